@@ -0,0 +1,190 @@
+package controller
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mabels/cloudflared-controller/controller/types"
+	"github.com/rs/zerolog"
+	"golang.org/x/time/rate"
+)
+
+// cfTransport is shared by all Cloudflare clients. It limits the request
+// rate with a token bucket, retries 429 and 5xx responses with backoff and
+// bounds every attempt with a timeout.
+type cfTransport struct {
+	base       http.RoundTripper
+	log        *zerolog.Logger
+	limiter    *rate.Limiter
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	timeout    time.Duration
+	now        func() time.Time
+	sleep      func(ctx context.Context, d time.Duration) error
+	// set in dry-run, mutating requests are only recorded
+	plan *types.Plan
+}
+
+func newCFTransport(log *zerolog.Logger, cfg *types.CFControllerCloudflareConfig, base http.RoundTripper) *cfTransport {
+	limit := rate.Inf
+	if cfg.RateLimit > 0 {
+		limit = rate.Limit(cfg.RateLimit)
+	}
+	burst := cfg.RateBurst
+	if burst < 1 {
+		burst = 1
+	}
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &cfTransport{
+		base:       base,
+		log:        log,
+		limiter:    rate.NewLimiter(limit, burst),
+		maxRetries: cfg.MaxRetries,
+		minBackoff: cfg.RetryMinBackoff,
+		maxBackoff: cfg.RetryMaxBackoff,
+		timeout:    cfg.RequestTimeout,
+		now:        time.Now,
+		sleep:      sleepContext,
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// a throttled request was not processed and is always retried, failed
+// requests only if they are idempotent
+func retryableStatus(method string, code int) bool {
+	return code == http.StatusTooManyRequests || (code >= 500 && idempotent(method))
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// retryAfter parses the Retry-After header, seconds or an http date
+func (t *cfTransport) retryAfter(resp *http.Response) (time.Duration, bool) {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		d := at.Sub(t.now())
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// backoff is exponential with full jitter, starting at minBackoff
+func (t *cfTransport) backoff(attempt int) time.Duration {
+	d := t.minBackoff << uint(attempt)
+	if d <= 0 || (t.maxBackoff > 0 && d > t.maxBackoff) {
+		d = t.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)) + 1)
+}
+
+// cancelBody cancels the timeout of an attempt once its body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (cb *cancelBody) Close() error {
+	err := cb.ReadCloser.Close()
+	cb.cancel()
+	return err
+}
+
+func (t *cfTransport) attempt(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	cancel := context.CancelFunc(func() {})
+	if t.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+	}
+	err := t.limiter.Wait(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+func (t *cfTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.plan != nil && mutating(req.Method) {
+		return t.planned(req)
+	}
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.Body != nil && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		resp, err := t.attempt(req)
+		// a body without GetBody can't be sent again
+		retryable := attempt < t.maxRetries && (req.Body == nil || req.GetBody != nil)
+		if err != nil {
+			if !retryable || !idempotent(req.Method) || req.Context().Err() != nil {
+				return nil, err
+			}
+			wait := t.backoff(attempt)
+			t.log.Warn().Err(err).Str("method", req.Method).Str("path", req.URL.Path).
+				Int("attempt", attempt+1).Dur("wait", wait).Msg("Cloudflare request failed, retrying")
+			if err := t.sleep(req.Context(), wait); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !retryableStatus(req.Method, resp.StatusCode) || !retryable {
+			return resp, nil
+		}
+		// Retry-After is honoured even beyond maxBackoff
+		wait, found := t.retryAfter(resp)
+		if !found {
+			wait = t.backoff(attempt)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		t.log.Warn().Int("status", resp.StatusCode).Str("method", req.Method).Str("path", req.URL.Path).
+			Int("attempt", attempt+1).Dur("wait", wait).Msg("Cloudflare request throttled, retrying")
+		if err := t.sleep(req.Context(), wait); err != nil {
+			return nil, err
+		}
+	}
+}
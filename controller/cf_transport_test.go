@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mabels/cloudflared-controller/controller/types"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func stubResponse(code int, header http.Header) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		StatusCode: code,
+		Header:     header,
+		Body:       io.NopCloser(strings.NewReader("{}")),
+	}
+}
+
+func testTransport(base roundTripFunc, sleeps *[]time.Duration) *cfTransport {
+	log := zerolog.Nop()
+	t := newCFTransport(&log, &types.CFControllerCloudflareConfig{
+		MaxRetries:      3,
+		RetryMinBackoff: time.Second,
+		RetryMaxBackoff: 4 * time.Second,
+		RequestTimeout:  time.Minute,
+	}, base)
+	t.sleep = func(ctx context.Context, d time.Duration) error {
+		*sleeps = append(*sleeps, d)
+		return nil
+	}
+	return t
+}
+
+func TestCFTransportRetryAfter(t *testing.T) {
+	calls := 0
+	sleeps := []time.Duration{}
+	tr := testTransport(func(req *http.Request) (*http.Response, error) {
+		calls++
+		if calls == 1 {
+			return stubResponse(http.StatusTooManyRequests, http.Header{"Retry-After": []string{"7"}}), nil
+		}
+		body, _ := io.ReadAll(req.Body)
+		assert.Equal(t, "payload", string(body))
+		return stubResponse(http.StatusOK, nil), nil
+	}, &sleeps)
+	req, _ := http.NewRequest(http.MethodPost, "https://api.cloudflare.com/client/v4/x", strings.NewReader("payload"))
+	resp, err := tr.RoundTrip(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, []time.Duration{7 * time.Second}, sleeps)
+}
+
+func TestCFTransportNoRetryOfFailedPost(t *testing.T) {
+	calls := 0
+	sleeps := []time.Duration{}
+	tr := testTransport(func(req *http.Request) (*http.Response, error) {
+		calls++
+		return stubResponse(http.StatusBadGateway, nil), nil
+	}, &sleeps)
+	req, _ := http.NewRequest(http.MethodPost, "https://api.cloudflare.com/client/v4/x", strings.NewReader("payload"))
+	resp, err := tr.RoundTrip(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Equal(t, 1, calls)
+	assert.Empty(t, sleeps)
+}
+
+func TestCFTransportRetriesGet(t *testing.T) {
+	calls := 0
+	sleeps := []time.Duration{}
+	tr := testTransport(func(req *http.Request) (*http.Response, error) {
+		calls++
+		if calls == 2 {
+			return nil, errors.New("connection reset")
+		}
+		return stubResponse(http.StatusServiceUnavailable, nil), nil
+	}, &sleeps)
+	req, _ := http.NewRequest(http.MethodGet, "https://api.cloudflare.com/client/v4/x", nil)
+	resp, err := tr.RoundTrip(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, 4, calls)
+	assert.Len(t, sleeps, 3)
+	for i, d := range sleeps {
+		assert.Greater(t, d, time.Duration(0))
+		assert.LessOrEqual(t, d, time.Second<<uint(i))
+	}
+}
+
+func TestCFTransportTimeout(t *testing.T) {
+	log := zerolog.Nop()
+	tr := newCFTransport(&log, &types.CFControllerCloudflareConfig{
+		RequestTimeout: 10 * time.Millisecond,
+	}, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}))
+	req, _ := http.NewRequest(http.MethodGet, "https://api.cloudflare.com/client/v4/x", nil)
+	_, err := tr.RoundTrip(req)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
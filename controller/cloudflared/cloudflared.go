@@ -17,6 +17,8 @@ import (
 	"github.com/google/uuid"
 	"github.com/mabels/cloudflared-controller/controller/config"
 	"github.com/mabels/cloudflared-controller/controller/k8s_data"
+	"github.com/mabels/cloudflared-controller/controller/placement"
+	"github.com/mabels/cloudflared-controller/controller/rules"
 	"github.com/mabels/cloudflared-controller/controller/types"
 	"github.com/mabels/cloudflared-controller/utils"
 	"github.com/rs/zerolog"
@@ -65,6 +67,11 @@ func (ri *runningInstance) buildCredentialsFile(cfc types.CFController, cm *core
 		ns = ret.Namespace
 		name = ret.Name
 	}
+	// the account of the tunnel secret is checked
+	cfc, err = withTunnelCredentials(cfc, cm)
+	if err != nil {
+		return credfname, err
+	}
 	cts, err := k8s_data.FetchSecret(cfc, ns, name, tunnelIdStr)
 	if err != nil {
 		return credfname, err
@@ -78,26 +85,21 @@ func (ri *runningInstance) buildCredentialsFile(cfc types.CFController, cm *core
 	return credfname, os.WriteFile(credfname, bytesCts, 0600)
 }
 
-func (ri *runningInstance) buildConfig(credfname string, cm *corev1.ConfigMap) (*types.CFConfigYaml, error) {
+func (ri *runningInstance) buildConfig(cfc types.CFController, credfname string, cm *corev1.ConfigMap) (*types.CFConfigYaml, error) {
 	tunnelId, found := cm.ObjectMeta.GetAnnotations()[config.AnnotationCloudflareTunnelId()]
 	if !found {
 		return nil, fmt.Errorf("missing label %s", config.AnnotationCloudflareTunnelId())
 	}
-	cfis := []types.CFConfigIngress{}
-	for _, rules := range cm.Data {
-		rule := []types.CFConfigIngress{}
-		err := yaml.Unmarshal([]byte(rules), &rule)
-		if err != nil {
-			ri.log.Error().Err(err).Str("rules", rules).Msg("error unmarshalling rules")
-			continue
-		}
-		cfis = append(cfis, rule...)
-	}
-	cfis = append(cfis, types.CFConfigIngress{Service: "http_status:404"})
 	igss := types.CFConfigYaml{
 		Tunnel:          tunnelId,
 		CredentialsFile: credfname,
-		Ingress:         cfis,
+	}
+	if !cfc.Cfg().CloudFlare.RemoteManaged() {
+		// without local rules cloudflared uses the remote configuration
+		igss.Ingress = rules.Ingress(rules.Build(ri.log, cm))
+		if rules.WarpRouting(ri.log, cm) {
+			igss.WarpRouting = &types.CFConfigWarpRouting{Enabled: true}
+		}
 	}
 	yConfigYamlByte, err := yaml.Marshal(igss)
 	if err != nil {
@@ -135,6 +137,15 @@ func (ri *runningInstance) Start(cfc types.CFController) error {
 	}
 	// cloudflared tunnel --config ./config.yml  run
 	cmds := []string{cfdFname, "tunnel", "--no-autoupdate", "--config", ri.configfname, "run"}
+	if cfc.Cfg().DryRun {
+		cfc.Plan().Record(&log, types.PlanEntry{
+			Target: "cloudflared",
+			Action: "start",
+			Object: ri.id,
+			Detail: strings.Join(cmds, " "),
+		})
+		return nil
+	}
 	ri.cmd = exec.Command(cfdFname, cmds[1:]...)
 
 	log.Info().Strs("cmds", cmds).Msg("starting cloudflared")
@@ -227,23 +238,13 @@ func (t *Tunnel) newRunningInstance(cfc types.CFController, cm *corev1.ConfigMap
 		ri.Stop(cfc)
 		return nil, err
 	}
-	cfgYaml, err := ri.buildConfig(credfname, cm)
+	// the DNS records are registered by the leader in updateCFTunnel
+	_, err = ri.buildConfig(cfc, credfname, cm)
 	if err != nil {
 		log.Error().Err(err).Msg("error building config file")
 		ri.Stop(cfc)
 		return nil, err
 	}
-	for _, rule := range cfgYaml.Ingress {
-		if rule.Hostname == "" {
-			continue
-		}
-		uid, err := uuid.Parse(cfgYaml.Tunnel)
-		if err != nil {
-			log.Error().Err(err).Str("tunnelId", cfgYaml.Tunnel).Msg("error parsing tunnel id")
-			continue
-		}
-		registerCFDnsEndpoint(cfc, uid, rule.Hostname)
-	}
 	err = ri.Start(cfc)
 	if err != nil {
 		log.Error().Err(err).Msg("error starting cloudflared")
@@ -276,13 +277,51 @@ func (t *Tunnel) newRunningInstance(cfc types.CFController, cm *corev1.ConfigMap
 	return ri, nil
 }
 
+func logRuleErrors(cfc types.CFController, errs []rules.RuleError) {
+	for _, err := range errs {
+		cfc.Log().Error().Err(err.Err).Str("key", err.Key).Int("rule", err.Index+1).
+			Str("hostname", err.Rule.Hostname).Str("path", err.Rule.Path).
+			Str("service", err.Rule.Service).Msg("invalid ingress rule")
+	}
+}
+
+func logRuleWarnings(cfc types.CFController, warns []rules.RuleError) {
+	for _, warn := range warns {
+		cfc.Log().Warn().Err(warn.Err).Str("key", warn.Key).Int("rule", warn.Index+1).
+			Str("hostname", warn.Rule.Hostname).Str("path", warn.Rule.Path).
+			Str("service", warn.Rule.Service).Msg("unreachable ingress rule")
+	}
+}
+
+// sameInstance is true if the running cloudflared can serve the ConfigMap.
+// With remote managed config the rules are picked up without a restart.
+func sameInstance(cfc types.CFController, running, cm *corev1.ConfigMap) bool {
+	if cfc.Cfg().CloudFlare.RemoteManaged() {
+		return running.Annotations[config.AnnotationCloudflareTunnelId()] == cm.Annotations[config.AnnotationCloudflareTunnelId()] &&
+			running.Annotations[config.AnnotationCloudflareTunnelK8sSecret()] == cm.Annotations[config.AnnotationCloudflareTunnelK8sSecret()]
+	}
+	return reflect.DeepEqual(running.Data, cm.Data) &&
+		rules.WarpRouting(cfc.Log(), running) == rules.WarpRouting(cfc.Log(), cm) &&
+		running.Annotations[config.AnnotationCloudflareTunnelFallback()] == cm.Annotations[config.AnnotationCloudflareTunnelFallback()]
+}
+
 func (t *Tunnel) Start(cfc types.CFController, cm *corev1.ConfigMap) {
 	t.processing.Lock()
 	defer t.processing.Unlock()
-	if t.ri != nil && reflect.DeepEqual(t.ri.currentConfigMap.Data, cm.Data) {
+	if t.ri != nil && sameInstance(cfc, t.ri.currentConfigMap, cm) {
 		t.ri.log.Info().Msg("already running no change")
 		return
 	}
+	if !cfc.Cfg().CloudFlare.RemoteManaged() {
+		// keep the running instance if cloudflared would refuse the new config
+		srules := rules.Build(cfc.Log(), cm)
+		errs := rules.Validate(srules)
+		if len(errs) > 0 {
+			logRuleErrors(cfc, errs)
+			return
+		}
+		logRuleWarnings(cfc, rules.Warnings(srules))
+	}
 
 	instanceToStop := t.ri
 	newri, err := t.newRunningInstance(cfc, cm)
@@ -302,6 +341,7 @@ func (t *Tunnel) Stop(cfc types.CFController) {
 	defer t.processing.Unlock()
 	if t.ri != nil {
 		t.ri.Stop(cfc)
+		t.ri = nil
 	}
 }
 
@@ -337,15 +377,42 @@ func (tr *TunnelRunner) Stop(cfc types.CFController, cm *corev1.ConfigMap) {
 	tr.getTunnel(cm.Name).Stop(cfc)
 }
 
-func ConfigMapHandlerStartCloudflared(_cfc types.CFController) func(cms []*corev1.ConfigMap, ev watch.Event) {
+func tunnelKey(cm *corev1.ConfigMap) string {
+	return cm.Namespace + "/" + cm.Name
+}
+
+func ConfigMapHandlerStartCloudflared(_cfc types.CFController, members *placement.Members) func(cms []*corev1.ConfigMap, ev watch.Event) {
 	cfc := _cfc.WithComponent("cloudflared")
 	tr := NewTunnelRunner()
+	placed := func(cm *corev1.ConfigMap) bool {
+		if members == nil {
+			return true
+		}
+		return members.Owns(tunnelKey(cm), placement.Connectors(cfc, cm.GetAnnotations()))
+	}
+	if members != nil {
+		cfc.RegisterShutdown(members.Register(func(_ []string) {
+			// reassign the tunnels after a replica joined or its lease expired
+			for _, cm := range cfc.K8sData().TunnelConfigMaps.Get() {
+				if placed(cm) {
+					tr.Start(cfc, cm)
+				} else {
+					tr.Stop(cfc, cm)
+				}
+			}
+		}))
+	}
 	return func(cms []*corev1.ConfigMap, ev watch.Event) {
 		cm, found := ev.Object.(*corev1.ConfigMap)
 		if !found {
 			cfc.Log().Error().Msg("error casting object")
 			return
 		}
+		if ev.Type != watch.Deleted && !placed(cm) {
+			cfc.Log().Debug().Str("tunnel", tunnelKey(cm)).Msg("tunnel placed on other replicas")
+			tr.Stop(cfc, cm)
+			return
+		}
 		// state, found := cm.Annotations[config.AnnotationCloudflareTunnelState()]
 		// if !found {
 		// 	cfc.Log().Error().Msg("error getting state")
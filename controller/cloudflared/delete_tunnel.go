@@ -0,0 +1,291 @@
+package cloudflared
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	cfgo "github.com/cloudflare/cloudflare-go"
+	"github.com/mabels/cloudflared-controller/controller/config"
+	"github.com/mabels/cloudflared-controller/controller/k8s_data"
+	"github.com/mabels/cloudflared-controller/controller/rules"
+	"github.com/mabels/cloudflared-controller/controller/types"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// deletionProtected is true if the deletion-protection annotation of the
+// tunnel ConfigMap is set or one of the source objects in its data was
+// protected when it wrote its rules or routes
+func deletionProtected(cfc types.CFController, cm *corev1.ConfigMap) bool {
+	if k8s_data.DeletionProtected(cm.Annotations) {
+		return true
+	}
+	for _, rule := range rules.FromConfigMap(cfc.Log(), cm) {
+		if rule.Rule.Meta != nil && rule.Rule.Meta.DeletionProtection {
+			return true
+		}
+	}
+	for _, route := range rules.PrivateRoutes(cfc.Log(), cm) {
+		if route.Route.DeletionProtection {
+			return true
+		}
+	}
+	return false
+}
+
+// tunnelDeletions delays the deletion of tunnels by the grace period, a
+// ConfigMap which comes back in time keeps its tunnel. The deadline is kept
+// in the deletion Lease of the tunnel, so the next leader continues the
+// pending deletions. A protected tunnel gets a deletion Lease without
+// deadline, it keeps its hostnames away from the DNS garbage collection.
+type tunnelDeletions struct {
+	lock sync.Mutex
+	// key namespace/name of the tunnel ConfigMap
+	timers map[string]*time.Timer
+	// key namespace/name of the tunnel ConfigMap
+	protected map[string]bool
+}
+
+func newTunnelDeletions() *tunnelDeletions {
+	return &tunnelDeletions{
+		timers:    make(map[string]*time.Timer),
+		protected: make(map[string]bool),
+	}
+}
+
+func sortedHostnames(hostnames map[string]bool) []string {
+	ret := make([]string, 0, len(hostnames))
+	for hostname := range hostnames {
+		ret = append(ret, hostname)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// parseHostnames reads the tunnel-delete-hostnames annotation
+func parseHostnames(value string) map[string]bool {
+	ret := make(map[string]bool)
+	for _, hostname := range strings.Split(value, ",") {
+		hostname = strings.TrimSpace(hostname)
+		if hostname != "" {
+			ret[hostname] = true
+		}
+	}
+	return ret
+}
+
+// deletionAnnotations are the annotations of the deletion Lease which
+// every deletion needs, the credentials-secret of the ConfigMap lets the
+// next leader find the tunnel in its account
+func deletionAnnotations(tp *types.CFTunnelParameter, cm *corev1.ConfigMap, hostnames map[string]bool) map[string]string {
+	annos := map[string]string{
+		config.AnnotationCloudflareTunnelName():            tp.Namespace + "/" + tp.Name,
+		config.AnnotationCloudflareTunnelDeleteHostnames(): strings.Join(sortedHostnames(hostnames), ","),
+	}
+	if value, found := cm.Annotations[config.AnnotationCloudflareCredentialsSecret()]; found {
+		annos[config.AnnotationCloudflareCredentialsSecret()] = value
+	}
+	return annos
+}
+
+func (td *tunnelDeletions) schedule(cfc types.CFController, tp *types.CFTunnelParameter, cm *corev1.ConfigMap) {
+	hostnames := hostnamesOf(cfc, []*corev1.ConfigMap{cm})
+	if deletionProtected(cfc, cm) {
+		cfc.Log().Warn().Str("name", tp.Name).Msg("Tunnel ConfigMap deleted, tunnel is deletion protected and kept")
+		annos := deletionAnnotations(tp, cm, hostnames)
+		annos[config.AnnotationCloudflareDeletionProtection()] = "true"
+		err := k8s_data.UpsertTunnelDeletion(cfc, tp, annos)
+		if err != nil {
+			cfc.Log().Error().Err(err).Str("name", tp.Name).Msg("Failed to store tunnel deletion protection")
+		}
+		td.lock.Lock()
+		td.protected[tp.K8SConfigMapName().FQDN] = true
+		td.lock.Unlock()
+		return
+	}
+	grace := cfc.Cfg().CloudFlare.TunnelDeleteGrace
+	if grace <= 0 {
+		deleteCFTunnel(cfc, tp, hostnames)
+		return
+	}
+	// the next leader finds the tunnel by its name
+	annos := deletionAnnotations(tp, cm, hostnames)
+	annos[config.AnnotationCloudflareTunnelDeleteAfter()] = time.Now().Add(grace).UTC().Format(time.RFC3339)
+	err := k8s_data.UpsertTunnelDeletion(cfc, tp, annos)
+	if err != nil {
+		cfc.Log().Error().Err(err).Str("name", tp.Name).Msg("Failed to store tunnel deletion deadline")
+	}
+	cfc.Log().Info().Str("name", tp.Name).Dur("grace", grace).Msg("Tunnel ConfigMap deleted, deleting tunnel after grace period")
+	td.start(cfc, tp, hostnames, grace)
+}
+
+func (td *tunnelDeletions) start(cfc types.CFController, tp *types.CFTunnelParameter, hostnames map[string]bool, delay time.Duration) {
+	key := tp.K8SConfigMapName().FQDN
+	td.lock.Lock()
+	defer td.lock.Unlock()
+	if timer, found := td.timers[key]; found {
+		timer.Stop()
+	}
+	td.timers[key] = time.AfterFunc(delay, func() {
+		td.lock.Lock()
+		delete(td.timers, key)
+		td.lock.Unlock()
+		if deleteCFTunnel(cfc, tp, hostnames) == nil {
+			unmarkDeletion(cfc, tp)
+		}
+	})
+}
+
+func (td *tunnelDeletions) cancel(cfc types.CFController, tp *types.CFTunnelParameter) {
+	key := tp.K8SConfigMapName().FQDN
+	td.lock.Lock()
+	timer, found := td.timers[key]
+	if found {
+		timer.Stop()
+		delete(td.timers, key)
+	}
+	protected := td.protected[key]
+	delete(td.protected, key)
+	td.lock.Unlock()
+	if found || protected {
+		unmarkDeletion(cfc, tp)
+	}
+	if found {
+		cfc.Log().Info().Str("configMap", key).Msg("Tunnel ConfigMap is back, tunnel deletion canceled")
+	}
+}
+
+func unmarkDeletion(cfc types.CFController, tp *types.CFTunnelParameter) {
+	err := k8s_data.DeleteTunnelDeletion(cfc, tp)
+	if err != nil && !errors.IsNotFound(err) {
+		cfc.Log().Error().Err(err).Str("name", tp.Name).Msg("Failed to remove tunnel deletion deadline")
+	}
+}
+
+// restore continues the deletions of a previous leader from the deletion
+// Leases, a tunnel whose ConfigMap is back is kept
+func (td *tunnelDeletions) restore(cfc types.CFController) {
+	leases, err := k8s_data.ListTunnelDeletions(cfc)
+	if err != nil {
+		cfc.Log().Error().Err(err).Msg("Failed to list tunnel deletions")
+		return
+	}
+	for _, lease := range leases {
+		tp, err := k8s_data.NewUniqueTunnelParams().GetConfigMapTunnelParam(cfc, &lease.ObjectMeta)
+		if err != nil {
+			cfc.Log().Error().Err(err).Str("lease", lease.Namespace+"/"+lease.Name).Msg("Failed to read tunnel of pending deletion")
+			continue
+		}
+		_, err = cfc.Rest().K8s().CoreV1().ConfigMaps(tp.K8SConfigMapName().Namespace).Get(cfc.Context(), tp.K8SConfigMapName().Name, metav1.GetOptions{})
+		if err == nil {
+			unmarkDeletion(cfc, tp)
+			continue
+		}
+		if !errors.IsNotFound(err) {
+			cfc.Log().Error().Err(err).Str("name", tp.Name).Msg("Failed to read tunnel ConfigMap")
+			continue
+		}
+		if _, found := lease.Annotations[config.AnnotationCloudflareDeletionProtection()]; found {
+			td.lock.Lock()
+			td.protected[tp.K8SConfigMapName().FQDN] = true
+			td.lock.Unlock()
+			continue
+		}
+		deadline, err := time.Parse(time.RFC3339, lease.Annotations[config.AnnotationCloudflareTunnelDeleteAfter()])
+		if err != nil {
+			cfc.Log().Warn().Err(err).Str("name", tp.Name).Msg("Invalid tunnel deletion deadline, deleting after grace period")
+			deadline = time.Now().Add(cfc.Cfg().CloudFlare.TunnelDeleteGrace)
+		}
+		// the tunnel lives in the account of the deleted ConfigMap
+		scoped, err := withTunnelCredentials(cfc, &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+			Namespace:   tp.K8SConfigMapName().Namespace,
+			Annotations: lease.Annotations,
+		}})
+		if err != nil {
+			cfc.Log().Error().Err(err).Str("name", tp.Name).Msg("Failed to read credentials of pending deletion")
+			continue
+		}
+		delay := time.Until(deadline)
+		if delay < 0 {
+			delay = 0
+		}
+		cfc.Log().Info().Str("name", tp.Name).Dur("delay", delay).Msg("Continuing pending tunnel deletion")
+		td.start(scoped, tp, parseHostnames(lease.Annotations[config.AnnotationCloudflareTunnelDeleteHostnames()]), delay)
+	}
+}
+
+func (td *tunnelDeletions) stop() {
+	td.lock.Lock()
+	defer td.lock.Unlock()
+	for key, timer := range td.timers {
+		timer.Stop()
+		delete(td.timers, key)
+	}
+	for key := range td.protected {
+		delete(td.protected, key)
+	}
+}
+
+// deleteCFTunnel tears the tunnel down: first the DNS records of its
+// hostnames and its private routes, then the connections, the tunnel and
+// at last the secret.
+// hostnames are the hostnames of the deleted ConfigMap.
+func deleteCFTunnel(cfc types.CFController, tp *types.CFTunnelParameter, hostnames map[string]bool) error {
+	tunnels, err := findTunnelFromCF(cfc, tp)
+	if err != nil {
+		cfc.Log().Error().Err(err).Msg("Error finding tunnel")
+		return err
+	}
+	if len(hostnames) > 0 {
+		desired := desiredHostnames(cfc)
+		for hostname := range hostnames {
+			if desired[hostname] {
+				// moved to another tunnel
+				continue
+			}
+			zone, err := cfc.Rest().ZoneForHostname(hostname)
+			if err != nil {
+				cfc.Log().Error().Err(err).Str("dnsName", hostname).Msg("Error resolving zone")
+				continue
+			}
+			releaseDNSRecord(cfc, zone.ID, hostname)
+			releaseLoadBalancer(cfc, zone.ID, hostname)
+		}
+	}
+	if len(tunnels) != 0 {
+		api, err := cfc.Rest().Cfgo()
+		if err != nil {
+			cfc.Log().Error().Err(err).Msg("Can't find CF client")
+			return err
+		}
+		removePrivateRoutes(cfc, &types.CFTunnelParameterWithID{
+			CFTunnelParameter: *tp,
+			ID:                tunnels[0].ID,
+		})
+		rc := cfgo.AccountIdentifier(cfc.Cfg().CloudFlare.AccountId)
+		tunnelId := tunnels[0].ID.String()
+		// a tunnel with connections can't be deleted
+		err = api.CleanupTunnelConnections(cfc.Context(), rc, tunnelId)
+		if err != nil {
+			cfc.Log().Error().Err(err).Str("tunnelId", tunnelId).Msg("Error cleaning up tunnel connections")
+			return err
+		}
+		err = api.DeleteTunnel(cfc.Context(), rc, tunnelId)
+		if err != nil {
+			cfc.Log().Error().Err(err).Str("tunnelId", tunnelId).Msg("Error deleting tunnel")
+			return err
+		}
+		cfc.Log().Info().Str("name", tp.Name).Str("tunnelId", tunnelId).Msg("Deleted tunnel")
+	} else {
+		cfc.Log().Info().Str("name", tp.Name).Msg("Tunnel not found")
+	}
+	err = k8s_data.DeleteSecret(cfc, tp)
+	if err != nil && !errors.IsNotFound(err) {
+		cfc.Log().Error().Err(err).Msg("Error deleting tunnel secret")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package cloudflared
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mabels/cloudflared-controller/controller"
+	"github.com/mabels/cloudflared-controller/controller/config"
+	"github.com/mabels/cloudflared-controller/controller/types"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	coordv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func tunnelCM(name string, annos map[string]string, data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "default",
+			Annotations: annos,
+		},
+		Data: data,
+	}
+}
+
+func TestDeletionProtected(t *testing.T) {
+	log := zerolog.Nop()
+	cfc := controller.NewCFController(&log)
+	anno := config.AnnotationCloudflareDeletionProtection()
+	assert.False(t, deletionProtected(cfc, tunnelCM("a", nil, nil)))
+	assert.True(t, deletionProtected(cfc, tunnelCM("a", map[string]string{anno: "true"}, nil)))
+	assert.False(t, deletionProtected(cfc, tunnelCM("a", map[string]string{anno: "false"}, nil)))
+	assert.True(t, deletionProtected(cfc, tunnelCM("a", map[string]string{anno: "yes please"}, nil)))
+
+	// the source objects protect through their rules and routes
+	data := map[string]string{
+		"ingress-default-a": "- hostname: a.example.com\n  service: http://a\n",
+		"ingress-default-b": "- hostname: b.example.com\n  service: http://b\n  meta:\n    deletionProtection: true\n",
+	}
+	assert.True(t, deletionProtected(cfc, tunnelCM("a", nil, data)))
+	// the annotation was removed from ingress b
+	data["ingress-default-b"] = "- hostname: b.example.com\n  service: http://b\n"
+	assert.False(t, deletionProtected(cfc, tunnelCM("a", nil, data)))
+	data["private-routes.service-default-c"] = "- network: 10.43.0.1/32\n"
+	data["private-routes.service-default-d"] = "- network: 10.43.0.1/32\n  deletionProtection: true\n"
+	assert.True(t, deletionProtected(cfc, tunnelCM("a", nil, data)))
+}
+
+// k8sWrites serves an empty k8s API and records the writes with their bodies
+func k8sWrites(t *testing.T, cfc types.CFController) *[]string {
+	writes := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodGet {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		writes = append(writes, r.Method+" "+r.URL.Path+" "+string(body))
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(srv.Close)
+	cs, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	assert.NoError(t, err)
+	cfc.Rest().SetK8s(cs)
+	return &writes
+}
+
+func TestTunnelDeletionsCancel(t *testing.T) {
+	log := zerolog.Nop()
+	cfc := controller.NewCFController(&log)
+	cfc.SetCfg(&types.CFControllerConfig{})
+	cfc.Cfg().CloudFlare.TunnelDeleteGrace = time.Hour
+	writes := k8sWrites(t, cfc)
+	td := newTunnelDeletions()
+	cm := tunnelCM("a", nil, map[string]string{"ingress-default-a": "- hostname: a.example.com\n  service: http://a\n"})
+	tp := &types.CFTunnelParameter{Namespace: "default", Name: "a"}
+	td.schedule(cfc, tp, cm)
+	assert.Len(t, td.timers, 1)
+	// the deadline survives a change of the leader
+	assert.Len(t, *writes, 1)
+	assert.Contains(t, (*writes)[0], "POST /apis/coordination.k8s.io/v1/namespaces/default/leases ")
+	assert.Contains(t, (*writes)[0], `"name":"cfd-tunnel-del.a"`)
+	assert.Contains(t, (*writes)[0], config.AnnotationCloudflareTunnelDeleteAfter())
+	assert.Contains(t, (*writes)[0], `"a.example.com"`)
+	td.cancel(cfc, tp)
+	assert.Len(t, td.timers, 0)
+	assert.Len(t, *writes, 2)
+	assert.Contains(t, (*writes)[1], "DELETE /apis/coordination.k8s.io/v1/namespaces/default/leases/cfd-tunnel-del.a ")
+
+	// protected tunnels are never scheduled
+	cm = tunnelCM("b", map[string]string{config.AnnotationCloudflareDeletionProtection(): "true"}, nil)
+	td.schedule(cfc, &types.CFTunnelParameter{Namespace: "default", Name: "b"}, cm)
+	assert.Len(t, td.timers, 0)
+	assert.True(t, td.protected["default/cfd-tunnel-cfg.b"])
+	assert.Contains(t, (*writes)[2], config.AnnotationCloudflareDeletionProtection())
+}
+
+func TestParseHostnames(t *testing.T) {
+	assert.Equal(t, map[string]bool{"a.example.com": true, "b.example.com": true}, parseHostnames(" a.example.com,,b.example.com "))
+	assert.Equal(t, map[string]bool{}, parseHostnames(""))
+}
+
+func TestDNSGCRetiresDeletedTunnel(t *testing.T) {
+	log := zerolog.Nop()
+	cfc := controller.NewCFController(&log)
+	cfc.SetCfg(&types.CFControllerConfig{})
+	cfc.Cfg().DNS.GCDelay = time.Hour
+	gc := &dnsGarbageCollector{
+		cfc:     cfc,
+		known:   make(map[string]bool),
+		pending: make(map[string]bool),
+		retired: make(map[string]bool),
+	}
+	a := tunnelCM("a", nil, map[string]string{"ingress-default-a": "- hostname: a.example.com\n  service: http://a\n"})
+	b := tunnelCM("b", nil, map[string]string{"ingress-default-b": "- hostname: b.example.com\n  service: http://b\n"})
+	gc.observe([]*corev1.ConfigMap{a, b}, watch.Event{Type: watch.Added, Object: b})
+	// removed from a tunnel ConfigMap
+	b.Data = map[string]string{}
+	gc.observe([]*corev1.ConfigMap{a, b}, watch.Event{Type: watch.Modified, Object: b})
+	// the whole tunnel ConfigMap is deleted
+	gc.observe([]*corev1.ConfigMap{b}, watch.Event{Type: watch.Deleted, Object: a})
+	assert.Equal(t, map[string]bool{"b.example.com": true}, gc.pending)
+	assert.Equal(t, map[string]bool{"a.example.com": true}, gc.retired)
+	gc.timer.Stop()
+}
+
+// staticTunnelConfigMaps are the tunnel ConfigMaps known to a fresh leader
+type staticTunnelConfigMaps struct {
+	types.TunnelConfigMaps
+	cms []*corev1.ConfigMap
+}
+
+func (s *staticTunnelConfigMaps) Get() []*corev1.ConfigMap {
+	return s.cms
+}
+
+func TestDNSGCFreshLeader(t *testing.T) {
+	log := zerolog.Nop()
+	cfc := controller.NewCFController(&log)
+	cfc.SetCfg(&types.CFControllerConfig{})
+	cfc.Cfg().Leader.Name = "cloudflared-controller"
+	cfc.Cfg().CloudFlare.TunnelDeleteGrace = time.Hour
+	cfc.K8sData().TunnelConfigMaps = &staticTunnelConfigMaps{cms: []*corev1.ConfigMap{
+		tunnelCM("a", nil, map[string]string{"ingress-default-a": "- hostname: a.example.com\n  service: http://a\n"}),
+	}}
+	// the deletion Leases of the previous leader
+	leases := coordv1.LeaseList{Items: []coordv1.Lease{{
+		ObjectMeta: metav1.ObjectMeta{Name: "cfd-tunnel-del.p", Namespace: "default", Annotations: map[string]string{
+			config.AnnotationCloudflareTunnelName():            "default/p",
+			config.AnnotationCloudflareDeletionProtection():    "true",
+			config.AnnotationCloudflareTunnelDeleteHostnames(): "p.example.com",
+		}},
+	}, {
+		ObjectMeta: metav1.ObjectMeta{Name: "cfd-tunnel-del.d", Namespace: "default", Annotations: map[string]string{
+			config.AnnotationCloudflareTunnelName():            "default/d",
+			config.AnnotationCloudflareTunnelDeleteAfter():     time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+			config.AnnotationCloudflareTunnelDeleteHostnames(): "a.example.com,d.example.com",
+		}},
+	}}}
+	selectors := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/apis/coordination.k8s.io/v1/leases" {
+			selectors = append(selectors, r.URL.Query().Get("labelSelector"))
+			json.NewEncoder(w).Encode(leases)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+	}))
+	defer srv.Close()
+	cs, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	assert.NoError(t, err)
+	cfc.Rest().SetK8s(cs)
+
+	// no ConfigMap was deleted while this leader runs
+	gc := &dnsGarbageCollector{
+		cfc:     cfc,
+		known:   make(map[string]bool),
+		pending: make(map[string]bool),
+		retired: make(map[string]bool),
+	}
+	desired, err := gc.desired()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"a.example.com": true, "d.example.com": true, "p.example.com": true}, desired)
+	assert.Equal(t, map[string]bool{"d.example.com": true, "p.example.com": true}, gc.retired)
+	assert.Equal(t, []string{"cloudflared-controller/deletion-of=cloudflared-controller"}, selectors)
+
+	td := newTunnelDeletions()
+	td.restore(cfc)
+	assert.Equal(t, map[string]bool{"default/cfd-tunnel-cfg.p": true}, td.protected)
+	assert.Len(t, td.timers, 1)
+	assert.NotNil(t, td.timers["default/cfd-tunnel-cfg.d"])
+	td.stop()
+}
+
+func TestTunnelDeletionsRestoreCredentials(t *testing.T) {
+	log := zerolog.Nop()
+	cfc := controller.NewCFController(&log)
+	cfc.SetCfg(&types.CFControllerConfig{})
+	cfc.Cfg().Leader.Name = "cloudflared-controller"
+	cfc.Cfg().CloudFlare.ApiToken = "token"
+	cfc.Cfg().CloudFlare.AccountId = "controller-account"
+	accounts := make(chan string, 1)
+	cf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case accounts <- r.URL.Path:
+		default:
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"success":true,"errors":[],"messages":[],"result":[]}`))
+	}))
+	defer cf.Close()
+	cfc.Cfg().CloudFlare.ApiUrl = cf.URL
+
+	// the tunnel ConfigMap of team-a was deleted with its own credentials
+	leases := coordv1.LeaseList{Items: []coordv1.Lease{{
+		ObjectMeta: metav1.ObjectMeta{Name: "cfd-tunnel-del.t", Namespace: "team-a", Annotations: map[string]string{
+			config.AnnotationCloudflareTunnelName():        "team-a/t",
+			config.AnnotationCloudflareTunnelDeleteAfter(): time.Now().Add(-time.Minute).UTC().Format(time.RFC3339),
+			config.AnnotationCloudflareCredentialsSecret(): "cloudflare",
+		}},
+	}}}
+	secret := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "cloudflare", Namespace: "team-a"},
+		Data: map[string][]byte{
+			"CLOUDFLARE_API_TOKEN":  []byte("team-token"),
+			"CLOUDFLARE_ACCOUNT_ID": []byte("team-account"),
+		},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/apis/coordination.k8s.io/v1/leases":
+			json.NewEncoder(w).Encode(leases)
+		case r.URL.Path == "/api/v1/namespaces/team-a/secrets/cloudflare":
+			json.NewEncoder(w).Encode(secret)
+		case r.Method == http.MethodDelete:
+			w.Write([]byte("{}"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+		}
+	}))
+	defer srv.Close()
+	cs, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	assert.NoError(t, err)
+	cfc.Rest().SetK8s(cs)
+
+	td := newTunnelDeletions()
+	td.restore(cfc)
+	defer td.stop()
+	select {
+	case path := <-accounts:
+		assert.Equal(t, "/accounts/team-account/cfd_tunnel", path)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the pending deletion did not look up the tunnel")
+	}
+}
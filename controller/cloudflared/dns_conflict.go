@@ -0,0 +1,150 @@
+package cloudflared
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	cfgo "github.com/cloudflare/cloudflare-go"
+	"github.com/google/uuid"
+	"github.com/mabels/cloudflared-controller/controller/config"
+	"github.com/mabels/cloudflared-controller/controller/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+)
+
+type dnsConflictError struct {
+	Hostname string
+	Type     string
+	Target   string
+}
+
+func (e *dnsConflictError) Error() string {
+	return fmt.Sprintf("DNS record %s %s points to %s and not to the tunnel", e.Type, e.Hostname, e.Target)
+}
+
+// addressRecords are the records of name which a tunnel CNAME replaces
+func addressRecords(cfc types.CFController, zoneId string, name string) ([]cfgo.DNSRecord, error) {
+	api, err := cfc.Rest().Cfgo()
+	if err != nil {
+		return nil, err
+	}
+	recs, _, err := api.ListDNSRecords(cfc.Context(), cfgo.ZoneIdentifier(zoneId), cfgo.ListDNSRecordsParams{
+		Name: name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]cfgo.DNSRecord, 0, len(recs))
+	for _, rec := range recs {
+		switch rec.Type {
+		case "CNAME", "A", "AAAA":
+			ret = append(ret, rec)
+		}
+	}
+	return ret, nil
+}
+
+func pointsToTunnel(recs []cfgo.DNSRecord, tunnelId uuid.UUID) bool {
+	return len(recs) == 1 && recs[0].Type == "CNAME" && recs[0].Content == tunnelTarget(tunnelId)
+}
+
+func logDNSConflict(cfc types.CFController, hostname string, recs []cfgo.DNSRecord, policy types.DNSConflictPolicy) {
+	for _, rec := range recs {
+		cfc.Log().Warn().Str("dnsName", hostname).Str("record", rec.Type+" "+rec.Name).
+			Str("target", rec.Content).Str("policy", string(policy)).Msg("DNS record conflict")
+	}
+}
+
+// replaceDNSRecords replaces the records of hostname by the tunnel CNAME
+func replaceDNSRecords(cfc types.CFController, zoneId string, tunnelId uuid.UUID, hostname string, recs []cfgo.DNSRecord, opts dnsRecordOptions) error {
+	api, err := cfc.Rest().Cfgo()
+	if err != nil {
+		return err
+	}
+	// a CNAME can't coexist with other address records
+	for _, rec := range recs[1:] {
+		err = api.DeleteDNSRecord(cfc.Context(), cfgo.ZoneIdentifier(zoneId), rec.ID)
+		if err != nil {
+			cfc.Log().Error().Err(err).Str("dnsName", hostname).Str("record", rec.Type+" "+rec.Name).Msg("Error deleting DNS record")
+			return err
+		}
+	}
+	return updateTunnelRecord(cfc, zoneId, tunnelId, &recs[0], opts)
+}
+
+// resolveDNSConflict applies policy to the existing records of hostname,
+// records we own are moved to the tunnel without asking the policy.
+// It returns true if the records were replaced by the tunnel CNAME.
+func resolveDNSConflict(cfc types.CFController, zoneId string, tunnelId uuid.UUID, hostname string, recs []cfgo.DNSRecord, policy types.DNSConflictPolicy, opts dnsRecordOptions) (bool, error) {
+	owned, err := ownsDNSRecord(cfc, zoneId, hostname)
+	if err != nil {
+		return false, err
+	}
+	if owned {
+		// the hostname moved to this tunnel or the tunnel was recreated
+		err = replaceDNSRecords(cfc, zoneId, tunnelId, hostname, recs, opts)
+		if err != nil {
+			cfc.Log().Error().Err(err).Str("dnsName", hostname).Msg("Error updating DNS record")
+			return false, err
+		}
+		cfc.Log().Info().Str("dnsName", hostname).Str("target", recs[0].Content).Msg("Moved DNS record to tunnel")
+		return true, nil
+	}
+	if policy == "" {
+		policy = types.DNSConflictSkip
+	}
+	logDNSConflict(cfc, hostname, recs, policy)
+	switch policy {
+	case types.DNSConflictOverwrite:
+		err = replaceDNSRecords(cfc, zoneId, tunnelId, hostname, recs, opts)
+		if err != nil {
+			cfc.Log().Error().Err(err).Str("dnsName", hostname).Msg("Error overwriting DNS record")
+			return false, err
+		}
+		cfc.Log().Info().Str("dnsName", hostname).Str("target", recs[0].Content).Msg("Overwrote DNS record")
+		return true, nil
+	case types.DNSConflictFail:
+		return false, &dnsConflictError{
+			Hostname: hostname,
+			Type:     recs[0].Type,
+			Target:   recs[0].Content,
+		}
+	}
+	return false, nil
+}
+
+// markDNSError sets or clears the dns-error annotation of the source
+// object, source is kind/namespace/name
+func markDNSError(cfc types.CFController, source string, dnsErr error) error {
+	parts := strings.SplitN(source, "/", 3)
+	if len(parts) != 3 {
+		return fmt.Errorf("invalid source %s", source)
+	}
+	var value interface{}
+	if dnsErr != nil {
+		value = dnsErr.Error()
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				config.AnnotationCloudflareDNSError(): value,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	switch parts[0] {
+	case "ingress":
+		_, err = cfc.Rest().K8s().NetworkingV1().Ingresses(parts[1]).Patch(cfc.Context(), parts[2], k8stypes.MergePatchType, patch, metav1.PatchOptions{})
+	case "service":
+		_, err = cfc.Rest().K8s().CoreV1().Services(parts[1]).Patch(cfc.Context(), parts[2], k8stypes.MergePatchType, patch, metav1.PatchOptions{})
+	default:
+		return fmt.Errorf("unknown kind %s", parts[0])
+	}
+	if err != nil {
+		cfc.Log().Error().Err(err).Str("source", source).Msg("Error marking source object")
+	}
+	return err
+}
@@ -0,0 +1,103 @@
+package cloudflared
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	cfgo "github.com/cloudflare/cloudflare-go"
+	"github.com/google/uuid"
+	"github.com/mabels/cloudflared-controller/controller"
+	"github.com/mabels/cloudflared-controller/controller/types"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+type dnsCalls struct {
+	updated []cfgo.DNSRecord
+	deleted []string
+	// every other request
+	other []string
+}
+
+// dnsServer serves the ownership records of owners and the address records
+// of records and records the changes
+func dnsServer(t *testing.T, cfc types.CFController, owners map[string]string, records map[string][]cfgo.DNSRecord) *dnsCalls {
+	calls := &dnsCalls{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var result interface{}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/zones/zone/dns_records":
+			name := r.URL.Query().Get("name")
+			recs := []cfgo.DNSRecord{}
+			if r.URL.Query().Get("type") == "TXT" {
+				if content, found := owners[name]; found {
+					recs = append(recs, cfgo.DNSRecord{ID: "txt", Type: "TXT", Name: name, Content: content})
+				}
+			} else {
+				recs = append(recs, records[name]...)
+			}
+			result = recs
+		case r.Method == http.MethodPatch || r.Method == http.MethodPut:
+			rec := cfgo.DNSRecord{}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&rec))
+			calls.updated = append(calls.updated, rec)
+			result = rec
+		case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/zones/zone/dns_records/"):
+			calls.deleted = append(calls.deleted, strings.TrimPrefix(r.URL.Path, "/zones/zone/dns_records/"))
+			result = cfgo.DNSRecord{}
+		default:
+			calls.other = append(calls.other, r.Method+" "+r.URL.Path)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"success":false,"errors":[{"code":1000,"message":"unexpected"}],"messages":[],"result":null}`))
+			return
+		}
+		out, _ := json.Marshal(map[string]interface{}{"success": true, "errors": []interface{}{}, "messages": []interface{}{}, "result": result})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+	}))
+	t.Cleanup(srv.Close)
+	api, err := cfc.Rest().Cfgo()
+	assert.NoError(t, err)
+	api.BaseURL = srv.URL
+	return calls
+}
+
+func dnsController() types.CFController {
+	log := zerolog.Nop()
+	cfc := controller.NewCFController(&log)
+	cfg := types.CFControllerConfig{ClusterName: "eu"}
+	cfg.CloudFlare.ApiToken = "token"
+	cfg.CloudFlare.AccountId = "acc"
+	cfc.SetCfg(&cfg)
+	return cfc
+}
+
+func TestResolveDNSConflictOwnedRecord(t *testing.T) {
+	cfc := dnsController()
+	calls := dnsServer(t, cfc, map[string]string{
+		ownerRecordName("www.example.com"):   dnsOwner{Heritage: ownerHeritage, Cluster: "eu", Source: "ingress/default/www"}.String(),
+		ownerRecordName("other.example.com"): dnsOwner{Heritage: ownerHeritage, Cluster: "us", Source: "ingress/default/other"}.String(),
+	}, nil)
+
+	tunnelId := uuid.New()
+	oldTunnel := tunnelTarget(uuid.New())
+	// our record of the old tunnel is moved even if the policy skips
+	replaced, err := resolveDNSConflict(cfc, "zone", tunnelId, "www.example.com",
+		[]cfgo.DNSRecord{{ID: "www", Type: "CNAME", Name: "www.example.com", Content: oldTunnel}},
+		types.DNSConflictSkip, dnsRecordOptions{Proxied: true, TTL: 1})
+	assert.NoError(t, err)
+	assert.True(t, replaced)
+	assert.Len(t, calls.updated, 1)
+	assert.Equal(t, tunnelTarget(tunnelId), calls.updated[0].Content)
+
+	// the record of another cluster is left alone
+	replaced, err = resolveDNSConflict(cfc, "zone", tunnelId, "other.example.com",
+		[]cfgo.DNSRecord{{ID: "other", Type: "CNAME", Name: "other.example.com", Content: oldTunnel}},
+		types.DNSConflictSkip, dnsRecordOptions{Proxied: true, TTL: 1})
+	assert.NoError(t, err)
+	assert.False(t, replaced)
+	assert.Len(t, calls.updated, 1)
+}
@@ -0,0 +1,268 @@
+package cloudflared
+
+import (
+	"sync"
+	"time"
+
+	cfgo "github.com/cloudflare/cloudflare-go"
+	"github.com/mabels/cloudflared-controller/controller/config"
+	"github.com/mabels/cloudflared-controller/controller/k8s_data"
+	"github.com/mabels/cloudflared-controller/controller/rules"
+	"github.com/mabels/cloudflared-controller/controller/types"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+type dnsGarbageCollector struct {
+	cfc types.CFController
+
+	lock sync.Mutex
+	// hostnames of the last seen tunnel ConfigMaps
+	known map[string]bool
+	// removed hostnames waiting for GCDelay
+	pending map[string]bool
+	// hostnames of deleted tunnel ConfigMaps, the tunnel teardown owns them
+	retired map[string]bool
+	// retired contains the tunnel deletions of the previous leaders
+	seeded bool
+	timer  *time.Timer
+}
+
+func hostnamesOf(cfc types.CFController, cms []*corev1.ConfigMap) map[string]bool {
+	ret := make(map[string]bool)
+	for _, cm := range cms {
+		for _, rule := range rules.FromConfigMap(cfc.Log(), cm) {
+			if rule.Rule.Hostname != "" {
+				ret[rule.Rule.Hostname] = true
+			}
+		}
+	}
+	return ret
+}
+
+// observe queues the hostnames which left all tunnel ConfigMaps
+func (gc *dnsGarbageCollector) observe(cms []*corev1.ConfigMap, ev watch.Event) {
+	current := hostnamesOf(gc.cfc, cms)
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	if cm, ok := ev.Object.(*corev1.ConfigMap); ok && ev.Type == watch.Deleted {
+		for hostname := range hostnamesOf(gc.cfc, []*corev1.ConfigMap{cm}) {
+			if !current[hostname] {
+				gc.retired[hostname] = true
+			}
+		}
+	}
+	for hostname := range current {
+		delete(gc.retired, hostname)
+	}
+	for hostname := range gc.known {
+		if !current[hostname] && !gc.retired[hostname] {
+			gc.pending[hostname] = true
+		}
+	}
+	gc.known = current
+	if len(gc.pending) > 0 && gc.timer == nil {
+		gc.timer = time.AfterFunc(gc.cfc.Cfg().DNS.GCDelay, gc.collectPending)
+	}
+}
+
+// seed retires the hostnames of the pending and protected tunnel deletions,
+// the ConfigMaps of these tunnels were deleted before this leader started
+func (gc *dnsGarbageCollector) seed() error {
+	gc.lock.Lock()
+	seeded := gc.seeded
+	gc.lock.Unlock()
+	if seeded {
+		return nil
+	}
+	leases, err := k8s_data.ListTunnelDeletions(gc.cfc)
+	if err != nil {
+		return err
+	}
+	current := desiredHostnames(gc.cfc)
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	for _, lease := range leases {
+		for hostname := range parseHostnames(lease.Annotations[config.AnnotationCloudflareTunnelDeleteHostnames()]) {
+			if !current[hostname] {
+				gc.retired[hostname] = true
+			}
+		}
+	}
+	gc.seeded = true
+	return nil
+}
+
+// desired are the hostnames of all tunnel ConfigMaps and the retired ones
+func (gc *dnsGarbageCollector) desired() (map[string]bool, error) {
+	err := gc.seed()
+	if err != nil {
+		return nil, err
+	}
+	ret := desiredHostnames(gc.cfc)
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	for hostname := range gc.retired {
+		ret[hostname] = true
+	}
+	return ret, nil
+}
+
+// scopes are the controllers of all Cloudflare accounts of the tunnel
+// ConfigMaps, the one of the controller first
+func (gc *dnsGarbageCollector) scopes() []types.CFController {
+	ret := []types.CFController{gc.cfc}
+	seen := map[string]bool{}
+	for _, cm := range gc.cfc.K8sData().TunnelConfigMaps.Get() {
+		creds, err := k8s_data.TunnelCredentials(gc.cfc, cm.Namespace, cm.Annotations)
+		if err != nil {
+			gc.cfc.Log().Error().Err(err).Str("configMap", cm.Namespace+"/"+cm.Name).Msg("Error getting tunnel credentials")
+			continue
+		}
+		if creds == nil || seen[creds.Secret] {
+			continue
+		}
+		seen[creds.Secret] = true
+		ret = append(ret, gc.cfc.WithCredentials(creds))
+	}
+	return ret
+}
+
+func (gc *dnsGarbageCollector) collectPending() {
+	gc.lock.Lock()
+	pending := gc.pending
+	gc.pending = make(map[string]bool)
+	gc.timer = nil
+	gc.lock.Unlock()
+	desired, err := gc.desired()
+	if err != nil {
+		gc.cfc.Log().Error().Err(err).Msg("Error reading tunnel deletions, retrying")
+		gc.lock.Lock()
+		for hostname := range pending {
+			gc.pending[hostname] = true
+		}
+		if gc.timer == nil {
+			gc.timer = time.AfterFunc(gc.cfc.Cfg().DNS.GCDelay, gc.collectPending)
+		}
+		gc.lock.Unlock()
+		return
+	}
+	scopes := gc.scopes()
+	for hostname := range pending {
+		if desired[hostname] {
+			// moved to another tunnel
+			continue
+		}
+		var lastErr error
+		found := false
+		for _, cfc := range scopes {
+			zone, err := cfc.Rest().ZoneForHostname(hostname)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			found = true
+			releaseDNSRecord(cfc, zone.ID, hostname)
+			releaseLoadBalancer(cfc, zone.ID, hostname)
+		}
+		if !found {
+			gc.cfc.Log().Error().Err(lastErr).Str("dnsName", hostname).Msg("Error resolving zone")
+		}
+	}
+}
+
+// sweep deletes every owned record of all zones which has no tunnel rule
+// and every owned load balancer pool without load-balancer annotation, the
+// pools which were dropped from their load balancer are added again
+func (gc *dnsGarbageCollector) sweep() {
+	desired, err := gc.desired()
+	if err != nil {
+		gc.cfc.Log().Error().Err(err).Msg("Error reading tunnel deletions, skipping sweep")
+		return
+	}
+	desiredLBs := desiredLoadBalancers(gc.cfc)
+	gc.lock.Lock()
+	for hostname := range gc.retired {
+		desiredLBs[hostname] = true
+	}
+	gc.lock.Unlock()
+	for _, cfc := range gc.scopes() {
+		sweepZones(cfc, desired)
+		sweepLoadBalancerPools(cfc, desiredLBs)
+		repairLoadBalancers(cfc, desiredLBs)
+	}
+}
+
+func sweepZones(cfc types.CFController, desired map[string]bool) {
+	zoneIds, err := cfc.Rest().ZoneIDs()
+	if err != nil {
+		cfc.Log().Error().Err(err).Msg("Error getting zones")
+		return
+	}
+	api, err := cfc.Rest().Cfgo()
+	if err != nil {
+		cfc.Log().Error().Err(err).Msg("Can't find CF client")
+		return
+	}
+	for zone, zoneId := range zoneIds {
+		recs, _, err := api.ListDNSRecords(cfc.Context(), cfgo.ZoneIdentifier(zoneId), cfgo.ListDNSRecordsParams{
+			Type: "TXT",
+		})
+		if err != nil {
+			cfc.Log().Error().Err(err).Str("zone", zone).Msg("Error listing DNS records")
+			continue
+		}
+		for _, rec := range recs {
+			hostname, found := hostnameFromOwnerRecord(rec.Name)
+			if !found || desired[hostname] || !parseDNSOwner(rec.Content).ownedBy(cfc) {
+				continue
+			}
+			releaseDNSRecord(cfc, zoneId, hostname)
+		}
+	}
+}
+
+// StartDNSGarbageCollector deletes the DNS records of hostnames which left
+// all tunnel ConfigMaps. It only runs on the leader.
+func StartDNSGarbageCollector(_cfc types.CFController) func() {
+	cfc := _cfc.WithComponent("dns-gc")
+	if cfc.Cfg().DNS.GCInterval <= 0 {
+		cfc.Log().Info().Msg("DNS garbage collection disabled")
+		return func() {}
+	}
+	gc := &dnsGarbageCollector{
+		cfc:     cfc,
+		known:   make(map[string]bool),
+		pending: make(map[string]bool),
+		retired: make(map[string]bool),
+	}
+	unreg := cfc.K8sData().TunnelConfigMaps.Register(func(cms []*corev1.ConfigMap, ev watch.Event) {
+		gc.observe(cms, ev)
+	})
+	stop := make(chan struct{})
+	go func() {
+		// the first sweep waits an interval, so all tunnel ConfigMaps are known
+		ticker := time.NewTicker(cfc.Cfg().DNS.GCInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-cfc.Context().Done():
+				return
+			case <-ticker.C:
+				gc.sweep()
+			}
+		}
+	}()
+	return func() {
+		unreg()
+		close(stop)
+		gc.lock.Lock()
+		if gc.timer != nil {
+			gc.timer.Stop()
+			gc.timer = nil
+		}
+		gc.lock.Unlock()
+	}
+}
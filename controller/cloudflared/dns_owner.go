@@ -0,0 +1,200 @@
+package cloudflared
+
+import (
+	"fmt"
+	"strings"
+
+	cfgo "github.com/cloudflare/cloudflare-go"
+	"github.com/google/uuid"
+	"github.com/mabels/cloudflared-controller/controller/types"
+)
+
+// Every DNS record created by the controller gets an ownership TXT record
+// like external-dns does. Only records with our heritage and cluster are
+// ever deleted.
+const ownerRecordPrefix = "_cfd-owner."
+
+// the * of a wildcard may only be the first label, the owner of
+// *.example.com is _cfd-owner-wildcard.example.com
+const ownerWildcardRecordPrefix = "_cfd-owner-wildcard."
+const ownerHeritage = "cloudflared-controller"
+
+type dnsOwner struct {
+	Heritage string
+	Cluster  string
+	Source   string
+	// set on objects which are not named by their hostname
+	Hostname string
+}
+
+func ownerRecordName(hostname string) string {
+	if strings.HasPrefix(hostname, "*.") {
+		return ownerWildcardRecordPrefix + strings.TrimPrefix(hostname, "*.")
+	}
+	return ownerRecordPrefix + hostname
+}
+
+func hostnameFromOwnerRecord(name string) (string, bool) {
+	if strings.HasPrefix(name, ownerWildcardRecordPrefix) {
+		return "*." + strings.TrimPrefix(name, ownerWildcardRecordPrefix), true
+	}
+	if !strings.HasPrefix(name, ownerRecordPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(name, ownerRecordPrefix), true
+}
+
+func (o dnsOwner) String() string {
+	ret := fmt.Sprintf("heritage=%s,cluster=%s,source=%s", o.Heritage, o.Cluster, o.Source)
+	if o.Hostname != "" {
+		ret += ",hostname=" + o.Hostname
+	}
+	return ret
+}
+
+func parseDNSOwner(content string) dnsOwner {
+	ret := dnsOwner{}
+	for _, kv := range strings.Split(strings.Trim(content, `"`), ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch strings.TrimSpace(parts[0]) {
+		case "heritage":
+			ret.Heritage = parts[1]
+		case "cluster":
+			ret.Cluster = parts[1]
+		case "source":
+			ret.Source = parts[1]
+		case "hostname":
+			ret.Hostname = parts[1]
+		}
+	}
+	return ret
+}
+
+func (o dnsOwner) ownedBy(cfc types.CFController) bool {
+	return o.Heritage == ownerHeritage && o.Cluster == cfc.Cfg().ClusterName
+}
+
+func tunnelTarget(tunnelId uuid.UUID) string {
+	return fmt.Sprintf("%s.cfargotunnel.com", tunnelId.String())
+}
+
+func findDNSRecord(cfc types.CFController, zoneId string, typ string, name string) (*cfgo.DNSRecord, error) {
+	api, err := cfc.Rest().Cfgo()
+	if err != nil {
+		return nil, err
+	}
+	recs, _, err := api.ListDNSRecords(cfc.Context(), cfgo.ZoneIdentifier(zoneId), cfgo.ListDNSRecordsParams{
+		Type: typ,
+		Name: name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(recs) == 0 {
+		return nil, nil
+	}
+	return &recs[0], nil
+}
+
+// ownsDNSRecord is true if the ownership record of hostname has our
+// heritage and cluster
+func ownsDNSRecord(cfc types.CFController, zoneId string, hostname string) (bool, error) {
+	owner, err := findDNSRecord(cfc, zoneId, "TXT", ownerRecordName(hostname))
+	if err != nil {
+		cfc.Log().Error().Err(err).Str("dnsName", hostname).Msg("Error reading ownership record")
+		return false, err
+	}
+	return owner != nil && parseDNSOwner(owner.Content).ownedBy(cfc), nil
+}
+
+// claimDNSRecord writes the ownership record of hostname. A record which
+// was not created by the controller is only adopted if it already points to
+// our tunnel.
+func claimDNSRecord(cfc types.CFController, zoneId string, tunnelId uuid.UUID, hostname string, source string, created bool) error {
+	log := cfc.Log().With().Str("dnsName", hostname).Logger()
+	owner, err := findDNSRecord(cfc, zoneId, "TXT", ownerRecordName(hostname))
+	if err != nil {
+		log.Error().Err(err).Msg("Error reading ownership record")
+		return err
+	}
+	if owner != nil {
+		if !parseDNSOwner(owner.Content).ownedBy(cfc) {
+			log.Warn().Str("owner", owner.Content).Msg("DNS record is owned by someone else")
+		}
+		return nil
+	}
+	if !created {
+		rec, err := findDNSRecord(cfc, zoneId, "CNAME", hostname)
+		if err != nil {
+			log.Error().Err(err).Msg("Error reading DNS record")
+			return err
+		}
+		if rec == nil || rec.Content != tunnelTarget(tunnelId) {
+			log.Warn().Msg("DNS record exists and is not owned by the controller")
+			return nil
+		}
+	}
+	api, err := cfc.Rest().Cfgo()
+	if err != nil {
+		return err
+	}
+	_, err = api.CreateDNSRecord(cfc.Context(), cfgo.ZoneIdentifier(zoneId), cfgo.CreateDNSRecordParams{
+		Type: "TXT",
+		Name: ownerRecordName(hostname),
+		Content: dnsOwner{
+			Heritage: ownerHeritage,
+			Cluster:  cfc.Cfg().ClusterName,
+			Source:   source,
+		}.String(),
+		TTL: 1,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Error creating ownership record")
+		return err
+	}
+	return nil
+}
+
+// releaseDNSRecord deletes hostname and its ownership record if we own it
+func releaseDNSRecord(cfc types.CFController, zoneId string, hostname string) error {
+	log := cfc.Log().With().Str("dnsName", hostname).Logger()
+	owner, err := findDNSRecord(cfc, zoneId, "TXT", ownerRecordName(hostname))
+	if err != nil {
+		log.Error().Err(err).Msg("Error reading ownership record")
+		return err
+	}
+	if owner == nil || !parseDNSOwner(owner.Content).ownedBy(cfc) {
+		return nil
+	}
+	api, err := cfc.Rest().Cfgo()
+	if err != nil {
+		return err
+	}
+	rec, err := findDNSRecord(cfc, zoneId, "CNAME", hostname)
+	if err != nil {
+		log.Error().Err(err).Msg("Error reading DNS record")
+		return err
+	}
+	if rec != nil {
+		err = api.DeleteDNSRecord(cfc.Context(), cfgo.ZoneIdentifier(zoneId), rec.ID)
+		if err != nil {
+			log.Error().Err(err).Msg("Error deleting DNS record")
+			return err
+		}
+	}
+	err = api.DeleteDNSRecord(cfc.Context(), cfgo.ZoneIdentifier(zoneId), owner.ID)
+	if err != nil {
+		log.Error().Err(err).Msg("Error deleting ownership record")
+		return err
+	}
+	log.Info().Str("source", parseDNSOwner(owner.Content).Source).Msg("Deleted DNS record")
+	return nil
+}
+
+// desiredHostnames are the hostnames of all tunnel ConfigMaps
+func desiredHostnames(cfc types.CFController) map[string]bool {
+	return hostnamesOf(cfc, cfc.K8sData().TunnelConfigMaps.Get())
+}
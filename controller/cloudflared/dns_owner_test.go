@@ -0,0 +1,43 @@
+package cloudflared
+
+import (
+	"testing"
+
+	cfgo "github.com/cloudflare/cloudflare-go"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNSOwner(t *testing.T) {
+	owner := dnsOwner{Heritage: ownerHeritage, Cluster: "k8s", Source: "ingress-default-a"}
+	assert.Equal(t, "heritage=cloudflared-controller,cluster=k8s,source=ingress-default-a", owner.String())
+	assert.Equal(t, owner, parseDNSOwner(owner.String()))
+	// TXT content is returned quoted
+	assert.Equal(t, owner, parseDNSOwner(`"`+owner.String()+`"`))
+	assert.Equal(t, dnsOwner{}, parseDNSOwner("v=spf1 -all"))
+
+	owner.Hostname = "a.example.com"
+	assert.Equal(t, "heritage=cloudflared-controller,cluster=k8s,source=ingress-default-a,hostname=a.example.com", owner.String())
+	assert.Equal(t, owner, parseDNSOwner(owner.String()))
+}
+
+func TestOwnerRecordName(t *testing.T) {
+	hostname, found := hostnameFromOwnerRecord(ownerRecordName("a.example.com"))
+	assert.True(t, found)
+	assert.Equal(t, "a.example.com", hostname)
+	_, found = hostnameFromOwnerRecord("_dmarc.example.com")
+	assert.False(t, found)
+
+	assert.Equal(t, "_cfd-owner-wildcard.preview.example.com", ownerRecordName("*.preview.example.com"))
+	hostname, found = hostnameFromOwnerRecord(ownerRecordName("*.preview.example.com"))
+	assert.True(t, found)
+	assert.Equal(t, "*.preview.example.com", hostname)
+}
+
+func TestPointsToTunnel(t *testing.T) {
+	tunnelId := uuid.New()
+	assert.True(t, pointsToTunnel([]cfgo.DNSRecord{{Type: "CNAME", Content: tunnelTarget(tunnelId)}}, tunnelId))
+	assert.False(t, pointsToTunnel([]cfgo.DNSRecord{{Type: "CNAME", Content: tunnelTarget(uuid.New())}}, tunnelId))
+	assert.False(t, pointsToTunnel([]cfgo.DNSRecord{{Type: "A", Content: "1.2.3.4"}}, tunnelId))
+	assert.False(t, pointsToTunnel(nil, tunnelId))
+}
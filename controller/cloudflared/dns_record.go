@@ -0,0 +1,78 @@
+package cloudflared
+
+import (
+	cfgo "github.com/cloudflare/cloudflare-go"
+	"github.com/google/uuid"
+	"github.com/mabels/cloudflared-controller/controller/types"
+)
+
+// dnsRecordOptions of the tunnel CNAME of a hostname
+type dnsRecordOptions struct {
+	Proxied bool
+	// 1 is automatic, proxied records are always automatic
+	TTL     int
+	Comment string
+}
+
+func dnsRecordOptionsFromMeta(cfc types.CFController, hostname string, meta *types.CFConfigIngressMeta) dnsRecordOptions {
+	ret := dnsRecordOptions{
+		Proxied: true,
+		TTL:     1,
+	}
+	if meta == nil {
+		return ret
+	}
+	if meta.DNSProxied != nil {
+		ret.Proxied = *meta.DNSProxied
+	}
+	if meta.DNSTTL > 0 {
+		if ret.Proxied {
+			cfc.Log().Warn().Str("dnsName", hostname).Int("ttl", meta.DNSTTL).Msg("Ignoring TTL of proxied record")
+		} else {
+			ret.TTL = meta.DNSTTL
+		}
+	}
+	ret.Comment = meta.DNSComment
+	return ret
+}
+
+func (o dnsRecordOptions) matches(rec *cfgo.DNSRecord) bool {
+	proxied := rec.Proxied != nil && *rec.Proxied
+	return proxied == o.Proxied && rec.TTL == o.TTL && rec.Comment == o.Comment
+}
+
+// createTunnelRecord creates the CNAME of hostname, at the zone apex
+// cloudflare flattens it
+func createTunnelRecord(cfc types.CFController, zoneId string, tunnelId uuid.UUID, hostname string, opts dnsRecordOptions) error {
+	api, err := cfc.Rest().Cfgo()
+	if err != nil {
+		return err
+	}
+	_, err = api.CreateDNSRecord(cfc.Context(), cfgo.ZoneIdentifier(zoneId), cfgo.CreateDNSRecordParams{
+		Type:    "CNAME",
+		Name:    hostname,
+		Content: tunnelTarget(tunnelId),
+		Proxied: &opts.Proxied,
+		TTL:     opts.TTL,
+		Comment: opts.Comment,
+	})
+	return err
+}
+
+// updateTunnelRecord points rec to the tunnel with opts
+func updateTunnelRecord(cfc types.CFController, zoneId string, tunnelId uuid.UUID, rec *cfgo.DNSRecord, opts dnsRecordOptions) error {
+	api, err := cfc.Rest().Cfgo()
+	if err != nil {
+		return err
+	}
+	_, err = api.UpdateDNSRecord(cfc.Context(), cfgo.ZoneIdentifier(zoneId), cfgo.UpdateDNSRecordParams{
+		ID:      rec.ID,
+		Type:    "CNAME",
+		Name:    rec.Name,
+		Content: tunnelTarget(tunnelId),
+		Proxied: &opts.Proxied,
+		TTL:     opts.TTL,
+		Comment: &opts.Comment,
+	})
+	return err
+}
@@ -0,0 +1,38 @@
+package cloudflared
+
+import (
+	"testing"
+
+	cfgo "github.com/cloudflare/cloudflare-go"
+	"github.com/mabels/cloudflared-controller/controller"
+	"github.com/mabels/cloudflared-controller/controller/types"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNSRecordOptionsFromMeta(t *testing.T) {
+	log := zerolog.Nop()
+	cfc := controller.NewCFController(&log)
+
+	assert.Equal(t, dnsRecordOptions{Proxied: true, TTL: 1}, dnsRecordOptionsFromMeta(cfc, "a.example.com", nil))
+
+	proxied := false
+	opts := dnsRecordOptionsFromMeta(cfc, "a.example.com", &types.CFConfigIngressMeta{
+		DNSProxied: &proxied,
+		DNSTTL:     300,
+		DNSComment: "team-a",
+	})
+	assert.Equal(t, dnsRecordOptions{Proxied: false, TTL: 300, Comment: "team-a"}, opts)
+
+	// proxied records have an automatic TTL
+	opts = dnsRecordOptionsFromMeta(cfc, "a.example.com", &types.CFConfigIngressMeta{DNSTTL: 300})
+	assert.Equal(t, dnsRecordOptions{Proxied: true, TTL: 1}, opts)
+}
+
+func TestDNSRecordOptionsMatches(t *testing.T) {
+	proxied := true
+	rec := cfgo.DNSRecord{Proxied: &proxied, TTL: 1}
+	assert.True(t, dnsRecordOptions{Proxied: true, TTL: 1}.matches(&rec))
+	assert.False(t, dnsRecordOptions{Proxied: true, TTL: 1, Comment: "x"}.matches(&rec))
+	assert.False(t, dnsRecordOptions{Proxied: false, TTL: 1}.matches(&cfgo.DNSRecord{TTL: 120}))
+}
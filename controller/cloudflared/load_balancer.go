@@ -0,0 +1,520 @@
+package cloudflared
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"regexp"
+	"time"
+
+	cfgo "github.com/cloudflare/cloudflare-go"
+	"github.com/google/uuid"
+	"github.com/mabels/cloudflared-controller/controller/rules"
+	"github.com/mabels/cloudflared-controller/controller/types"
+)
+
+// A hostname with the load-balancer annotation is published through a
+// load balancer named like the hostname. Every cluster adds its own pool
+// with its tunnel as origin, pools of other clusters are never touched.
+
+var reSanitzePoolName = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+func lbPoolName(cfc types.CFController, hostname string) string {
+	return reSanitzePoolName.ReplaceAllString(fmt.Sprintf("cfd-%s-%s", cfc.Cfg().ClusterName, hostname), "-")
+}
+
+func lbOwner(cfc types.CFController, hostname string, source string) string {
+	return dnsOwner{
+		Heritage: ownerHeritage,
+		Cluster:  cfc.Cfg().ClusterName,
+		Source:   source,
+		Hostname: hostname,
+	}.String()
+}
+
+func desiredMonitor(cfc types.CFController, hostname string, source string, meta *types.CFConfigIngressMeta) cfgo.LoadBalancerMonitor {
+	path := "/"
+	if meta != nil && meta.LBMonitorPath != "" {
+		path = meta.LBMonitorPath
+	}
+	return cfgo.LoadBalancerMonitor{
+		Type:            "https",
+		Description:     lbOwner(cfc, hostname, source),
+		Method:          "GET",
+		Path:            path,
+		Header:          map[string][]string{"Host": {hostname}},
+		Timeout:         5,
+		Retries:         2,
+		Interval:        60,
+		ConsecutiveUp:   1,
+		ConsecutiveDown: 1,
+		ExpectedCodes:   "2xx",
+		FollowRedirects: true,
+	}
+}
+
+func sameMonitor(a, b cfgo.LoadBalancerMonitor) bool {
+	return a.Type == b.Type && a.Description == b.Description && a.Method == b.Method &&
+		a.Path == b.Path && reflect.DeepEqual(a.Header, b.Header) && a.ExpectedCodes == b.ExpectedCodes
+}
+
+func desiredPool(cfc types.CFController, tunnelId uuid.UUID, hostname string, source string, monitorId string) cfgo.LoadBalancerPool {
+	return cfgo.LoadBalancerPool{
+		Name:        lbPoolName(cfc, hostname),
+		Description: lbOwner(cfc, hostname, source),
+		Enabled:     true,
+		Monitor:     monitorId,
+		Origins: []cfgo.LoadBalancerOrigin{{
+			Name:    cfc.Cfg().ClusterName,
+			Address: tunnelTarget(tunnelId),
+			Enabled: true,
+			Weight:  1,
+			// the tunnel routes by the Host header
+			Header: map[string][]string{"Host": {hostname}},
+		}},
+	}
+}
+
+func samePool(a, b cfgo.LoadBalancerPool) bool {
+	return a.Name == b.Name && a.Description == b.Description && a.Enabled == b.Enabled &&
+		a.Monitor == b.Monitor && reflect.DeepEqual(a.Origins, b.Origins)
+}
+
+func findPool(cfc types.CFController, api *cfgo.API, name string) (*cfgo.LoadBalancerPool, error) {
+	pools, err := api.ListLoadBalancerPools(cfc.Context(), cfgo.AccountIdentifier(cfc.Cfg().CloudFlare.AccountId), cfgo.ListLoadBalancerPoolParams{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range pools {
+		if pools[i].Name == name {
+			return &pools[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func findLoadBalancer(cfc types.CFController, api *cfgo.API, zoneId string, hostname string) (*cfgo.LoadBalancer, error) {
+	lbs, err := api.ListLoadBalancers(cfc.Context(), cfgo.ZoneIdentifier(zoneId), cfgo.ListLoadBalancerParams{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range lbs {
+		if lbs[i].Name == hostname {
+			return &lbs[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// upsertMonitor returns the id of the health monitor of the pool
+func upsertMonitor(cfc types.CFController, api *cfgo.API, pool *cfgo.LoadBalancerPool, desired cfgo.LoadBalancerMonitor) (string, error) {
+	rc := cfgo.AccountIdentifier(cfc.Cfg().CloudFlare.AccountId)
+	if pool != nil && pool.Monitor != "" {
+		monitor, err := api.GetLoadBalancerMonitor(cfc.Context(), rc, pool.Monitor)
+		if err == nil && parseDNSOwner(monitor.Description).ownedBy(cfc) {
+			if !sameMonitor(monitor, desired) {
+				desired.ID = monitor.ID
+				_, err = api.UpdateLoadBalancerMonitor(cfc.Context(), rc, cfgo.UpdateLoadBalancerMonitorParams{
+					LoadBalancerMonitor: desired,
+				})
+				if err != nil {
+					return "", err
+				}
+			}
+			return monitor.ID, nil
+		}
+	}
+	monitor, err := api.CreateLoadBalancerMonitor(cfc.Context(), rc, cfgo.CreateLoadBalancerMonitorParams{
+		LoadBalancerMonitor: desired,
+	})
+	if err != nil {
+		return "", err
+	}
+	return monitor.ID, nil
+}
+
+// clearForLoadBalancer removes the DNS records of hostname which the load
+// balancer replaces. Our CNAME is released, the records of others follow
+// the dns-conflict policy. It returns false if the records are kept.
+func clearForLoadBalancer(cfc types.CFController, zoneId string, hostname string, policy types.DNSConflictPolicy) (bool, error) {
+	recs, err := addressRecords(cfc, zoneId, hostname)
+	if err != nil {
+		cfc.Log().Error().Str("dnsName", hostname).Err(err).Msg("Error reading DNS record")
+		return false, err
+	}
+	if len(recs) == 0 {
+		return true, nil
+	}
+	owned, err := ownsDNSRecord(cfc, zoneId, hostname)
+	if err != nil {
+		return false, err
+	}
+	if owned {
+		return true, releaseDNSRecord(cfc, zoneId, hostname)
+	}
+	if policy == "" {
+		policy = types.DNSConflictSkip
+	}
+	logDNSConflict(cfc, hostname, recs, policy)
+	switch policy {
+	case types.DNSConflictOverwrite:
+		api, err := cfc.Rest().Cfgo()
+		if err != nil {
+			return false, err
+		}
+		for _, rec := range recs {
+			err = api.DeleteDNSRecord(cfc.Context(), cfgo.ZoneIdentifier(zoneId), rec.ID)
+			if err != nil {
+				cfc.Log().Error().Err(err).Str("dnsName", hostname).Str("record", rec.Type+" "+rec.Name).Msg("Error deleting DNS record")
+				return false, err
+			}
+		}
+		cfc.Log().Info().Str("dnsName", hostname).Str("target", recs[0].Content).Msg("Overwrote DNS record with load balancer")
+		return true, nil
+	case types.DNSConflictFail:
+		return false, &dnsConflictError{
+			Hostname: hostname,
+			Type:     recs[0].Type,
+			Target:   recs[0].Content,
+		}
+	}
+	return false, nil
+}
+
+// registerCFLoadBalancer upserts the monitor and the pool of this cluster and
+// adds the pool to the load balancer of hostname. It returns false if a
+// record of someone else is in the way.
+func registerCFLoadBalancer(cfc types.CFController, zoneId string, tunnelId uuid.UUID, hostname string, source string, meta *types.CFConfigIngressMeta) (bool, error) {
+	log := cfc.Log().With().Str("dnsName", hostname).Logger()
+	api, err := cfc.Rest().Cfgo()
+	if err != nil {
+		return false, err
+	}
+	// the load balancer can't be created next to another record
+	cleared, err := clearForLoadBalancer(cfc, zoneId, hostname, meta.DNSConflict)
+	if err != nil || !cleared {
+		return false, err
+	}
+	rc := cfgo.AccountIdentifier(cfc.Cfg().CloudFlare.AccountId)
+	pool, err := findPool(cfc, api, lbPoolName(cfc, hostname))
+	if err != nil {
+		log.Error().Err(err).Msg("Error listing load balancer pools")
+		return false, err
+	}
+	monitorId, err := upsertMonitor(cfc, api, pool, desiredMonitor(cfc, hostname, source, meta))
+	if err != nil {
+		log.Error().Err(err).Msg("Error upserting health monitor")
+		return false, err
+	}
+	desired := desiredPool(cfc, tunnelId, hostname, source, monitorId)
+	if pool == nil {
+		created, err := api.CreateLoadBalancerPool(cfc.Context(), rc, cfgo.CreateLoadBalancerPoolParams{
+			LoadBalancerPool: desired,
+		})
+		if err != nil {
+			log.Error().Err(err).Msg("Error creating load balancer pool")
+			return false, err
+		}
+		pool = &created
+		log.Info().Str("pool", pool.Name).Msg("Created load balancer pool")
+	} else if !samePool(*pool, desired) {
+		desired.ID = pool.ID
+		_, err = api.UpdateLoadBalancerPool(cfc.Context(), rc, cfgo.UpdateLoadBalancerPoolParams{
+			LoadBalancer: desired,
+		})
+		if err != nil {
+			log.Error().Err(err).Msg("Error updating load balancer pool")
+			return false, err
+		}
+	}
+	err = attachPool(cfc, api, zoneId, hostname, pool)
+	return err == nil, err
+}
+
+func hasPool(pools []string, poolId string) bool {
+	for _, id := range pools {
+		if id == poolId {
+			return true
+		}
+	}
+	return false
+}
+
+// referencesPool is true if the pool is used by the load balancer
+func referencesPool(lb *cfgo.LoadBalancer, poolId string) bool {
+	if lb.FallbackPool == poolId || hasPool(lb.DefaultPools, poolId) {
+		return true
+	}
+	for _, pools := range []map[string][]string{lb.RegionPools, lb.PopPools, lb.CountryPools} {
+		for _, ids := range pools {
+			if hasPool(ids, poolId) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The load balancer of a hostname is shared by all clusters. Its pools are
+// written as a whole, a concurrent update of another cluster can drop the
+// pool which was just added. So every change starts from a fresh read and
+// is read again until it is kept, the sweep repairs what is lost later.
+
+// lbUpdateAttempts bounds the read, modify, write cycles of one change
+var lbUpdateAttempts = 5
+
+// lbRetryDelay is the base of the jittered delay between the cycles
+var lbRetryDelay = time.Second
+
+// lbBackoff waits before the next cycle, shutdown or losing the leadership
+// interrupts it
+func lbBackoff(cfc types.CFController, attempt int) error {
+	timer := time.NewTimer(time.Duration(attempt-1)*lbRetryDelay + time.Duration(rand.Int63n(int64(lbRetryDelay)+1)))
+	defer timer.Stop()
+	select {
+	case <-cfc.Context().Done():
+		return cfc.Context().Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// attachPool adds the pool to the load balancer of hostname, the pools of
+// the other clusters are kept
+func attachPool(cfc types.CFController, api *cfgo.API, zoneId string, hostname string, pool *cfgo.LoadBalancerPool) error {
+	log := cfc.Log().With().Str("dnsName", hostname).Str("pool", pool.Name).Logger()
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			// give a concurrent update time to land before it is read
+			if err := lbBackoff(cfc, attempt); err != nil {
+				return err
+			}
+		}
+		lb, err := findLoadBalancer(cfc, api, zoneId, hostname)
+		if err != nil {
+			log.Error().Err(err).Msg("Error listing load balancers")
+			return err
+		}
+		if lb == nil {
+			_, err = api.CreateLoadBalancer(cfc.Context(), cfgo.ZoneIdentifier(zoneId), cfgo.CreateLoadBalancerParams{
+				LoadBalancer: cfgo.LoadBalancer{
+					Name:         hostname,
+					Description:  ownerHeritage,
+					FallbackPool: pool.ID,
+					DefaultPools: []string{pool.ID},
+					Proxied:      true,
+				},
+			})
+			if err != nil {
+				log.Error().Err(err).Msg("Error creating load balancer")
+				return err
+			}
+			log.Info().Msg("Created load balancer")
+			return nil
+		}
+		if hasPool(lb.DefaultPools, pool.ID) {
+			return nil
+		}
+		if attempt >= lbUpdateAttempts {
+			err = fmt.Errorf("pool %s of load balancer %s was overwritten %d times", pool.Name, hostname, attempt)
+			log.Error().Err(err).Msg("Error adding pool to load balancer")
+			return err
+		}
+		if attempt > 0 {
+			log.Warn().Int("attempt", attempt).Msg("Pool was dropped by a concurrent update, adding it again")
+		}
+		lb.DefaultPools = append(lb.DefaultPools, pool.ID)
+		if lb.FallbackPool == "" {
+			lb.FallbackPool = pool.ID
+		}
+		_, err = api.UpdateLoadBalancer(cfc.Context(), cfgo.ZoneIdentifier(zoneId), cfgo.UpdateLoadBalancerParams{
+			LoadBalancer: *lb,
+		})
+		if err != nil {
+			log.Error().Err(err).Msg("Error adding pool to load balancer")
+			return err
+		}
+		log.Info().Msg("Added pool to load balancer")
+		if cfc.Cfg().DryRun {
+			// the planned update is never read back
+			return nil
+		}
+	}
+}
+
+func withoutPool(pools []string, poolId string) []string {
+	ret := make([]string, 0, len(pools))
+	for _, id := range pools {
+		if id != poolId {
+			ret = append(ret, id)
+		}
+	}
+	return ret
+}
+
+// detachPool removes the pool from the load balancer of hostname, the
+// pools of the other clusters are kept and the last pool deletes it
+func detachPool(cfc types.CFController, api *cfgo.API, zoneId string, hostname string, pool *cfgo.LoadBalancerPool) error {
+	log := cfc.Log().With().Str("dnsName", hostname).Str("pool", pool.Name).Logger()
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if err := lbBackoff(cfc, attempt); err != nil {
+				return err
+			}
+		}
+		lb, err := findLoadBalancer(cfc, api, zoneId, hostname)
+		if err != nil {
+			log.Error().Err(err).Msg("Error listing load balancers")
+			return err
+		}
+		if lb == nil || !referencesPool(lb, pool.ID) {
+			return nil
+		}
+		if attempt >= lbUpdateAttempts {
+			err = fmt.Errorf("pool %s of load balancer %s was added again %d times", pool.Name, hostname, attempt)
+			log.Error().Err(err).Msg("Error removing pool from load balancer")
+			return err
+		}
+		lb.DefaultPools = withoutPool(lb.DefaultPools, pool.ID)
+		if len(lb.DefaultPools) == 0 {
+			err = api.DeleteLoadBalancer(cfc.Context(), cfgo.ZoneIdentifier(zoneId), lb.ID)
+			if err != nil {
+				log.Error().Err(err).Msg("Error deleting load balancer")
+				return err
+			}
+			log.Info().Msg("Deleted load balancer")
+			return nil
+		}
+		if lb.FallbackPool == pool.ID {
+			lb.FallbackPool = lb.DefaultPools[0]
+		}
+		for region, pools := range lb.RegionPools {
+			lb.RegionPools[region] = withoutPool(pools, pool.ID)
+		}
+		for pop, pools := range lb.PopPools {
+			lb.PopPools[pop] = withoutPool(pools, pool.ID)
+		}
+		for country, pools := range lb.CountryPools {
+			lb.CountryPools[country] = withoutPool(pools, pool.ID)
+		}
+		_, err = api.UpdateLoadBalancer(cfc.Context(), cfgo.ZoneIdentifier(zoneId), cfgo.UpdateLoadBalancerParams{
+			LoadBalancer: *lb,
+		})
+		if err != nil {
+			log.Error().Err(err).Msg("Error removing pool from load balancer")
+			return err
+		}
+		if cfc.Cfg().DryRun {
+			return nil
+		}
+	}
+}
+
+// releaseLoadBalancer removes the pool of this cluster from the load
+// balancer of hostname and deletes it, the last pool deletes the load balancer
+func releaseLoadBalancer(cfc types.CFController, zoneId string, hostname string) error {
+	log := cfc.Log().With().Str("dnsName", hostname).Logger()
+	api, err := cfc.Rest().Cfgo()
+	if err != nil {
+		return err
+	}
+	rc := cfgo.AccountIdentifier(cfc.Cfg().CloudFlare.AccountId)
+	pool, err := findPool(cfc, api, lbPoolName(cfc, hostname))
+	if err != nil {
+		log.Error().Err(err).Msg("Error listing load balancer pools")
+		return err
+	}
+	if pool == nil || !parseDNSOwner(pool.Description).ownedBy(cfc) {
+		return nil
+	}
+	err = detachPool(cfc, api, zoneId, hostname, pool)
+	if err != nil {
+		return err
+	}
+	err = api.DeleteLoadBalancerPool(cfc.Context(), rc, pool.ID)
+	if err != nil {
+		log.Error().Err(err).Msg("Error deleting load balancer pool")
+		return err
+	}
+	if pool.Monitor != "" {
+		monitor, err := api.GetLoadBalancerMonitor(cfc.Context(), rc, pool.Monitor)
+		if err == nil && parseDNSOwner(monitor.Description).ownedBy(cfc) {
+			err = api.DeleteLoadBalancerMonitor(cfc.Context(), rc, monitor.ID)
+			if err != nil {
+				log.Error().Err(err).Msg("Error deleting health monitor")
+			}
+		}
+	}
+	log.Info().Str("pool", pool.Name).Msg("Deleted load balancer pool")
+	return nil
+}
+
+// desiredLoadBalancers are the hostnames with the load-balancer annotation
+func desiredLoadBalancers(cfc types.CFController) map[string]bool {
+	ret := make(map[string]bool)
+	for _, cm := range cfc.K8sData().TunnelConfigMaps.Get() {
+		for _, rule := range rules.FromConfigMap(cfc.Log(), cm) {
+			if rule.Rule.Hostname != "" && rule.Rule.Meta != nil && rule.Rule.Meta.LoadBalancer {
+				ret[rule.Rule.Hostname] = true
+			}
+		}
+	}
+	return ret
+}
+
+// sweepLoadBalancerPools releases the owned pools of hostnames which are
+// no longer published through a load balancer
+func sweepLoadBalancerPools(cfc types.CFController, desired map[string]bool) {
+	api, err := cfc.Rest().Cfgo()
+	if err != nil {
+		cfc.Log().Error().Err(err).Msg("Can't find CF client")
+		return
+	}
+	pools, err := api.ListLoadBalancerPools(cfc.Context(), cfgo.AccountIdentifier(cfc.Cfg().CloudFlare.AccountId), cfgo.ListLoadBalancerPoolParams{})
+	if err != nil {
+		cfc.Log().Error().Err(err).Msg("Error listing load balancer pools")
+		return
+	}
+	for _, pool := range pools {
+		owner := parseDNSOwner(pool.Description)
+		if !owner.ownedBy(cfc) || owner.Hostname == "" || desired[owner.Hostname] {
+			continue
+		}
+		zone, err := cfc.Rest().ZoneForHostname(owner.Hostname)
+		if err != nil {
+			cfc.Log().Error().Err(err).Str("dnsName", owner.Hostname).Msg("Error resolving zone")
+			continue
+		}
+		releaseLoadBalancer(cfc, zone.ID, owner.Hostname)
+	}
+}
+
+// repairLoadBalancers adds the pools of this cluster again which were
+// dropped from their load balancers by a concurrent update
+func repairLoadBalancers(cfc types.CFController, hostnames map[string]bool) {
+	if len(hostnames) == 0 {
+		return
+	}
+	api, err := cfc.Rest().Cfgo()
+	if err != nil {
+		cfc.Log().Error().Err(err).Msg("Can't find CF client")
+		return
+	}
+	pools, err := api.ListLoadBalancerPools(cfc.Context(), cfgo.AccountIdentifier(cfc.Cfg().CloudFlare.AccountId), cfgo.ListLoadBalancerPoolParams{})
+	if err != nil {
+		cfc.Log().Error().Err(err).Msg("Error listing load balancer pools")
+		return
+	}
+	for i := range pools {
+		owner := parseDNSOwner(pools[i].Description)
+		if !owner.ownedBy(cfc) || !hostnames[owner.Hostname] || pools[i].Name != lbPoolName(cfc, owner.Hostname) {
+			continue
+		}
+		zone, err := cfc.Rest().ZoneForHostname(owner.Hostname)
+		if err != nil {
+			cfc.Log().Error().Err(err).Str("dnsName", owner.Hostname).Msg("Error resolving zone")
+			continue
+		}
+		attachPool(cfc, api, zone.ID, owner.Hostname, &pools[i])
+	}
+}
@@ -0,0 +1,139 @@
+package cloudflared
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cfgo "github.com/cloudflare/cloudflare-go"
+	"github.com/google/uuid"
+	"github.com/mabels/cloudflared-controller/controller"
+	"github.com/mabels/cloudflared-controller/controller/types"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadBalancerPool(t *testing.T) {
+	log := zerolog.Nop()
+	cfc := controller.NewCFController(&log)
+	cfc.SetCfg(&types.CFControllerConfig{ClusterName: "eu.west"})
+
+	assert.Equal(t, "cfd-eu-west-www-example-com", lbPoolName(cfc, "www.example.com"))
+
+	tunnelId := uuid.New()
+	pool := desiredPool(cfc, tunnelId, "www.example.com", "ingress-default-www", "m1")
+	assert.Equal(t, tunnelTarget(tunnelId), pool.Origins[0].Address)
+	assert.Equal(t, []string{"www.example.com"}, pool.Origins[0].Header["Host"])
+	owner := parseDNSOwner(pool.Description)
+	assert.True(t, owner.ownedBy(cfc))
+	assert.Equal(t, "www.example.com", owner.Hostname)
+	assert.Equal(t, "ingress-default-www", owner.Source)
+	assert.True(t, samePool(pool, desiredPool(cfc, tunnelId, "www.example.com", "ingress-default-www", "m1")))
+	assert.False(t, samePool(pool, desiredPool(cfc, uuid.New(), "www.example.com", "ingress-default-www", "m1")))
+
+	monitor := desiredMonitor(cfc, "www.example.com", "ingress-default-www", nil)
+	assert.Equal(t, "/", monitor.Path)
+	other := desiredMonitor(cfc, "www.example.com", "ingress-default-www", &types.CFConfigIngressMeta{LBMonitorPath: "/healthz"})
+	assert.Equal(t, "/healthz", other.Path)
+	assert.False(t, sameMonitor(monitor, other))
+
+	assert.Equal(t, []string{"a", "c"}, withoutPool([]string{"a", "b", "c"}, "b"))
+}
+
+// lbServer serves one shared load balancer, the first update of this
+// cluster is overwritten by a concurrent update of another cluster
+func lbServer(t *testing.T, cfc types.CFController, lb *cfgo.LoadBalancer) *int {
+	updates := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var result interface{}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/zones/zone/load_balancers":
+			result = []cfgo.LoadBalancer{*lb}
+		case r.Method == http.MethodPut && r.URL.Path == "/zones/zone/load_balancers/lb":
+			updates++
+			written := cfgo.LoadBalancer{}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&written))
+			if updates == 1 {
+				// the other cluster read before our update
+				lb.DefaultPools = append(lb.DefaultPools, "other2")
+			} else {
+				*lb = written
+			}
+			result = lb
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		out, _ := json.Marshal(map[string]interface{}{"success": true, "errors": []interface{}{}, "messages": []interface{}{}, "result": result})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+	}))
+	t.Cleanup(srv.Close)
+	api, err := cfc.Rest().Cfgo()
+	assert.NoError(t, err)
+	api.BaseURL = srv.URL
+	return &updates
+}
+
+func TestAttachPoolKeepsConcurrentPools(t *testing.T) {
+	lbRetryDelay = 0
+	log := zerolog.Nop()
+	cfc := controller.NewCFController(&log)
+	cfg := types.CFControllerConfig{ClusterName: "eu"}
+	cfg.CloudFlare.ApiToken = "token"
+	cfc.SetCfg(&cfg)
+	lb := &cfgo.LoadBalancer{ID: "lb", Name: "www.example.com", FallbackPool: "other", DefaultPools: []string{"other"}}
+	updates := lbServer(t, cfc, lb)
+	api, _ := cfc.Rest().Cfgo()
+
+	pool := &cfgo.LoadBalancerPool{ID: "ours", Name: "cfd-eu-www-example-com"}
+	assert.NoError(t, attachPool(cfc, api, "zone", "www.example.com", pool))
+	// the dropped pool was added again to what the other cluster wrote
+	assert.Equal(t, 2, *updates)
+	assert.Equal(t, []string{"other", "other2", "ours"}, lb.DefaultPools)
+	assert.Equal(t, "other", lb.FallbackPool)
+
+	*updates = 1
+	assert.NoError(t, detachPool(cfc, api, "zone", "www.example.com", pool))
+	assert.Equal(t, []string{"other", "other2"}, lb.DefaultPools)
+}
+
+func TestLBBackoffCanceled(t *testing.T) {
+	delay := lbRetryDelay
+	defer func() { lbRetryDelay = delay }()
+	lbRetryDelay = time.Hour
+	log := zerolog.Nop()
+	cfc := controller.NewCFController(&log)
+	// the leadership is lost
+	cfc.CancelFunc()()
+	start := time.Now()
+	assert.ErrorIs(t, lbBackoff(cfc, 3), context.Canceled)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestRegisterCFLoadBalancerConflict(t *testing.T) {
+	cfc := dnsController()
+	foreign := []cfgo.DNSRecord{{ID: "a", Type: "A", Name: "www.example.com", Content: "192.0.2.1"}}
+	calls := dnsServer(t, cfc, nil, map[string][]cfgo.DNSRecord{"www.example.com": foreign})
+	tunnelId := uuid.New()
+
+	// the foreign record is reported on the source and no pool is created
+	routed, err := registerCFLoadBalancer(cfc, "zone", tunnelId, "www.example.com", "ingress/default/www",
+		&types.CFConfigIngressMeta{LoadBalancer: true, DNSConflict: types.DNSConflictFail})
+	assert.False(t, routed)
+	var conflict *dnsConflictError
+	assert.ErrorAs(t, err, &conflict)
+	routed, err = registerCFLoadBalancer(cfc, "zone", tunnelId, "www.example.com", "ingress/default/www",
+		&types.CFConfigIngressMeta{LoadBalancer: true})
+	assert.False(t, routed)
+	assert.NoError(t, err)
+	assert.Empty(t, calls.other)
+	assert.Empty(t, calls.deleted)
+
+	cleared, err := clearForLoadBalancer(cfc, "zone", "www.example.com", types.DNSConflictOverwrite)
+	assert.True(t, cleared)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, calls.deleted)
+}
@@ -2,14 +2,16 @@ package cloudflared
 
 import (
 	"crypto/rand"
-	"fmt"
+	"encoding/base64"
+	"errors"
 	"strings"
 
+	cfgo "github.com/cloudflare/cloudflare-go"
 	"github.com/cloudflare/cloudflared/cfapi"
-	"gopkg.in/yaml.v3"
 
 	"github.com/mabels/cloudflared-controller/controller/config"
 	"github.com/mabels/cloudflared-controller/controller/k8s_data"
+	"github.com/mabels/cloudflared-controller/controller/rules"
 	"github.com/mabels/cloudflared-controller/controller/types"
 
 	// "github.com/mabels/cloudflared-controller/controller/config_maps"
@@ -38,34 +40,45 @@ import (
 // var reSanitzeNice = regexp.MustCompile(`[^_\\-\\.a-zA-Z0-9]+`)
 
 func findTunnelFromCF(cfc types.CFController, tp *types.CFTunnelParameter) ([]cfapi.TunnelWithToken, error) {
-	tf := cfapi.NewTunnelFilter()
-	tf.ByName(config.CfTunnelName(cfc, tp))
-
-	cfclient, err := cfc.Rest().CFClientWithoutZoneID()
+	api, err := cfc.Rest().Cfgo()
 	if err != nil {
 		cfc.Log().Error().Err(err).Msg("Can't find CF client")
 		return nil, err
 	}
-	ts, err := cfclient.ListTunnels(tf)
+	deleted := false
+	ts, _, err := api.ListTunnels(cfc.Context(), cfgo.AccountIdentifier(cfc.Cfg().CloudFlare.AccountId), cfgo.TunnelListParams{
+		Name:      config.CfTunnelName(cfc, tp),
+		IsDeleted: &deleted,
+	})
 	if err != nil {
 		cfc.Log().Error().Err(err).Msg("Error listing tunnels")
 		return nil, err
 	}
-	var foundTs *cfapi.Tunnel
-	for _, t := range ts {
-		if t.DeletedAt.IsZero() {
-			foundTs = t
+	var foundTs *cfgo.Tunnel
+	for i := range ts {
+		if ts[i].DeletedAt == nil || ts[i].DeletedAt.IsZero() {
+			foundTs = &ts[i]
 			break
 		}
 	}
 	if foundTs == nil {
-		// err := fmt.Errorf("No tunnel found for name %v", tp.Name)
-		cfc.Log().Debug().Err(err).Any("ts", ts).Msg("No tunnels found")
+		cfc.Log().Debug().Any("ts", ts).Msg("No tunnels found")
+		return nil, nil
+	}
+	id, err := uuid.Parse(foundTs.ID)
+	if err != nil {
+		cfc.Log().Error().Err(err).Str("tunnelId", foundTs.ID).Msg("Invalid tunnel id")
 		return nil, err
 	}
 	cfc.Log().Debug().Msgf("Found tunnel: %s/%s", foundTs.ID, foundTs.Name)
 	twt := cfapi.TunnelWithToken{
-		Tunnel: *foundTs,
+		Tunnel: cfapi.Tunnel{
+			ID:   id,
+			Name: foundTs.Name,
+		},
+	}
+	if foundTs.CreatedAt != nil {
+		twt.CreatedAt = *foundTs.CreatedAt
 	}
 	return []cfapi.TunnelWithToken{twt}, nil
 }
@@ -156,24 +169,56 @@ func findTunnelFromCF(cfc types.CFController, tp *types.CFTunnelParameter) ([]cf
 // 	return &ingress.Name
 // }
 
-func registerCFDnsEndpoint(cfc types.CFController, tunnelId uuid.UUID, name string) error {
-	parts := strings.Split(strings.Trim(strings.TrimSpace(name), "."), ".")
-	if len(parts) < 2 {
-		err := fmt.Errorf("Invalid DNS name: %s", name)
-		return err
+// registerCFDnsEndpoint points the DNS record of name to the tunnel, it
+// returns true if the hostname is routed through the tunnel
+func registerCFDnsEndpoint(cfc types.CFController, tunnelId uuid.UUID, name string, source string, meta *types.CFConfigIngressMeta) (bool, error) {
+	zone, err := cfc.Rest().ZoneForHostname(name)
+	if err != nil {
+		cfc.Log().Error().Str("dnsName", name).Err(err).Msg("Error resolving zone")
+		return false, err
+	}
+	if meta != nil && meta.LoadBalancer {
+		return registerCFLoadBalancer(cfc, zone.ID, tunnelId, name, source, meta)
 	}
-	domain := fmt.Sprintf("%s.%s", parts[len(parts)-2], parts[len(parts)-1])
-	cfClient, err := cfc.Rest().GetCFClientForDomain(domain)
+	recs, err := addressRecords(cfc, zone.ID, name)
 	if err != nil {
-		cfc.Log().Error().Str("dnsName", name).Err(err).Msg("Error getting CF client")
-		return err
+		cfc.Log().Error().Str("dnsName", name).Err(err).Msg("Error reading DNS record")
+		return false, err
 	}
-	_, err = cfClient.RouteTunnel(tunnelId, cfapi.NewDNSRoute(name, true))
-	if err != nil && !strings.HasPrefix(err.Error(), "Failed to add route: code: 1003") {
-		cfc.Log().Error().Str("dnsName", name).Err(err).Msg("Error routing tunnel")
-		return err
+	opts := dnsRecordOptionsFromMeta(cfc, name, meta)
+	var created bool
+	switch {
+	case pointsToTunnel(recs, tunnelId):
+		if !opts.matches(&recs[0]) {
+			err = updateTunnelRecord(cfc, zone.ID, tunnelId, &recs[0], opts)
+			if err != nil {
+				cfc.Log().Error().Str("dnsName", name).Err(err).Msg("Error updating DNS record")
+				return false, err
+			}
+		}
+	case len(recs) > 0:
+		policy := types.DNSConflictPolicy("")
+		if meta != nil {
+			policy = meta.DNSConflict
+		}
+		created, err = resolveDNSConflict(cfc, zone.ID, tunnelId, name, recs, policy, opts)
+		if err != nil {
+			return false, err
+		}
+		if !created {
+			// skipped, the record points somewhere else
+			return false, nil
+		}
+	default:
+		err = createTunnelRecord(cfc, zone.ID, tunnelId, name, opts)
+		if err != nil {
+			cfc.Log().Error().Str("dnsName", name).Err(err).Msg("Error creating DNS record")
+			return false, err
+		}
+		created = true
 	}
-	return nil
+	err = claimDNSRecord(cfc, zone.ID, tunnelId, name, source, created)
+	return err == nil, err
 }
 
 // func parseTunnelName(cfc types.CFController, ometa *v1.ObjectMeta) (ns string, name string, err error) {
@@ -216,26 +261,51 @@ func registerCFDnsEndpoint(cfc types.CFController, tunnelId uuid.UUID, name stri
 
 func updateCFTunnel(cfc types.CFController, tparam *types.CFTunnelParameterWithID, cm *corev1.ConfigMap) error {
 	// registerCFDnsEndpoint
-	for _, yamlRules := range cm.Data {
-		rules := []types.CFConfigIngress{}
-		err := yaml.Unmarshal([]byte(yamlRules), &rules)
-		if err != nil {
-			cfc.Log().Error().Err(err).Str("rules", yamlRules).Msg("error unmarshalling rules")
+	// key source object with dns-conflict fail, value first conflict
+	conflicts := make(map[string]error)
+	routed := make(map[string]bool)
+	for _, rule := range rules.FromConfigMap(cfc.Log(), cm) {
+		if rule.Rule.Hostname == "" {
 			continue
 		}
-		for _, rule := range rules {
-			registerCFDnsEndpoint(cfc, tparam.ID, rule.Hostname)
+		meta := types.CFConfigIngressMeta{}
+		if rule.Rule.Meta != nil {
+			meta = *rule.Rule.Meta
+		}
+		ok, err := registerCFDnsEndpoint(cfc, tparam.ID, rule.Rule.Hostname, rule.Key, &meta)
+		if ok {
+			routed[rule.Rule.Hostname] = true
+		}
+		if meta.DNSConflict != types.DNSConflictFail || meta.Source == "" {
+			continue
+		}
+		var conflict *dnsConflictError
+		if errors.As(err, &conflict) && conflicts[meta.Source] == nil {
+			conflicts[meta.Source] = err
+		} else if _, found := conflicts[meta.Source]; !found {
+			conflicts[meta.Source] = nil
+		}
+	}
+	for source, err := range conflicts {
+		markDNSError(cfc, source, err)
+	}
+	syncPrivateRoutes(cfc, tparam, cm)
+	if cfc.Cfg().CloudFlare.RemoteManaged() {
+		err := syncRemoteConfig(cfc, tparam, cm)
+		if err != nil {
+			return err
 		}
 	}
 	// updateConfigMap state
 	// cm.Annotations[config.AnnotationCloudflareTunnelState()] = "ready"
 	cm.Annotations[config.AnnotationCloudflareTunnelId()] = tparam.ID.String()
 	cm.Annotations[config.AnnotationCloudflareTunnelCFDName()] = config.CfTunnelName(cfc, &tparam.CFTunnelParameter)
+	cm.Annotations[config.AnnotationCloudflareDNSRouted()] = strings.Join(sortedHostnames(routed), ",")
 	return k8s_data.UpsertConfigMap(cfc, &tparam.CFTunnelParameter, cm)
 }
 
 func createCFTunnel(cfc types.CFController, tp *types.CFTunnelParameter, ometa *metav1.ObjectMeta) (*types.CFTunnelParameterWithID, error) {
-	cfClient, err := cfc.Rest().CFClientWithoutZoneID()
+	api, err := cfc.Rest().Cfgo()
 	if err != nil {
 		cfc.Log().Error().Err(err).Msg("Can't find CF client")
 		return nil, err
@@ -245,23 +315,32 @@ func createCFTunnel(cfc types.CFController, tp *types.CFTunnelParameter, ometa *
 	rand.Read(byteSecret)
 
 	// add cluster name from config
-	ts, err := cfClient.CreateTunnel(config.CfTunnelName(cfc, tp), byteSecret)
+	ts, err := api.CreateTunnel(cfc.Context(), cfgo.AccountIdentifier(cfc.Cfg().CloudFlare.AccountId), cfgo.TunnelCreateParams{
+		Name:      config.CfTunnelName(cfc, tp),
+		Secret:    base64.StdEncoding.EncodeToString(byteSecret),
+		ConfigSrc: cfc.Cfg().CloudFlare.ConfigSrc,
+	})
 	if err != nil {
 		cfc.Log().Error().Str("name", tp.Name).Err(err).Msg("Error creating tunnel")
 		return nil, err
 	}
+	tunnelId, err := uuid.Parse(ts.ID)
+	if err != nil {
+		cfc.Log().Error().Str("name", tp.Name).Str("id", ts.ID).Err(err).Msg("Error parsing tunnel id")
+		return nil, err
+	}
 	_, err = k8s_data.CreateSecret(cfc, &types.CFTunnelParameterWithID{
 		CFTunnelParameter: *tp,
-		ID:                ts.ID,
+		ID:                tunnelId,
 	}, byteSecret, ometa)
 	if err != nil {
-		deleteCFTunnel(cfc, tp)
+		deleteCFTunnel(cfc, tp, nil)
 		cfc.Log().Error().Str("name", tp.Name).Err(err).Msg("Error creating secret")
 		return nil, err
 	}
 	return &types.CFTunnelParameterWithID{
 		CFTunnelParameter: *tp,
-		ID:                ts.ID,
+		ID:                tunnelId,
 	}, nil
 }
 
@@ -293,35 +372,21 @@ func validateCFTunnel(cfc types.CFController, tp *types.CFTunnelParameter, cm *c
 	return updateCFTunnel(cfc, tpwi, cm)
 }
 
-func deleteCFTunnel(cfc types.CFController, tp *types.CFTunnelParameter) {
-	tunnels, err := findTunnelFromCF(cfc, tp)
+// withTunnelCredentials uses the Cloudflare account of the tunnel ConfigMap
+func withTunnelCredentials(cfc types.CFController, cm *corev1.ConfigMap) (types.CFController, error) {
+	creds, err := k8s_data.TunnelCredentials(cfc, cm.Namespace, cm.Annotations)
 	if err != nil {
-		cfc.Log().Error().Err(err).Msg("Error finding tunnel")
-		return
+		return nil, err
 	}
-	if len(tunnels) != 0 {
-		cfClient, err := cfc.Rest().CFClientWithoutZoneID()
-		if err != nil {
-			cfc.Log().Error().Err(err).Msg("Can't find CF client")
-			return
-		}
-		err = cfClient.DeleteTunnel(tunnels[0].ID)
-		if err != nil {
-			cfc.Log().Error().Err(err).Msg("Error deleting tunnel")
-			return
-		}
-	} else {
-		cfc.Log().Info().Str("name", tp.Name).Msg("Tunnel not found")
-		err = k8s_data.DeleteSecret(cfc, tp)
-		if err != nil {
-			cfc.Log().Error().Err(err).Msg("Error deleting tunnel")
-			return
-		}
+	if creds == nil {
+		return cfc, nil
 	}
+	return cfc.WithCredentials(creds), nil
 }
 
 func ConfigMapHandlerPrepareCloudflared(_cfc types.CFController) func() {
 	cfc := _cfc.WithComponent("ConfigMapHandlerPrepareCloudflared")
+	deletions := newTunnelDeletions()
 	unreg := cfc.K8sData().TunnelConfigMaps.Register(func(cms []*corev1.ConfigMap, ev watch.Event) {
 		cm, found := ev.Object.(*corev1.ConfigMap)
 		if !found {
@@ -338,6 +403,12 @@ func ConfigMapHandlerPrepareCloudflared(_cfc types.CFController) func() {
 			log := c.Log().With().Str("tunnel", tparam.Name).Logger()
 			c.SetLog(&log)
 		})
+		scoped, err := withTunnelCredentials(cfc, cm)
+		if err != nil {
+			cfc.Log().Error().Err(err).Msg("error getting tunnel credentials")
+			return
+		}
+		cfc = scoped
 
 		// state, found := cm.Annotations[config.AnnotationCloudflareTunnelState()]
 		// if !found {
@@ -356,16 +427,21 @@ func ConfigMapHandlerPrepareCloudflared(_cfc types.CFController) func() {
 
 		switch ev.Type {
 		case watch.Added:
+			deletions.cancel(cfc, tparam)
 			validateCFTunnel(cfc, tparam, cm)
 		case watch.Modified:
+			deletions.cancel(cfc, tparam)
 			validateCFTunnel(cfc, tparam, cm)
 		case watch.Deleted:
-			deleteCFTunnel(cfc, tparam)
+			deletions.schedule(cfc, tparam, cm)
 		default:
 			cfc.Log().Error().Str("event", string(ev.Type)).Msg("unknown event type")
 		}
 	})
+	// the replayed tunnel ConfigMaps are known, continue the rest
+	deletions.restore(cfc)
 	return func() {
 		unreg()
+		deletions.stop()
 	}
 }
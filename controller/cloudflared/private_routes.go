@@ -0,0 +1,186 @@
+package cloudflared
+
+import (
+	"fmt"
+
+	cfgo "github.com/cloudflare/cloudflare-go"
+	"github.com/mabels/cloudflared-controller/controller/rules"
+	"github.com/mabels/cloudflared-controller/controller/types"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// private routes and virtual networks carry the owner of the DNS records
+// in their comment, only owned routes are ever deleted
+func routeOwner(cfc types.CFController, source string) string {
+	return dnsOwner{
+		Heritage: ownerHeritage,
+		Cluster:  cfc.Cfg().ClusterName,
+		Source:   source,
+	}.String()
+}
+
+func routeKey(network, vnetId string) string {
+	return vnetId + "/" + network
+}
+
+// defaultVirtualNetworkID returns the id of the default network, the routes
+// read back from the API carry it instead of an empty id
+func defaultVirtualNetworkID(cfc types.CFController, api *cfgo.API) (string, error) {
+	isDefault := true
+	deleted := false
+	vnets, err := api.ListTunnelVirtualNetworks(cfc.Context(), cfgo.AccountIdentifier(cfc.Cfg().CloudFlare.AccountId), cfgo.TunnelVirtualNetworksListParams{
+		IsDefault: &isDefault,
+		IsDeleted: &deleted,
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, vnet := range vnets {
+		if vnet.IsDefaultNetwork {
+			return vnet.ID, nil
+		}
+	}
+	return "", fmt.Errorf("the account has no default virtual network")
+}
+
+// virtualNetworkID returns the id of the named virtual network and creates
+// it if it is missing, the empty name is the default network
+func virtualNetworkID(cfc types.CFController, api *cfgo.API, name string, source string) (string, error) {
+	if name == "" {
+		return defaultVirtualNetworkID(cfc, api)
+	}
+	rc := cfgo.AccountIdentifier(cfc.Cfg().CloudFlare.AccountId)
+	deleted := false
+	vnets, err := api.ListTunnelVirtualNetworks(cfc.Context(), rc, cfgo.TunnelVirtualNetworksListParams{
+		Name:      name,
+		IsDeleted: &deleted,
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(vnets) > 0 {
+		return vnets[0].ID, nil
+	}
+	vnet, err := api.CreateTunnelVirtualNetwork(cfc.Context(), rc, cfgo.TunnelVirtualNetworkCreateParams{
+		Name:    name,
+		Comment: routeOwner(cfc, source),
+	})
+	if err != nil {
+		return "", err
+	}
+	cfc.Log().Info().Str("virtualNetwork", name).Str("id", vnet.ID).Msg("Created virtual network")
+	return vnet.ID, nil
+}
+
+func tunnelRoutes(cfc types.CFController, api *cfgo.API, tparam *types.CFTunnelParameterWithID) (map[string]cfgo.TunnelRoute, error) {
+	deleted := false
+	routes, err := api.ListTunnelRoutes(cfc.Context(), cfgo.AccountIdentifier(cfc.Cfg().CloudFlare.AccountId), cfgo.TunnelRoutesListParams{
+		TunnelID:  tparam.ID.String(),
+		IsDeleted: &deleted,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]cfgo.TunnelRoute, len(routes))
+	for _, route := range routes {
+		ret[routeKey(route.Network, route.VirtualNetworkID)] = route
+	}
+	return ret, nil
+}
+
+func deleteTunnelRoute(cfc types.CFController, api *cfgo.API, route cfgo.TunnelRoute) error {
+	err := api.DeleteTunnelRoute(cfc.Context(), cfgo.AccountIdentifier(cfc.Cfg().CloudFlare.AccountId), cfgo.TunnelRoutesDeleteParams{
+		Network:          route.Network,
+		VirtualNetworkID: route.VirtualNetworkID,
+	})
+	if err != nil {
+		cfc.Log().Error().Err(err).Str("network", route.Network).Msg("Error deleting private route")
+		return err
+	}
+	cfc.Log().Info().Str("network", route.Network).Str("virtualNetworkId", route.VirtualNetworkID).Msg("Deleted private route")
+	return nil
+}
+
+// syncPrivateRoutes creates the private routes of the tunnel ConfigMap and
+// deletes the owned routes of the tunnel which are no longer wanted
+func syncPrivateRoutes(cfc types.CFController, tparam *types.CFTunnelParameterWithID, cm *corev1.ConfigMap) error {
+	api, err := cfc.Rest().Cfgo()
+	if err != nil {
+		cfc.Log().Error().Err(err).Msg("Can't find CF client")
+		return err
+	}
+	current, err := tunnelRoutes(cfc, api, tparam)
+	if err != nil {
+		cfc.Log().Error().Err(err).Msg("Error listing private routes")
+		return err
+	}
+	// key virtual network name, value id
+	vnets := make(map[string]string)
+	// the owned routes of a virtual network which can't be resolved are kept
+	unresolved := false
+	wanted := make(map[string]bool)
+	for _, sr := range rules.PrivateRoutes(cfc.Log(), cm) {
+		log := cfc.Log().With().Str("network", sr.Route.Network).Str("virtualNetwork", sr.Route.VirtualNetwork).Logger()
+		vnetId, found := vnets[sr.Route.VirtualNetwork]
+		if !found {
+			vnetId, err = virtualNetworkID(cfc, api, sr.Route.VirtualNetwork, sr.Key)
+			if err != nil {
+				log.Error().Err(err).Msg("Error resolving virtual network")
+				unresolved = true
+				continue
+			}
+			vnets[sr.Route.VirtualNetwork] = vnetId
+		}
+		key := routeKey(sr.Route.Network, vnetId)
+		wanted[key] = true
+		if _, found := current[key]; found {
+			continue
+		}
+		_, err := api.CreateTunnelRoute(cfc.Context(), cfgo.AccountIdentifier(cfc.Cfg().CloudFlare.AccountId), cfgo.TunnelRoutesCreateParams{
+			Network:          sr.Route.Network,
+			TunnelID:         tparam.ID.String(),
+			Comment:          routeOwner(cfc, sr.Key),
+			VirtualNetworkID: vnetId,
+		})
+		if err != nil {
+			// e.g. the network is routed through another tunnel
+			log.Error().Err(err).Str("source", sr.Key).Msg("Error creating private route")
+			continue
+		}
+		log.Info().Str("source", sr.Key).Msg("Created private route")
+	}
+	resolved := make(map[string]bool, len(vnets))
+	for _, vnetId := range vnets {
+		resolved[vnetId] = true
+	}
+	for key, route := range current {
+		if wanted[key] || !parseDNSOwner(route.Comment).ownedBy(cfc) {
+			continue
+		}
+		if unresolved && !resolved[route.VirtualNetworkID] {
+			// it may be wanted in the virtual network which failed
+			continue
+		}
+		deleteTunnelRoute(cfc, api, route)
+	}
+	return nil
+}
+
+// removePrivateRoutes deletes all owned routes of the tunnel
+func removePrivateRoutes(cfc types.CFController, tparam *types.CFTunnelParameterWithID) error {
+	api, err := cfc.Rest().Cfgo()
+	if err != nil {
+		return err
+	}
+	current, err := tunnelRoutes(cfc, api, tparam)
+	if err != nil {
+		cfc.Log().Error().Err(err).Msg("Error listing private routes")
+		return err
+	}
+	for _, route := range current {
+		if parseDNSOwner(route.Comment).ownedBy(cfc) {
+			deleteTunnelRoute(cfc, api, route)
+		}
+	}
+	return nil
+}
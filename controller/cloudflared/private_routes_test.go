@@ -0,0 +1,69 @@
+package cloudflared
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	cfgo "github.com/cloudflare/cloudflare-go"
+	"github.com/google/uuid"
+	"github.com/mabels/cloudflared-controller/controller"
+	"github.com/mabels/cloudflared-controller/controller/types"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncPrivateRoutes(t *testing.T) {
+	log := zerolog.Nop()
+	cfc := controller.NewCFController(&log)
+	cfg := types.CFControllerConfig{ClusterName: "eu"}
+	cfg.CloudFlare.ApiToken = "token"
+	cfg.CloudFlare.AccountId = "acc"
+	cfc.SetCfg(&cfg)
+	owned := routeOwner(cfc, "private-routes.service-default-a")
+	routes := []cfgo.TunnelRoute{
+		{Network: "10.0.0.1/32", VirtualNetworkID: "default-id", Comment: owned},
+		{Network: "10.9.0.0/16", VirtualNetworkID: "default-id", Comment: owned},
+		{Network: "10.1.0.1/32", VirtualNetworkID: "team-id", Comment: owned},
+	}
+	writes := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var result interface{}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/accounts/acc/teamnet/routes":
+			result = routes
+		case r.Method == http.MethodGet && r.URL.Path == "/accounts/acc/teamnet/virtual_networks":
+			if r.URL.Query().Get("is_default") != "true" {
+				// the lookup of the team network fails
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"success":false,"errors":[{"code":1000,"message":"failed"}],"messages":[],"result":null}`))
+				return
+			}
+			result = []cfgo.TunnelVirtualNetwork{{ID: "default-id", Name: "default", IsDefaultNetwork: true}}
+		default:
+			writes = append(writes, r.Method+" "+r.URL.Path)
+			result = cfgo.TunnelRoute{}
+		}
+		out, _ := json.Marshal(map[string]interface{}{"success": true, "errors": []interface{}{}, "messages": []interface{}{}, "result": result})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+	}))
+	defer srv.Close()
+	api, err := cfc.Rest().Cfgo()
+	assert.NoError(t, err)
+	api.BaseURL = srv.URL
+
+	cm := tunnelCM("a", nil, map[string]string{
+		"private-routes.service-default-a": "- network: 10.0.0.1/32\n- network: 10.1.0.1/32\n  virtualNetwork: team\n",
+	})
+	tparam := &types.CFTunnelParameterWithID{
+		CFTunnelParameter: types.CFTunnelParameter{Namespace: "default", Name: "a"},
+		ID:                uuid.New(),
+	}
+	assert.NoError(t, syncPrivateRoutes(cfc, tparam, cm))
+	// the route of the default network exists, the route of the failed
+	// network is kept and only the unwanted route is deleted
+	assert.Len(t, writes, 1)
+	assert.Contains(t, writes[0], "DELETE /accounts/acc/teamnet/routes/network/10.9.0.0")
+}
@@ -0,0 +1,109 @@
+package cloudflared
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+
+	cfgo "github.com/cloudflare/cloudflare-go"
+	"github.com/mabels/cloudflared-controller/controller/config"
+	"github.com/mabels/cloudflared-controller/controller/rules"
+	"github.com/mabels/cloudflared-controller/controller/types"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func remoteIngress(cfcis []types.CFConfigIngress) []cfgo.UnvalidatedIngressRule {
+	ret := make([]cfgo.UnvalidatedIngressRule, 0, len(cfcis))
+	for _, cfci := range cfcis {
+		rule := cfgo.UnvalidatedIngressRule{
+			Hostname: cfci.Hostname,
+			Path:     cfci.Path,
+			Service:  cfci.Service,
+		}
+		if cfci.OriginRequest != nil {
+			rule.OriginRequest = &cfgo.OriginRequestConfig{}
+			if cfci.OriginRequest.NoTLSVerify {
+				noTLSVerify := true
+				rule.OriginRequest.NoTLSVerify = &noTLSVerify
+			}
+			if cfci.OriginRequest.HttpHostHeader != "" {
+				hostHeader := cfci.OriginRequest.HttpHostHeader
+				rule.OriginRequest.HTTPHostHeader = &hostHeader
+			}
+			if cfci.OriginRequest.Http2Origin {
+				http2Origin := true
+				rule.OriginRequest.Http2Origin = &http2Origin
+			}
+		}
+		ret = append(ret, rule)
+	}
+	return ret
+}
+
+// sameIngress compares the rules ignoring empty origin requests, which
+// cloudflare may return differently than we sent them
+func sameIngress(a, b []cfgo.UnvalidatedIngressRule) bool {
+	normalize := func(rules []cfgo.UnvalidatedIngressRule) []cfgo.UnvalidatedIngressRule {
+		ret := make([]cfgo.UnvalidatedIngressRule, 0, len(rules))
+		for _, r := range rules {
+			if r.OriginRequest != nil && reflect.DeepEqual(*r.OriginRequest, cfgo.OriginRequestConfig{}) {
+				r.OriginRequest = nil
+			}
+			ret = append(ret, r)
+		}
+		return ret
+	}
+	return reflect.DeepEqual(normalize(a), normalize(b))
+}
+
+func sameWarpRouting(a, b *cfgo.WarpRoutingConfig) bool {
+	return (a != nil && a.Enabled) == (b != nil && b.Enabled)
+}
+
+// syncRemoteConfig pushes the merged rules of the tunnel ConfigMap to the
+// remote tunnel configuration if they differ from the current version. The
+// pushed version is stored in the tunnel-config-version annotation.
+func syncRemoteConfig(cfc types.CFController, tparam *types.CFTunnelParameterWithID, cm *corev1.ConfigMap) error {
+	srules := rules.Build(cfc.Log(), cm)
+	errs := rules.Validate(srules)
+	if len(errs) > 0 {
+		logRuleErrors(cfc, errs)
+		return fmt.Errorf("invalid ingress rules for tunnel %s", tparam.Name)
+	}
+	logRuleWarnings(cfc, rules.Warnings(srules))
+	api, err := cfc.Rest().Cfgo()
+	if err != nil {
+		cfc.Log().Error().Err(err).Msg("Can't find CF client")
+		return err
+	}
+	account := cfgo.AccountIdentifier(cfc.Cfg().CloudFlare.AccountId)
+	desired := cfgo.TunnelConfiguration{
+		Ingress: remoteIngress(rules.Ingress(srules)),
+	}
+	if rules.WarpRouting(cfc.Log(), cm) {
+		desired.WarpRouting = &cfgo.WarpRoutingConfig{Enabled: true}
+	}
+	current, err := api.GetTunnelConfiguration(cfc.Context(), account, tparam.ID.String())
+	if err != nil {
+		cfc.Log().Error().Err(err).Msg("Error getting tunnel configuration")
+		return err
+	}
+	version := strconv.Itoa(current.Version)
+	if known, found := cm.Annotations[config.AnnotationCloudflareTunnelConfigVersion()]; found && known != version {
+		cfc.Log().Warn().Str("known", known).Str("current", version).Msg("Tunnel configuration was changed outside of the controller")
+	}
+	if !sameIngress(current.Config.Ingress, desired.Ingress) || !sameWarpRouting(current.Config.WarpRouting, desired.WarpRouting) {
+		updated, err := api.UpdateTunnelConfiguration(cfc.Context(), account, cfgo.TunnelConfigurationParams{
+			TunnelID: tparam.ID.String(),
+			Config:   desired,
+		})
+		if err != nil {
+			cfc.Log().Error().Err(err).Msg("Error updating tunnel configuration")
+			return err
+		}
+		version = strconv.Itoa(updated.Version)
+		cfc.Log().Info().Str("version", version).Int("rules", len(desired.Ingress)).Msg("Updated tunnel configuration")
+	}
+	cm.Annotations[config.AnnotationCloudflareTunnelConfigVersion()] = version
+	return nil
+}
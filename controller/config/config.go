@@ -37,6 +37,16 @@ func GetConfig(log *zerolog.Logger, version string) (*types.CFControllerConfig,
 	pflag.StringVar(&cfg.CloudFlaredFname, "cloudflared-fname", "cloudflared", "cloudflared binary filename")
 	pflag.StringVar(&cfg.ClusterName, "cloudflared-clustername", "k8s", "prefix the CF tunnel name with this cluster name")
 	pflag.StringVar(&cfg.CloudFlare.TunnelConfigMapNamespace, "cloudflared-tunnel-configmap-namespace", "default", "default namespace for cloudflared tunnel configmaps")
+	pflag.StringVar(&cfg.CloudFlare.ConfigSrc, "cloudflared-config-src", "local", "where cloudflared gets its ingress rules from: local or cloudflare")
+	pflag.DurationVar(&cfg.CloudFlare.ZoneCacheTTL, "zone-cache-ttl", 10*time.Minute, "refresh interval of the cached account zones (0 = no background refresh)")
+	pflag.DurationVar(&cfg.CloudFlare.ZoneCacheNegativeTTL, "zone-cache-negative-ttl", time.Minute, "how long a hostname without zone is not looked up again")
+	pflag.DurationVar(&cfg.CloudFlare.TunnelDeleteGrace, "tunnel-delete-grace", 5*time.Minute, "delay before the tunnel of a deleted tunnel ConfigMap is deleted (0 = immediately)")
+	pflag.Float64Var(&cfg.CloudFlare.RateLimit, "cloudflare-rate-limit", 4, "requests per second to the Cloudflare API (0 = unlimited)")
+	pflag.IntVar(&cfg.CloudFlare.RateBurst, "cloudflare-rate-burst", 10, "burst of requests to the Cloudflare API")
+	pflag.IntVar(&cfg.CloudFlare.MaxRetries, "cloudflare-max-retries", 5, "retries of throttled or failed Cloudflare API requests")
+	pflag.DurationVar(&cfg.CloudFlare.RetryMinBackoff, "cloudflare-retry-min-backoff", time.Second, "first backoff of a retried Cloudflare API request")
+	pflag.DurationVar(&cfg.CloudFlare.RetryMaxBackoff, "cloudflare-retry-max-backoff", 30*time.Second, "maximum backoff of a retried Cloudflare API request")
+	pflag.DurationVar(&cfg.CloudFlare.RequestTimeout, "cloudflare-request-timeout", 30*time.Second, "timeout of a single Cloudflare API request (0 = none)")
 	pflag.DurationVarP(&cfg.Leader.LeaseDuration, "leader-lease-duration", "l", 15*time.Second, "leader lease duration")
 	pflag.DurationVarP(&cfg.Leader.RenewDeadline, "leader-renew-deadline", "r", 10*time.Second, "leader renew deadline")
 	pflag.DurationVarP(&cfg.Leader.RetryPeriod, "leader-retry-period", "p", 2*time.Second, "leader retry period")
@@ -47,14 +57,28 @@ func GetConfig(log *zerolog.Logger, version string) (*types.CFControllerConfig,
 	pflag.StringVar(&cfg.Leader.Name, "leader-name", "cloudflared-controller", "leader elected name")
 	pflag.StringVar(&cfg.Leader.Namespace, "leader-namespace", "default", "leader election namespace")
 	pflag.IntVar(&cfg.ChannelSize, "channel-size", 10, "channel size")
+	pflag.IntVar(&cfg.Connectors.Default, "connectors-default", 0, "replicas running a tunnel without connectors annotation (0 = all)")
+	pflag.DurationVar(&cfg.Connectors.LeaseDuration, "connectors-lease-duration", 15*time.Second, "connector member lease duration")
+	pflag.DurationVar(&cfg.Connectors.RenewInterval, "connectors-renew-interval", 5*time.Second, "connector member lease renew interval")
+	pflag.DurationVar(&cfg.DNS.GCInterval, "dns-gc-interval", 10*time.Minute, "interval of the sweep over owned DNS records (0 = no garbage collection)")
+	pflag.DurationVar(&cfg.DNS.GCDelay, "dns-gc-delay", 30*time.Second, "delay before the DNS records of removed hostnames are deleted")
+	pflag.StringVar(&cfg.IngressClass.Controller, "ingress-controller-name", "cloudflare.com/cloudflared-controller", "spec.controller of the IngressClasses served by this controller")
+	pflag.DurationVar(&cfg.Preflight.Interval, "preflight-interval", 10*time.Minute, "interval of the token permission check (0 = only at start)")
+	pflag.BoolVar(&cfg.Preflight.Access, "preflight-access", false, "check and require the Access permissions of the token")
 	pflag.BoolVar(&cfg.TestCreateAccess, "test-create-access", false, "test create access")
+	pflag.BoolVar(&cfg.DryRun, "dry-run", false, "log the planned changes instead of applying them")
+	pflag.StringVar(&cfg.DebugAddr, "debug-addr", "", "listen address of the debug endpoints (e.g. :8081)")
 	pflag.Parse()
+	cfg.Command = pflag.Args()
 	if cfg.CloudFlare.ApiToken == "" {
 		return nil, fmt.Errorf("Cloudflare API Key is required")
 	}
 	if cfg.CloudFlare.AccountId == "" {
 		return nil, fmt.Errorf("Cloudflare Account ID is required")
 	}
+	if cfg.CloudFlare.ConfigSrc != "local" && cfg.CloudFlare.ConfigSrc != "cloudflare" {
+		return nil, fmt.Errorf("invalid cloudflared-config-src %s: local or cloudflare", cfg.CloudFlare.ConfigSrc)
+	}
 	// if cfg.CloudFlare.ZoneId == "" {
 	// 	return nil, fmt.Errorf("Cloudflare Zone ID is required")
 	// }
@@ -72,6 +96,9 @@ func AnnotationCloudflareTunnelId() string {
 func AnnotationCloudflareTunnelCFDName() string {
 	return fmt.Sprintf("%s/%s", AnnotationsPrefix, "tunnel-cfd-name")
 }
+func AnnotationCloudflareTunnelConfigVersion() string {
+	return fmt.Sprintf("%s/%s", AnnotationsPrefix, "tunnel-config-version")
+}
 func AnnotationCloudflareTunnelExternalName() string {
 	return fmt.Sprintf("%s/%s", AnnotationsPrefix, "tunnel-external-name")
 }
@@ -90,6 +117,89 @@ func AnnotationCloudflareTunnelHostHeader() string {
 // 	return fmt.Sprintf("%s/%s", AnnotationsPrefix, "tunnel-port")
 // }
 
+// number of controller replicas which run a connector for the tunnel
+func AnnotationCloudflareTunnelConnectors() string {
+	return fmt.Sprintf("%s/%s", AnnotationsPrefix, "connectors")
+}
+
+func AnnotationCloudflareRulePriority() string {
+	return fmt.Sprintf("%s/%s", AnnotationsPrefix, "rule-priority")
+}
+
+func AnnotationCloudflareDNSConflict() string {
+	return fmt.Sprintf("%s/%s", AnnotationsPrefix, "dns-conflict")
+}
+
+func AnnotationCloudflareDNSProxied() string {
+	return fmt.Sprintf("%s/%s", AnnotationsPrefix, "dns-proxied")
+}
+
+// seconds, only used for records which are not proxied
+func AnnotationCloudflareDNSTTL() string {
+	return fmt.Sprintf("%s/%s", AnnotationsPrefix, "dns-ttl")
+}
+
+func AnnotationCloudflareDNSComment() string {
+	return fmt.Sprintf("%s/%s", AnnotationsPrefix, "dns-comment")
+}
+
+// set on the source object if one of its DNS records is in conflict
+func AnnotationCloudflareDNSError() string {
+	return fmt.Sprintf("%s/%s", AnnotationsPrefix, "dns-error")
+}
+
+// set on the tunnel ConfigMap, the comma separated hostnames whose DNS record
+// or load balancer points to the tunnel
+func AnnotationCloudflareDNSRouted() string {
+	return fmt.Sprintf("%s/%s", AnnotationsPrefix, "dns-routed")
+}
+
+// keeps the tunnel if its ConfigMap is deleted
+func AnnotationCloudflareDeletionProtection() string {
+	return fmt.Sprintf("%s/%s", AnnotationsPrefix, "deletion-protection")
+}
+
+func AnnotationCloudflareLoadBalancer() string {
+	return fmt.Sprintf("%s/%s", AnnotationsPrefix, "load-balancer")
+}
+
+func AnnotationCloudflareLBMonitorPath() string {
+	return fmt.Sprintf("%s/%s", AnnotationsPrefix, "load-balancer-monitor-path")
+}
+
+// true copies the ImplementationSpecific paths of an Ingress verbatim as
+// cloudflared regex, otherwise they are prefixes
+func AnnotationCloudflarePathRegex() string {
+	return fmt.Sprintf("%s/%s", AnnotationsPrefix, "path-regex")
+}
+
+// the service of the final catch-all rule of the tunnel instead of http_status:404
+func AnnotationCloudflareTunnelFallback() string {
+	return fmt.Sprintf("%s/%s", AnnotationsPrefix, "tunnel-fallback")
+}
+
+// set on the deletion Lease while the tunnel of a deleted tunnel ConfigMap
+// waits for its deletion, the deadline in RFC3339 and the hostnames to release
+func AnnotationCloudflareTunnelDeleteAfter() string {
+	return fmt.Sprintf("%s/%s", AnnotationsPrefix, "tunnel-delete-after")
+}
+func AnnotationCloudflareTunnelDeleteHostnames() string {
+	return fmt.Sprintf("%s/%s", AnnotationsPrefix, "tunnel-delete-hostnames")
+}
+
+func AnnotationCloudflareCredentialsSecret() string {
+	return fmt.Sprintf("%s/%s", AnnotationsPrefix, "credentials-secret")
+}
+
+// true routes the ClusterIPs of a Service, otherwise a list of CIDRs
+func AnnotationCloudflarePrivateRoute() string {
+	return fmt.Sprintf("%s/%s", AnnotationsPrefix, "private-route")
+}
+
+func AnnotationCloudflareVirtualNetwork() string {
+	return fmt.Sprintf("%s/%s", AnnotationsPrefix, "virtual-network")
+}
+
 func AnnotationCloudflareTunnelMapping() string {
 	return fmt.Sprintf("%s/%s", AnnotationsPrefix, "tunnel-mapping")
 }
@@ -109,6 +219,9 @@ func AnnotationCloudflareTunnelK8sConfigMap() string {
 
 const (
 	LabelCloudflaredControllerVersion = "cloudflared-controller/version"
+	LabelCloudflaredControllerMember  = "cloudflared-controller/member-of"
+	// the Leases of pending tunnel deletions
+	LabelCloudflaredControllerDeletionOf = "cloudflared-controller/deletion-of"
 	// LabelCloudflaredControllerManaged = "cloudflared-controller/managed"
 	// LabelCloudflaredControllerTunnelId = "cloudflared-controller/tunnel-id"
 )
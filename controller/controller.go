@@ -2,6 +2,7 @@ package controller
 
 import (
 	"context"
+	"net/http"
 
 	"github.com/cloudflare/cloudflare-go/v3"
 	"github.com/cloudflare/cloudflare-go/v3/option"
@@ -21,11 +22,15 @@ type localController struct {
 	context     context.Context
 	cancelFunc  context.CancelFunc
 	k8sData     *types.K8sData
+	plan        *types.Plan
 }
 
-func getZones(cfc types.CFController) ([]zones.Zone, error) {
+func getZones(cfc types.CFController, apiToken string, httpClient *http.Client) ([]zones.Zone, error) {
 	client := cloudflare.NewClient(
-		option.WithAPIToken(cfc.Cfg().CloudFlare.ApiToken),
+		option.WithAPIToken(apiToken),
+		option.WithHTTPClient(httpClient),
+		// retries are done by the cfTransport
+		option.WithMaxRetries(0),
 	)
 
 	// cloudflare.New(&cloudflare.ClientParams{
@@ -37,10 +42,12 @@ func getZones(cfc types.CFController) ([]zones.Zone, error) {
 	// 	return nil, err
 	// }
 	zoneLst := []zones.Zone{}
-	page := 0
+	page := 1
 
 	for {
-		pages, err := client.Zones.List(cfc.Context(), zones.ZoneListParams{})
+		pages, err := client.Zones.List(cfc.Context(), zones.ZoneListParams{
+			Page: cloudflare.F(float64(page)),
+		})
 		if err != nil {
 			return nil, err
 		}
@@ -61,6 +68,7 @@ func NewCFController(log *zerolog.Logger) types.CFController {
 		context:    ctx,
 		cancelFunc: cancelFn,
 		k8sData:    &types.K8sData{},
+		plan:       &types.Plan{},
 		// },
 		shutdownFns: make(map[string]func()),
 	}
@@ -80,6 +88,10 @@ func (cfc *localController) K8sData() *types.K8sData {
 	return cfc.k8sData
 }
 
+func (cfc *localController) Plan() *types.Plan {
+	return cfc.plan
+}
+
 func (cfc *localController) Rest() types.RestClients {
 	return cfc.rest
 }
@@ -110,6 +122,18 @@ func (cfc *localController) WithComponent(component string, fns ...func(types.CF
 	return &cf
 }
 
+func (cfc *localController) WithCredentials(creds *types.CFCredentials) types.CFController {
+	cf := *cfc
+	cfg := *cfc.cfg
+	cfg.CloudFlare.ApiToken = creds.ApiToken
+	cfg.CloudFlare.AccountId = creds.AccountId
+	cf.cfg = &cfg
+	log := cf.Log().With().Str("credentials", creds.Secret).Logger()
+	cf.SetLog(&log)
+	cf.rest = cfc.rest.forCredentials(creds)
+	return &cf
+}
+
 func (cfc *localController) RegisterShutdown(sfn func()) func() {
 	id := uuid.New().String()
 	cfc.shutdownFns[id] = sfn
@@ -0,0 +1,118 @@
+package debug
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/mabels/cloudflared-controller/controller/rules"
+	"github.com/mabels/cloudflared-controller/controller/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// tunnelParam accepts the tunnel-name annotation syntax: name or namespace/name
+func tunnelParam(cfc types.CFController, tunnel string) (*types.CFTunnelParameter, error) {
+	ret := types.CFTunnelParameter{
+		Namespace: cfc.Cfg().CloudFlare.TunnelConfigMapNamespace,
+		Name:      strings.TrimSpace(tunnel),
+	}
+	parts := strings.Split(ret.Name, "/")
+	if len(parts) >= 2 {
+		ret.Namespace = parts[0]
+		ret.Name = parts[1]
+	}
+	if ret.Name == "" || ret.Namespace == "" {
+		return nil, fmt.Errorf("no usable tunnel name: %s", tunnel)
+	}
+	return &ret, nil
+}
+
+// Match merges the ConfigMap of the tunnel like buildConfig does and reports
+// the rule serving the url.
+func Match(cfc types.CFController, tunnel string, url string) (*rules.MatchReport, error) {
+	tparam, err := tunnelParam(cfc, tunnel)
+	if err != nil {
+		return nil, err
+	}
+	cmName := tparam.K8SConfigMapName()
+	cm, err := cfc.Rest().K8s().CoreV1().ConfigMaps(cmName.Namespace).Get(cfc.Context(), cmName.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	report, err := rules.Explain(rules.Build(cfc.Log(), cm), url)
+	if err != nil {
+		return nil, err
+	}
+	report.Tunnel = cmName.FQDN
+	return report, nil
+}
+
+func formatRule(ref rules.RuleRef) string {
+	return fmt.Sprintf("#%d key=%s hostname=%q path=%q service=%s",
+		ref.Index+1, ref.Key, ref.Rule.Hostname, ref.Rule.Path, ref.Rule.Service)
+}
+
+func WriteReport(out io.Writer, report *rules.MatchReport) {
+	fmt.Fprintf(out, "tunnel: %s\nurl: %s\n", report.Tunnel, report.URL)
+	if report.Match == nil {
+		fmt.Fprintf(out, "match: none\n")
+	} else {
+		fmt.Fprintf(out, "match: %s\n", formatRule(*report.Match))
+	}
+	fmt.Fprintf(out, "rules:\n")
+	for _, r := range report.Rules {
+		marker := " "
+		if report.Match != nil && report.Match.Index == r.Index {
+			marker = "*"
+		}
+		fmt.Fprintf(out, "%s %s\n", marker, formatRule(r))
+	}
+	if len(report.Shadowed) > 0 {
+		fmt.Fprintf(out, "shadowed:\n")
+		for _, s := range report.Shadowed {
+			fmt.Fprintf(out, "  %s\n    by %s\n", formatRule(s.RuleRef), formatRule(s.By))
+		}
+	}
+}
+
+// RunMatch implements the subcommand: match <tunnel> <url>
+func RunMatch(cfc types.CFController, args []string, out io.Writer) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: match <tunnel> <url>")
+	}
+	report, err := Match(cfc, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	WriteReport(out, report)
+	return nil
+}
+
+// matchHandler serves /debug/match?tunnel=<tunnel>&url=<url>
+func matchHandler(cfc types.CFController) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tunnel := r.URL.Query().Get("tunnel")
+		url := r.URL.Query().Get("url")
+		if tunnel == "" || url == "" {
+			http.Error(w, "tunnel and url parameters are required", http.StatusBadRequest)
+			return
+		}
+		report, err := Match(cfc, tunnel, url)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if strings.Contains(r.Header.Get("Accept"), "text/plain") {
+			w.Header().Set("Content-Type", "text/plain")
+			WriteReport(w, report)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(report)
+		if err != nil {
+			cfc.Log().Error().Err(err).Msg("error writing match report")
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package debug
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/mabels/cloudflared-controller/controller/types"
+)
+
+// Start serves the debug endpoints on --debug-addr, returns the stop function
+func Start(_cfc types.CFController) func() {
+	cfc := _cfc.WithComponent("debug")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/match", matchHandler(cfc))
+	srv := &http.Server{
+		Addr:              cfc.Cfg().DebugAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		cfc.Log().Info().Str("addr", srv.Addr).Msg("starting debug server")
+		err := srv.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			cfc.Log().Error().Err(err).Msg("debug server failed")
+		}
+	}()
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			cfc.Log().Error().Err(err).Msg("error stopping debug server")
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/mabels/cloudflared-controller/controller/types"
+	"github.com/rs/zerolog"
+	"k8s.io/client-go/transport"
+)
+
+func mutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// redactSecrets replaces the values of the fields which carry secrets like
+// the tunnel_secret of a created tunnel or tokens
+func redactSecrets(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			lower := strings.ToLower(key)
+			if strings.Contains(lower, "secret") || strings.Contains(lower, "token") || strings.Contains(lower, "password") {
+				v[key] = "[redacted]"
+				continue
+			}
+			v[key] = redactSecrets(field)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactSecrets(v[i])
+		}
+	}
+	return value
+}
+
+// planDetail is the request body as it is logged and kept for the summary,
+// a body which is not JSON is only counted
+func planDetail(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	var value interface{}
+	if json.Unmarshal(body, &value) != nil {
+		return fmt.Sprintf("%d bytes", len(body))
+	}
+	out, err := json.Marshal(redactSecrets(value))
+	if err != nil {
+		return fmt.Sprintf("%d bytes", len(body))
+	}
+	return string(out)
+}
+
+// planned answers a mutating Cloudflare request of the dry-run without
+// sending it. The result echoes the request with an id, so created objects
+// can be used by the following calls.
+func (t *cfTransport) planned(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	t.plan.Record(t.log, types.PlanEntry{
+		Target: "cloudflare",
+		Action: req.Method,
+		Object: req.URL.Path,
+		Detail: planDetail(body),
+	})
+	result := map[string]interface{}{}
+	if json.Unmarshal(body, &result) != nil || result == nil {
+		result = map[string]interface{}{}
+	}
+	if _, found := result["id"]; !found {
+		if req.Method == http.MethodPost {
+			result["id"] = uuid.New().String()
+		} else {
+			result["id"] = path.Base(req.URL.Path)
+		}
+	}
+	out, err := json.Marshal(map[string]interface{}{
+		"success":  true,
+		"errors":   []interface{}{},
+		"messages": []interface{}{},
+		"result":   result,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(out)),
+		ContentLength: int64(len(out)),
+		Request:       req,
+	}, nil
+}
+
+// k8sDryRun sends the mutating Kubernetes requests with dryRun=All, the
+// API server validates them but nothing is persisted. Leases are written,
+// leader election and connector placement depend on them.
+type k8sDryRun struct {
+	base http.RoundTripper
+	log  *zerolog.Logger
+	plan *types.Plan
+}
+
+func (k *k8sDryRun) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !mutating(req.Method) || strings.HasPrefix(req.URL.Path, "/apis/coordination.k8s.io/") {
+		return k.base.RoundTrip(req)
+	}
+	k.plan.Record(k.log, types.PlanEntry{
+		Target: "kubernetes",
+		Action: req.Method,
+		Object: req.URL.Path,
+	})
+	dry := req.Clone(req.Context())
+	query := dry.URL.Query()
+	query.Set("dryRun", "All")
+	dry.URL.RawQuery = query.Encode()
+	return k.base.RoundTrip(dry)
+}
+
+// K8sDryRun wraps the transport of the Kubernetes client for the dry-run
+func K8sDryRun(cfc types.CFController) transport.WrapperFunc {
+	log := cfc.Log().With().Str("component", "kubernetes-api").Logger()
+	return func(base http.RoundTripper) http.RoundTripper {
+		return &k8sDryRun{
+			base: base,
+			log:  &log,
+			plan: cfc.Plan(),
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/mabels/cloudflared-controller/controller/types"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCFTransportDryRun(t *testing.T) {
+	calls := 0
+	log := zerolog.Nop()
+	tr := newCFTransport(&log, &types.CFControllerCloudflareConfig{}, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		return stubResponse(http.StatusOK, nil), nil
+	}))
+	tr.plan = &types.Plan{}
+
+	req, _ := http.NewRequest(http.MethodGet, "https://api.cloudflare.com/client/v4/accounts/a/cfd_tunnel", nil)
+	_, err := tr.RoundTrip(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+
+	req, _ = http.NewRequest(http.MethodPost, "https://api.cloudflare.com/client/v4/accounts/a/cfd_tunnel", strings.NewReader(`{"name":"tunnel","tunnel_secret":"c2VjcmV0"}`))
+	resp, err := tr.RoundTrip(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+	body, _ := io.ReadAll(resp.Body)
+	out := struct {
+		Success bool
+		Result  map[string]string
+	}{}
+	assert.NoError(t, json.Unmarshal(body, &out))
+	assert.True(t, out.Success)
+	assert.Equal(t, "tunnel", out.Result["name"])
+	assert.NotEmpty(t, out.Result["id"])
+
+	req, _ = http.NewRequest(http.MethodDelete, "https://api.cloudflare.com/client/v4/accounts/a/cfd_tunnel/t1", nil)
+	resp, err = tr.RoundTrip(req)
+	assert.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	assert.NoError(t, json.Unmarshal(body, &out))
+	assert.Equal(t, "t1", out.Result["id"])
+
+	entries := tr.plan.Entries()
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "cloudflare", entries[0].Target)
+	assert.Equal(t, http.MethodPost, entries[0].Action)
+	assert.Equal(t, "/client/v4/accounts/a/cfd_tunnel", entries[0].Object)
+	// the secret of the tunnel is neither logged nor summarized
+	assert.Equal(t, `{"name":"tunnel","tunnel_secret":"[redacted]"}`, entries[0].Detail)
+	assert.Equal(t, http.MethodDelete, entries[1].Action)
+}
+
+func TestPlanDetail(t *testing.T) {
+	assert.Equal(t, "", planDetail(nil))
+	assert.Equal(t, "6 bytes", planDetail([]byte("name=a")))
+	assert.Equal(t, `{"config":{"ingress":[{"service":"http://a"}]},"token":"[redacted]"}`,
+		planDetail([]byte(`{"token":"t","config":{"ingress":[{"service":"http://a"}]}}`)))
+	assert.Equal(t, `[{"api_token":"[redacted]","name":"a"}]`, planDetail([]byte(`[{"name":"a","api_token":"t"}]`)))
+}
+
+func TestK8sDryRun(t *testing.T) {
+	queries := []string{}
+	log := zerolog.Nop()
+	plan := &types.Plan{}
+	k := &k8sDryRun{
+		base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			queries = append(queries, req.URL.RawQuery)
+			return stubResponse(http.StatusOK, nil), nil
+		}),
+		log:  &log,
+		plan: plan,
+	}
+	for _, r := range []struct{ method, url string }{
+		{http.MethodGet, "https://k8s/api/v1/namespaces/default/configmaps"},
+		{http.MethodPut, "https://k8s/api/v1/namespaces/default/configmaps/cm?fieldManager=x"},
+		{http.MethodPut, "https://k8s/apis/coordination.k8s.io/v1/namespaces/default/leases/leader"},
+	} {
+		req, _ := http.NewRequest(r.method, r.url, nil)
+		_, err := k.RoundTrip(req)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []string{"", "dryRun=All&fieldManager=x", ""}, queries)
+	assert.Len(t, plan.Entries(), 1)
+
+	sb := strings.Builder{}
+	plan.WriteSummary(&sb)
+	assert.Contains(t, sb.String(), "1 intercepted calls")
+	assert.Contains(t, sb.String(), "1 kubernetes PUT")
+}
@@ -25,6 +25,13 @@ func introSpectTunnelName(cfc types.CFController, ingress *netv1.Ingress, tparam
 	if !tNok && !tENok {
 		var tunnelName *string = nil
 		for _, rule := range ingress.Spec.Rules {
+			if strings.Contains(rule.Host, "*") && !isWildcardHost(rule.Host) {
+				err := fmt.Errorf("a wildcard is only allowed as first label")
+				cfc.Log().Error().Str("host", rule.Host).Err(err).Msg("")
+				return err
+			}
+			// the * of a wildcard is the first label, *.a.example.com and
+			// b.a.example.com guess the same tunnel a.example.com
 			split := strings.SplitN(rule.Host, ".", 2)
 			if tunnelName == nil && len(split) >= 2 && split[1] != "" {
 				tunnelName = &split[1]
@@ -48,11 +55,23 @@ func introSpectTunnelName(cfc types.CFController, ingress *netv1.Ingress, tparam
 	return nil
 }
 
-func findSchema(path netv1.HTTPIngressPath, ingress *netv1.Ingress) string {
-	return "http"
+// isWildcardHost is true for *.example.com
+func isWildcardHost(host string) bool {
+	return strings.HasPrefix(host, "*.") && !strings.Contains(host[1:], "*")
+}
+
+// defaultHostHeader is the host header of a rule without mapping, the
+// origin gets the requested host of a wildcard
+func defaultHostHeader(host string) *string {
+	if isWildcardHost(host) {
+		return nil
+	}
+	return &host
 }
 
-func findClassMapping(mapping []types.ClassIngressAnnotationMapping, rule netv1.IngressRule, path netv1.HTTPIngressPath) types.ClassIngressAnnotationMapping {
+// findClassMapping returns the tunnel-mapping of the path, without one the
+// detected schema is used
+func findClassMapping(mapping []types.ClassIngressAnnotationMapping, rule netv1.IngressRule, path netv1.HTTPIngressPath, schema string) types.ClassIngressAnnotationMapping {
 	for _, m := range mapping {
 		if m.Hostname == rule.Host && path.Path == m.Path {
 			return m
@@ -60,13 +79,34 @@ func findClassMapping(mapping []types.ClassIngressAnnotationMapping, rule netv1.
 	}
 	return types.ClassIngressAnnotationMapping{
 		Hostname:   rule.Host,
-		Schema:     "http",
-		HostHeader: &rule.Host,
+		Schema:     schema,
+		HostHeader: defaultHostHeader(rule.Host),
 		Path:       path.Path,
 	}
 }
 
-func classIngress(_cfc types.CFController, ev watch.Event, ingress *netv1.Ingress) {
+func tunnelKey(tparam *types.CFTunnelParameter) string {
+	return fmt.Sprintf("%s/%s", tparam.Namespace, tparam.Name)
+}
+
+// upsertTunnelRules writes to every tunnel only the rules of its hosts, a
+// tunnel without rules gets none to clear the rules it got before. The
+// tunnels the ingress no longer uses lose its rules.
+func upsertTunnelRules(cfc types.CFController, ingress *netv1.Ingress, tparams *k8s_data.UniqueTunnelParams, tunnelRules map[string][]types.CFConfigIngress) {
+	for _, tparam := range tparams.Get() {
+		cfcis, ok := tunnelRules[tunnelKey(tparam)]
+		if !ok {
+			cfcis = []types.CFConfigIngress{}
+		}
+		err := cfc.K8sData().TunnelConfigMaps.UpsertConfigMap(cfc, tparam, "ingress", &ingress.ObjectMeta, cfcis)
+		if err != nil {
+			cfc.Log().Error().Err(err).Msg("Failed to upsert configmap")
+		}
+	}
+	cfc.K8sData().TunnelConfigMaps.RemoveConfigMapExcept(cfc, "ingress", &ingress.ObjectMeta, tparams.Get())
+}
+
+func classIngress(_cfc types.CFController, ev watch.Event, ingress *netv1.Ingress, services serviceLookup) {
 	cfc := _cfc.WithComponent("classIngress", func(cfc types.CFController) {
 		log := cfc.Log().With().Str("ingress", ingress.Name).Logger()
 		cfc.SetLog(&log)
@@ -87,64 +127,84 @@ func classIngress(_cfc types.CFController, ev watch.Event, ingress *netv1.Ingres
 		annotationMapping = utils.ParseClassIngressMapping(cfc.Log(), _mapping)
 	}
 
-	cfcis := []types.CFConfigIngress{}
+	// the rules of each tunnel, key namespace/name of the tunnel
+	tunnelRules := map[string][]types.CFConfigIngress{}
 	mapping := []types.CFEndpointMapping{}
+	// hosts which already got the catch-all of the defaultBackend
+	defaultHosts := map[string]struct{}{}
 	for _, rule := range ingress.Spec.Rules {
-		if rule.HTTP == nil {
+		if rule.HTTP == nil && ingress.Spec.DefaultBackend == nil {
 			cfc.Log().Warn().Str("host", rule.Host).Msg("Skipping non-http ingress rule")
 			continue
 		}
-		_, err := tparams.GetConfigMapTunnelParam(cfc, &ingress.ObjectMeta, fmt.Sprintf("%s/%s", ingress.Namespace, rule.Host))
+		tparam, err := tparams.GetConfigMapTunnelParam(cfc, &ingress.ObjectMeta, fmt.Sprintf("%s/%s", ingress.Namespace, rule.Host))
 		if err != nil {
 			cfc.Log().Error().Err(err).Msg("Failed to find tunnel param")
 			continue
 		}
-		for _, path := range rule.HTTP.Paths {
+		tunnel := tunnelKey(tparam)
+		paths := []netv1.HTTPIngressPath{}
+		if rule.HTTP != nil {
+			paths = append(paths, rule.HTTP.Paths...)
+		}
+		// the defaultBackend is the catch-all of every host of the ingress,
+		// a rule without host would be the catch-all of the whole tunnel
+		if _, done := defaultHosts[rule.Host]; ingress.Spec.DefaultBackend != nil && rule.Host != "" && !done {
+			defaultHosts[rule.Host] = struct{}{}
+			paths = append(paths, netv1.HTTPIngressPath{Backend: *ingress.Spec.DefaultBackend})
+		}
+		for _, path := range paths {
+			if path.Backend.Service == nil {
+				cfc.Log().Warn().Str("host", rule.Host).Str("path", path.Path).Msg("Skipping non-service backend")
+				continue
+			}
 
-			amap := findClassMapping(annotationMapping, rule, path)
+			// like ingress-nginx the certificate of a detected https
+			// backend is not verified
+			proto := findSchema(ingress, services, path.Backend.Service)
+			schema := proto.Schema
+			if schema == "https" {
+				schema = "https-notlsverify"
+			}
+			amap := findClassMapping(annotationMapping, rule, path, schema)
 
 			notlsverify := false
 			if amap.Schema == "https-notlsverify" {
 				notlsverify = true
 				amap.Schema = "https"
 			}
-			port := ""
-			intPort := path.Backend.Service.Port.Number
-			if 0 < intPort && intPort < 0x10000 {
-				port = fmt.Sprintf(":%d", intPort)
-			} else {
-				cfc.Log().Warn().Msg(fmt.Sprintf("port by name(%v) or number(%v) not supported",
-					path.Backend.Service.Port.Name, path.Backend.Service.Port.Number))
+			intPort, err := backendPort(services, path.Backend.Service)
+			if err != nil {
+				cfc.Log().Warn().Err(err).Str("host", rule.Host).Str("path", path.Path).Msg("Skipping backend")
 				continue
 			}
+			port := fmt.Sprintf(":%d", intPort)
 			srvUrl := fmt.Sprintf("%s://%s.%s%s", amap.Schema, path.Backend.Service.Name, ingress.Namespace, port)
 			mapping = append(mapping, types.CFEndpointMapping{
 				External: rule.Host,
 				Internal: srvUrl,
 			})
 			hostheader := rule.Host
+			if isWildcardHost(rule.Host) {
+				hostheader = ""
+			}
 			if amap.HostHeader != nil {
 				hostheader = *amap.HostHeader
 			}
 			cci := types.CFConfigIngress{
 				Hostname: rule.Host,
-				Path:     path.Path,
+				Path:     pathRegex(ingress, path),
 				Service:  srvUrl,
 				OriginRequest: &types.CFConfigOriginRequest{
 					HttpHostHeader: hostheader,
 					NoTLSVerify:    notlsverify,
+					Http2Origin:    proto.Http2Origin && amap.Schema == "https",
 				},
 			}
-			cfcis = append(cfcis, cci)
-		}
-	}
-	// remove duplicates
-	for _, tparam := range tparams.Get() {
-		err := cfc.K8sData().TunnelConfigMaps.UpsertConfigMap(cfc, tparam, "ingress", &ingress.ObjectMeta, cfcis)
-		if err != nil {
-			cfc.Log().Error().Err(err).Msg("Failed to upsert configmap")
+			tunnelRules[tunnel] = append(tunnelRules[tunnel], cci)
 		}
 	}
+	upsertTunnelRules(cfc, ingress, tparams, tunnelRules)
 	cfc.Log().Info().Any("mapping", mapping).Msg("Wrote cloudflared config")
 	return
 }
@@ -221,6 +281,11 @@ func stackedIngress(_cfc types.CFController, ev watch.Event, ingress *netv1.Ingr
 			cfc.Log().Warn().Str("name", tparam.Name).Str("host", rule.Host).Msg("Skipping non-http ingress rule")
 			continue
 		}
+		// the host of a stacked ingress is the origin, a wildcard can't be dialed
+		if strings.Contains(rule.Host, "*") {
+			cfc.Log().Warn().Str("name", tparam.Name).Str("host", rule.Host).Msg("Skipping wildcard origin of stacked ingress")
+			continue
+		}
 
 		// _port, ok := annotations[config.AnnotationCloudflareTunnelPort()]
 		// if ok {
@@ -251,7 +316,7 @@ func stackedIngress(_cfc types.CFController, ev watch.Event, ingress *netv1.Ingr
 			}
 			cci := types.CFConfigIngress{
 				Hostname: amap.ExtHostName,
-				Path:     path.Path,
+				Path:     pathRegex(ingress, path),
 				Service:  svcUrl,
 				OriginRequest: &types.CFConfigOriginRequest{
 					HttpHostHeader: hostHeader,
@@ -287,9 +352,22 @@ func stackedIngress(_cfc types.CFController, ev watch.Event, ingress *netv1.Ingr
 // }
 
 type watcherBindingIngresses struct {
-	watcher         types.Watcher[*netv1.Ingress]
-	unregisterEvent func()
-	namespace       string
+	watcher            types.Watcher[*netv1.Ingress]
+	unregisterEvent    func()
+	services           types.Watcher[*corev1.Service]
+	unregisterServices func()
+	namespace          string
+}
+
+func (wbi watcherBindingIngresses) serviceLookup() serviceLookup {
+	return watcherServiceLookup(wbi.services)
+}
+
+func (wbi watcherBindingIngresses) stop() {
+	wbi.unregisterEvent()
+	wbi.watcher.Stop()
+	wbi.unregisterServices()
+	wbi.services.Stop()
 }
 
 type ingresses struct {
@@ -297,7 +375,7 @@ type ingresses struct {
 	items map[string]watcherBindingIngresses
 }
 
-func startIngressWatcher(_cfc types.CFController, ns string) (watcherBindingIngresses, error) {
+func startIngressWatcher(_cfc types.CFController, ns string, classes *ingressClasses) (watcherBindingIngresses, error) {
 	cfc := _cfc.WithComponent("ingress", func(cfc types.CFController) {
 		log := cfc.Log().With().Str("namespace", ns).Logger()
 		cfc.SetLog(&log)
@@ -310,46 +388,66 @@ func startIngressWatcher(_cfc types.CFController, ns string) (watcherBindingIngr
 				Cif: cfc.Rest().K8s().NetworkingV1().Ingresses(ns),
 			},
 		})
+	// the services are watched first to resolve the named ports of the
+	// ingresses, a changed service reconciles its ingresses again
+	var services serviceLookup
+	svcs, unregSvcs, err := startServiceWatcher(cfc, ns, func(name string) {
+		for _, ingress := range wt.GetState() {
+			if referencesService(ingress, name) {
+				handleIngress(watch.Event{Type: watch.Modified, Object: ingress}, ingress, cfc, classes, services)
+			}
+		}
+	})
+	if err != nil {
+		return watcherBindingIngresses{}, err
+	}
+	services = watcherServiceLookup(svcs)
 	unreg := wt.RegisterEvent(func(_ []*netv1.Ingress, ev watch.Event) {
 		ingress, ok := ev.Object.(*netv1.Ingress)
 		if !ok {
 			cfc.Log().Error().Any("ev", ev).Msg("Failed to cast to Ingress")
 			return
 		}
-
-		annotations := ingress.GetAnnotations()
-		_, foundCTN := annotations[config.AnnotationCloudflareTunnelName()]
-		// _, foundCID := annotations[config.AnnotationCloudflareTunnelId]
-		if !foundCTN {
-			cfc.Log().Debug().Str("uid", string(ingress.GetUID())).Str("name", ingress.Name).
-				Msgf("skipping not cloudflared annotated(%s)", config.AnnotationCloudflareTunnelName())
-			cfc.K8sData().TunnelConfigMaps.RemoveConfigMap(cfc, "ingress", &ingress.ObjectMeta)
-			return
-		}
-		processEvent(ev, ingress, cfc)
+		handleIngress(ev, ingress, cfc, classes, services)
 	})
-	err := wt.Start()
+	err = wt.Start()
+	if err != nil {
+		unregSvcs()
+		svcs.Stop()
+	}
 	cfc.Log().Info().Msg("Started watcher")
 	return watcherBindingIngresses{
-		watcher:         wt,
-		unregisterEvent: unreg,
-		namespace:       ns,
+		watcher:            wt,
+		unregisterEvent:    unreg,
+		services:           svcs,
+		unregisterServices: unregSvcs,
+		namespace:          ns,
 	}, err
 }
 
-func processEvent(ev watch.Event, ingress *netv1.Ingress, cfc types.CFController) {
+// handleIngress skips the ingresses which are neither of our class nor annotated
+func handleIngress(ev watch.Event, ingress *netv1.Ingress, cfc types.CFController, classes *ingressClasses, services serviceLookup) {
+	_, foundCTN := ingress.GetAnnotations()[config.AnnotationCloudflareTunnelName()]
+	// _, foundCID := annotations[config.AnnotationCloudflareTunnelId]
+	if _, ours := classes.lookup(ingress); !ours && !foundCTN {
+		cfc.Log().Debug().Str("uid", string(ingress.GetUID())).Str("name", ingress.Name).
+			Msgf("skipping not cloudflared annotated(%s)", config.AnnotationCloudflareTunnelName())
+		cfc.K8sData().TunnelConfigMaps.RemoveConfigMap(cfc, "ingress", &ingress.ObjectMeta)
+		syncStatus(cfc, ingress, false)
+		return
+	}
+	processEvent(ev, ingress, cfc, classes, services)
+}
+
+func processEvent(ev watch.Event, ingress *netv1.Ingress, cfc types.CFController, classes *ingressClasses, services serviceLookup) {
 	switch ev.Type {
-	case watch.Added:
-		if ingress.Spec.IngressClassName != nil && *ingress.Spec.IngressClassName == "cloudflared" {
-			classIngress(cfc, ev, ingress)
-		} else {
-			stackedIngress(cfc, ev, ingress)
-		}
-	case watch.Modified:
-		if ingress.Spec.IngressClassName != nil && *ingress.Spec.IngressClassName == "cloudflared" {
-			classIngress(cfc, ev, ingress)
+	case watch.Added, watch.Modified:
+		if ic, ok := classes.lookup(ingress); ok {
+			classIngress(cfc, ev, ic.apply(ingress), services)
+			syncStatus(cfc, ingress, true)
 		} else {
 			stackedIngress(cfc, ev, ingress)
+			syncStatus(cfc, ingress, false)
 		}
 	case watch.Deleted:
 		// o := ev.Object.(*metav1.ObjectMeta)
@@ -360,11 +458,57 @@ func processEvent(ev watch.Event, ingress *netv1.Ingress, cfc types.CFController
 	}
 }
 
+// startIngressClassWatcher keeps classes in sync with the IngressClasses of the
+// cluster and reprocesses all ingresses if they change
+func startIngressClassWatcher(cfc types.CFController, classes *ingressClasses, igs *ingresses) (types.Watcher[*netv1.IngressClass], func(), error) {
+	wt := watcher.NewWatcher(
+		types.WatcherConfig[netv1.IngressClass, *netv1.IngressClass, types.WatcherBindingIngressClass, types.WatcherBindingIngressClassClient]{
+			Log:     cfc.Log(),
+			Context: cfc.Context(),
+			K8sClient: types.WatcherBindingIngressClassClient{
+				Cif: cfc.Rest().K8s().NetworkingV1().IngressClasses(),
+			},
+		})
+	err := wt.Start()
+	if err != nil {
+		return wt, func() {}, err
+	}
+	classes.update(cfc, wt.GetState())
+	unreg := wt.RegisterEvent(func(state []*netv1.IngressClass, ev watch.Event) {
+		classes.update(cfc, state)
+		igs.lock.Lock()
+		defer igs.lock.Unlock()
+		for _, v := range igs.items {
+			for _, ingress := range v.watcher.GetState() {
+				handleIngress(watch.Event{Type: watch.Modified, Object: ingress}, ingress, cfc, classes, v.serviceLookup())
+			}
+		}
+	})
+	return wt, unreg, nil
+}
+
 func Start(_cfc types.CFController) func() {
 	cfc := _cfc.WithComponent("ingress")
 	igs := &ingresses{
 		items: make(map[string]watcherBindingIngresses),
 	}
+	classes := newIngressClasses()
+	classWatcher, unregClasses, err := startIngressClassWatcher(cfc, classes, igs)
+	if err != nil {
+		cfc.Log().Error().Err(err).Msg("Failed to start ingressclass watcher")
+	}
+	// the status follows the tunnel id of the tunnel ConfigMaps
+	unregStatus := cfc.K8sData().TunnelConfigMaps.Register(func(cms []*corev1.ConfigMap, ev watch.Event) {
+		igs.lock.Lock()
+		defer igs.lock.Unlock()
+		for _, v := range igs.items {
+			for _, ingress := range v.watcher.GetState() {
+				if _, ours := classes.lookup(ingress); ours {
+					syncStatus(cfc, ingress, true)
+				}
+			}
+		}
+	})
 	unreg := cfc.K8sData().Namespaces.RegisterEvent(func(_ []*corev1.Namespace, ev watch.Event) {
 		cfc.Log().Debug().Any("ev", ev).Msg("Got event")
 		ns, ok := ev.Object.(*corev1.Namespace)
@@ -380,7 +524,7 @@ func Start(_cfc types.CFController) func() {
 		switch ev.Type {
 		case watch.Added:
 			if _, ok := igs.items[ns.Name]; !ok {
-				wif, err := startIngressWatcher(cfc, ns.Name)
+				wif, err := startIngressWatcher(cfc, ns.Name, classes)
 				if err != nil {
 					cfc.Log().Error().Err(err).Msg("Failed to start ingress watcher")
 					return
@@ -392,8 +536,7 @@ func Start(_cfc types.CFController) func() {
 			my, ok := igs.items[ns.Name]
 			if !ok {
 				delete(igs.items, ns.Name)
-				my.unregisterEvent()
-				my.watcher.Stop()
+				my.stop()
 			}
 		default:
 			cfc.Log().Error().Msgf("Unknown event type: %s", ev.Type)
@@ -404,10 +547,12 @@ func Start(_cfc types.CFController) func() {
 		igs.lock.Lock()
 		defer igs.lock.Unlock()
 		for _, v := range igs.items {
-			v.unregisterEvent()
-			v.watcher.Stop()
+			v.stop()
 		}
 		unreg()
+		unregStatus()
+		unregClasses()
+		classWatcher.Stop()
 	}
 
 }
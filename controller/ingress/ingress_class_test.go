@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/mabels/cloudflared-controller/controller/config"
+	"github.com/mabels/cloudflared-controller/controller/k8s_data"
 	"github.com/mabels/cloudflared-controller/controller/types"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
@@ -104,7 +105,7 @@ func setupIngress() (*mockController, *net1.Ingress, watch.Event) {
 func TestIngressClassIntrospectTunnelNameHttpClass(t *testing.T) {
 	cf, ingress, ev := setupIngress()
 
-	processEvent(ev, ingress, cf)
+	processEvent(ev, ingress, cf, newIngressClasses(), nil)
 
 	assert.Len(t, cf.tunnelConfigMaps.upsertCalls, 1)
 	assert.Equal(t, cf.tunnelConfigMaps.upsertCalls[0].tparam.Namespace, "what")
@@ -113,7 +114,7 @@ func TestIngressClassIntrospectTunnelNameHttpClass(t *testing.T) {
 	assert.Equal(t, cf.tunnelConfigMaps.upsertCalls[0].cfcis, []types.CFConfigIngress{
 		{
 			Hostname: "xxx.what.tech",
-			Path:     "/wurst",
+			Path:     "^/wurst(/|$)",
 			Service:  "http://svc-wurst-xxx-what-tech.what:4711",
 			OriginRequest: &types.CFConfigOriginRequest{
 				NoTLSVerify:    false,
@@ -122,7 +123,7 @@ func TestIngressClassIntrospectTunnelNameHttpClass(t *testing.T) {
 		},
 		{
 			Hostname: "xxx.what.tech",
-			Path:     "/",
+			Path:     "^/",
 			Service:  "http://svc-471-xxx-what-tech.what:471",
 			OriginRequest: &types.CFConfigOriginRequest{
 				NoTLSVerify:    false,
@@ -131,7 +132,7 @@ func TestIngressClassIntrospectTunnelNameHttpClass(t *testing.T) {
 		},
 		{
 			Hostname: "yyy.what.tech",
-			Path:     "/",
+			Path:     "^/",
 			Service:  "http://svc-yyy-wurst-what-tech.what:499",
 			OriginRequest: &types.CFConfigOriginRequest{
 				NoTLSVerify:    false,
@@ -150,14 +151,14 @@ func TestIngressClassIntrospectMappingHttpClass(t *testing.T) {
 			xxx.what.tech/https-notlsverify/max.lust,
 			yyy.what.tech/https`,
 	}
-	processEvent(ev, ingress, cf)
+	processEvent(ev, ingress, cf, newIngressClasses(), nil)
 
 	assert.Len(t, cf.tunnelConfigMaps.upsertCalls, 1)
 	assert.Len(t, cf.tunnelConfigMaps.upsertCalls[0].cfcis, 3)
 	assert.Equal(t, cf.tunnelConfigMaps.upsertCalls[0].cfcis, []types.CFConfigIngress{
 		{
 			Hostname: "xxx.what.tech",
-			Path:     "/wurst",
+			Path:     "^/wurst(/|$)",
 			Service:  "https://svc-wurst-xxx-what-tech.what:4711",
 			OriginRequest: &types.CFConfigOriginRequest{
 				NoTLSVerify:    false,
@@ -166,7 +167,7 @@ func TestIngressClassIntrospectMappingHttpClass(t *testing.T) {
 		},
 		{
 			Hostname: "xxx.what.tech",
-			Path:     "/",
+			Path:     "^/",
 			Service:  "https://svc-471-xxx-what-tech.what:471",
 			OriginRequest: &types.CFConfigOriginRequest{
 				NoTLSVerify:    true,
@@ -175,7 +176,7 @@ func TestIngressClassIntrospectMappingHttpClass(t *testing.T) {
 		},
 		{
 			Hostname: "yyy.what.tech",
-			Path:     "/",
+			Path:     "^/",
 			Service:  "https://svc-yyy-wurst-what-tech.what:499",
 			OriginRequest: &types.CFConfigOriginRequest{
 				NoTLSVerify:    false,
@@ -192,9 +193,221 @@ func TestIngressClassHttpClass(t *testing.T) {
 		config.AnnotationCloudflareTunnelName(): "murks/hello",
 	}
 
-	processEvent(ev, ingress, cf)
+	processEvent(ev, ingress, cf, newIngressClasses(), nil)
 
 	assert.Len(t, cf.tunnelConfigMaps.upsertCalls, 1)
 	assert.Equal(t, cf.tunnelConfigMaps.upsertCalls[0].tparam.Namespace, "murks")
 	assert.Equal(t, cf.tunnelConfigMaps.upsertCalls[0].tparam.Name, "hello")
 }
+
+func TestIngressClassParametersDefaults(t *testing.T) {
+	cf, ingress, ev := setupIngress()
+	className := "cf-public"
+	ingress.Spec.IngressClassName = &className
+	classes := newIngressClasses()
+	classes.items[className] = &ingressClass{
+		name: className,
+		defaults: classDefaults(map[string]string{
+			"tunnel-name": "murks/public",
+		}),
+	}
+
+	processEvent(ev, ingress, cf, classes, nil)
+
+	assert.Len(t, cf.tunnelConfigMaps.upsertCalls, 1)
+	assert.Equal(t, cf.tunnelConfigMaps.upsertCalls[0].tparam.Namespace, "murks")
+	assert.Equal(t, cf.tunnelConfigMaps.upsertCalls[0].tparam.Name, "public")
+	// the ingress itself is not changed
+	assert.Empty(t, ingress.Annotations)
+}
+
+func TestIngressClassAnnotationOverridesDefaults(t *testing.T) {
+	cf, ingress, ev := setupIngress()
+	className := "cf-public"
+	ingress.Spec.IngressClassName = &className
+	ingress.Annotations = map[string]string{
+		config.AnnotationCloudflareTunnelName(): "murks/hello",
+	}
+	classes := newIngressClasses()
+	classes.items[className] = &ingressClass{
+		name:     className,
+		defaults: classDefaults(map[string]string{"tunnel-name": "murks/public"}),
+	}
+
+	processEvent(ev, ingress, cf, classes, nil)
+
+	assert.Len(t, cf.tunnelConfigMaps.upsertCalls, 1)
+	assert.Equal(t, cf.tunnelConfigMaps.upsertCalls[0].tparam.Name, "hello")
+}
+
+func TestIngressClassDefaultClass(t *testing.T) {
+	_, ingress, _ := setupIngress()
+	ingress.Spec.IngressClassName = nil
+	classes := newIngressClasses()
+
+	_, ok := classes.lookup(ingress)
+	assert.False(t, ok)
+
+	classes.items["cf-private"] = &ingressClass{name: "cf-private"}
+	classes.items["cf-public"] = &ingressClass{name: "cf-public", isDefault: true}
+	ic, ok := classes.lookup(ingress)
+	assert.True(t, ok)
+	assert.Equal(t, "cf-public", ic.name)
+
+	nginx := "nginx"
+	ingress.Spec.IngressClassName = &nginx
+	_, ok = classes.lookup(ingress)
+	assert.False(t, ok)
+
+	legacy := legacyIngressClassName
+	ingress.Spec.IngressClassName = &legacy
+	_, ok = classes.lookup(ingress)
+	assert.True(t, ok)
+}
+
+func TestIngressClassDefaultsKeys(t *testing.T) {
+	assert.Equal(t, map[string]string{
+		config.AnnotationCloudflareTunnelName(): "murks/public",
+		"example.com/other":                     "x",
+	}, classDefaults(map[string]string{
+		"tunnel-name":       "murks/public",
+		"example.com/other": "x",
+	}))
+}
+
+func TestIngressClassDefaultBackend(t *testing.T) {
+	cf, ingress, ev := setupIngress()
+	ingress.Spec.DefaultBackend = &net1.IngressBackend{
+		Service: &net1.IngressServiceBackend{
+			Name: "errors",
+			Port: net1.ServiceBackendPort{Number: 8080},
+		},
+	}
+	ingress.Spec.Rules = append(ingress.Spec.Rules, net1.IngressRule{Host: "zzz.what.tech"})
+
+	processEvent(ev, ingress, cf, newIngressClasses(), nil)
+
+	assert.Len(t, cf.tunnelConfigMaps.upsertCalls, 1)
+	catchAlls := []types.CFConfigIngress{}
+	for _, cfci := range cf.tunnelConfigMaps.upsertCalls[0].cfcis {
+		if cfci.Path == "" {
+			catchAlls = append(catchAlls, cfci)
+		}
+	}
+	assert.Equal(t, []types.CFConfigIngress{
+		{
+			Hostname: "xxx.what.tech",
+			Service:  "http://errors.what:8080",
+			OriginRequest: &types.CFConfigOriginRequest{
+				HttpHostHeader: "xxx.what.tech",
+			},
+		},
+		{
+			Hostname: "yyy.what.tech",
+			Service:  "http://errors.what:8080",
+			OriginRequest: &types.CFConfigOriginRequest{
+				HttpHostHeader: "yyy.what.tech",
+			},
+		},
+		{
+			Hostname: "zzz.what.tech",
+			Service:  "http://errors.what:8080",
+			OriginRequest: &types.CFConfigOriginRequest{
+				HttpHostHeader: "zzz.what.tech",
+			},
+		},
+	}, catchAlls)
+}
+
+func TestIngressClassWildcardHost(t *testing.T) {
+	cf, ingress, ev := setupIngress()
+	ingress.Spec.Rules = []net1.IngressRule{
+		{
+			Host: "*.preview.what.tech",
+			IngressRuleValue: net1.IngressRuleValue{
+				HTTP: &net1.HTTPIngressRuleValue{
+					Paths: []net1.HTTPIngressPath{
+						{
+							Backend: net1.IngressBackend{
+								Service: &net1.IngressServiceBackend{
+									Name: "preview",
+									Port: net1.ServiceBackendPort{Number: 80},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			Host:             "a.preview.what.tech",
+			IngressRuleValue: ingress.Spec.Rules[1].IngressRuleValue,
+		},
+	}
+
+	processEvent(ev, ingress, cf, newIngressClasses(), nil)
+
+	assert.Len(t, cf.tunnelConfigMaps.upsertCalls, 1)
+	assert.Equal(t, "preview.what.tech", cf.tunnelConfigMaps.upsertCalls[0].tparam.Name)
+	cfcis := cf.tunnelConfigMaps.upsertCalls[0].cfcis
+	assert.Len(t, cfcis, 2)
+	assert.Equal(t, types.CFConfigIngress{
+		Hostname: "*.preview.what.tech",
+		Service:  "http://preview.what:80",
+		// the origin gets the requested host
+		OriginRequest: &types.CFConfigOriginRequest{},
+	}, cfcis[0])
+	assert.Equal(t, "a.preview.what.tech", cfcis[1].OriginRequest.HttpHostHeader)
+}
+
+func TestIngressClassMisplacedWildcard(t *testing.T) {
+	cf, ingress, ev := setupIngress()
+	ingress.Spec.Rules[0].Host = "xxx.*.what.tech"
+
+	processEvent(ev, ingress, cf, newIngressClasses(), nil)
+
+	assert.Empty(t, cf.tunnelConfigMaps.upsertCalls)
+}
+
+func TestUpsertTunnelRulesPerTunnel(t *testing.T) {
+	cf, ingress, _ := setupIngress()
+	tparams := k8s_data.NewUniqueTunnelParams()
+	one := &types.CFTunnelParameter{Namespace: "what", Name: "one.tech"}
+	two := &types.CFTunnelParameter{Namespace: "what", Name: "two.tech"}
+	empty := &types.CFTunnelParameter{Namespace: "what", Name: "empty.tech"}
+	tparams.Add(tunnelKey(one), one)
+	tparams.Add(tunnelKey(two), two)
+	tparams.Add(tunnelKey(empty), empty)
+
+	upsertTunnelRules(cf, ingress, tparams, map[string][]types.CFConfigIngress{
+		tunnelKey(one): {{Hostname: "a.one.tech", Service: "http://a.what:80"}},
+		tunnelKey(two): {{Hostname: "b.two.tech", Service: "http://b.what:80"}},
+	})
+
+	assert.Len(t, cf.tunnelConfigMaps.upsertCalls, 3)
+	byTunnel := map[string][]types.CFConfigIngress{}
+	for _, call := range cf.tunnelConfigMaps.upsertCalls {
+		byTunnel[call.tparam.Name] = call.cfcis
+	}
+	assert.Equal(t, []types.CFConfigIngress{{Hostname: "a.one.tech", Service: "http://a.what:80"}}, byTunnel["one.tech"])
+	assert.Equal(t, []types.CFConfigIngress{{Hostname: "b.two.tech", Service: "http://b.what:80"}}, byTunnel["two.tech"])
+	assert.Equal(t, []types.CFConfigIngress{}, byTunnel["empty.tech"])
+}
+
+func TestIngressClassMovesTunnel(t *testing.T) {
+	cf, ingress, ev := setupIngress()
+	ingress.Annotations = map[string]string{
+		config.AnnotationCloudflareTunnelName(): "murks/one",
+	}
+	processEvent(ev, ingress, cf, newIngressClasses(), nil)
+	// all hosts move to another tunnel, the first one loses the rules
+	ingress.Annotations[config.AnnotationCloudflareTunnelName()] = "murks/two"
+	processEvent(watch.Event{Type: watch.Modified}, ingress, cf, newIngressClasses(), nil)
+
+	assert.Len(t, cf.tunnelConfigMaps.upsertCalls, 2)
+	assert.Equal(t, "two", cf.tunnelConfigMaps.upsertCalls[1].tparam.Name)
+	assert.Len(t, cf.tunnelConfigMaps.keepCalls, 2)
+	keep := cf.tunnelConfigMaps.keepCalls[1]
+	assert.Len(t, keep, 1)
+	assert.Equal(t, "two", keep[0].Name)
+}
@@ -0,0 +1,146 @@
+package ingress
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mabels/cloudflared-controller/controller/config"
+	"github.com/mabels/cloudflared-controller/controller/types"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// legacyIngressClassName is served without an IngressClass object
+const legacyIngressClassName = "cloudflared"
+
+// the annotation which marks the default IngressClass of the cluster
+const defaultIngressClassAnnotation = "ingressclass.kubernetes.io/is-default-class"
+
+// ingressClass is an IngressClass served by this controller
+type ingressClass struct {
+	name      string
+	isDefault bool
+	// annotations of the parameters ConfigMap, applied to the Ingresses
+	// of this class which do not set them
+	defaults map[string]string
+}
+
+type ingressClasses struct {
+	lock  sync.RWMutex
+	items map[string]*ingressClass
+}
+
+func newIngressClasses() *ingressClasses {
+	return &ingressClasses{
+		items: make(map[string]*ingressClass),
+	}
+}
+
+// classDefaults turns the keys of the parameters ConfigMap into annotations,
+// a key without prefix like tunnel-name is taken as cloudflare.com/tunnel-name
+func classDefaults(data map[string]string) map[string]string {
+	ret := make(map[string]string, len(data))
+	for k, v := range data {
+		if !strings.Contains(k, "/") {
+			k = fmt.Sprintf("%s/%s", config.AnnotationsPrefix, k)
+		}
+		ret[k] = v
+	}
+	return ret
+}
+
+func parametersDefaults(cfc types.CFController, ic *netv1.IngressClass) (map[string]string, error) {
+	params := ic.Spec.Parameters
+	if params == nil {
+		return map[string]string{}, nil
+	}
+	if (params.APIGroup != nil && *params.APIGroup != "") || params.Kind != "ConfigMap" {
+		return nil, fmt.Errorf("unsupported parameters kind %s, only ConfigMap", params.Kind)
+	}
+	ns := cfc.Cfg().CloudFlare.TunnelConfigMapNamespace
+	if params.Namespace != nil && *params.Namespace != "" {
+		ns = *params.Namespace
+	}
+	cm, err := cfc.Rest().K8s().CoreV1().ConfigMaps(ns).Get(cfc.Context(), params.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return classDefaults(cm.Data), nil
+}
+
+// update replaces the served classes with the IngressClasses of our controller,
+// a class whose parameters can not be read keeps its previous defaults
+func (ics *ingressClasses) update(cfc types.CFController, classes []*netv1.IngressClass) {
+	items := make(map[string]*ingressClass)
+	for _, ic := range classes {
+		if ic.Spec.Controller != cfc.Cfg().IngressClass.Controller {
+			continue
+		}
+		defaults, err := parametersDefaults(cfc, ic)
+		if err != nil {
+			cfc.Log().Error().Err(err).Str("ingressClass", ic.Name).Msg("Failed to read IngressClass parameters")
+			ics.lock.RLock()
+			prev, ok := ics.items[ic.Name]
+			ics.lock.RUnlock()
+			if ok {
+				defaults = prev.defaults
+			}
+		}
+		items[ic.Name] = &ingressClass{
+			name:      ic.Name,
+			isDefault: ic.Annotations[defaultIngressClassAnnotation] == "true",
+			defaults:  defaults,
+		}
+	}
+	ics.lock.Lock()
+	defer ics.lock.Unlock()
+	ics.items = items
+}
+
+// lookup returns the class of the ingress if it is served by us, an Ingress
+// without class is ours if one of our classes is the default class
+func (ics *ingressClasses) lookup(ingress *netv1.Ingress) (*ingressClass, bool) {
+	ics.lock.RLock()
+	defer ics.lock.RUnlock()
+	if ingress.Spec.IngressClassName != nil {
+		name := *ingress.Spec.IngressClassName
+		if ic, ok := ics.items[name]; ok {
+			return ic, true
+		}
+		if name == legacyIngressClassName {
+			return &ingressClass{name: name}, true
+		}
+		return nil, false
+	}
+	names := make([]string, 0, len(ics.items))
+	for name, ic := range ics.items {
+		if ic.isDefault {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, false
+	}
+	// more than one default is a misconfiguration, stay deterministic
+	sort.Strings(names)
+	return ics.items[names[0]], true
+}
+
+// apply returns the ingress with the defaults of the class for the missing annotations
+func (ic *ingressClass) apply(ingress *netv1.Ingress) *netv1.Ingress {
+	if len(ic.defaults) == 0 {
+		return ingress
+	}
+	ret := ingress.DeepCopy()
+	if ret.Annotations == nil {
+		ret.Annotations = map[string]string{}
+	}
+	for k, v := range ic.defaults {
+		if _, ok := ret.Annotations[k]; !ok {
+			ret.Annotations[k] = v
+		}
+	}
+	return ret
+}
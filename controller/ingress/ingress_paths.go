@@ -0,0 +1,39 @@
+package ingress
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/mabels/cloudflared-controller/controller/config"
+	netv1 "k8s.io/api/networking/v1"
+)
+
+// pathRegex translates the path of an ingress into the path regex of
+// cloudflared. Exact matches the whole path, Prefix matches the path and
+// everything below it by path segment. ImplementationSpecific is a Prefix
+// unless the ingress is annotated with path-regex, then the path is taken as
+// regex. The empty path matches everything.
+func pathRegex(ingress *netv1.Ingress, path netv1.HTTPIngressPath) string {
+	if path.Path == "" {
+		return ""
+	}
+	pathType := netv1.PathTypeImplementationSpecific
+	if path.PathType != nil {
+		pathType = *path.PathType
+	}
+	switch pathType {
+	case netv1.PathTypeExact:
+		return fmt.Sprintf("^%s$", regexp.QuoteMeta(path.Path))
+	case netv1.PathTypeImplementationSpecific:
+		if ingress.Annotations[config.AnnotationCloudflarePathRegex()] == "true" {
+			return path.Path
+		}
+	}
+	// a trailing slash of a prefix is ignored, /api/ matches /api
+	prefix := strings.TrimRight(path.Path, "/")
+	if prefix == "" {
+		return "^/"
+	}
+	return fmt.Sprintf("^%s(/|$)", regexp.QuoteMeta(prefix))
+}
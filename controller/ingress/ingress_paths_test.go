@@ -0,0 +1,70 @@
+package ingress
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/mabels/cloudflared-controller/controller/config"
+	"github.com/stretchr/testify/assert"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func typedPath(path string, pathType netv1.PathType) netv1.HTTPIngressPath {
+	return netv1.HTTPIngressPath{Path: path, PathType: &pathType}
+}
+
+func assertMatches(t *testing.T, re string, matches []string, notMatches []string) {
+	r := regexp.MustCompile(re)
+	for _, m := range matches {
+		assert.True(t, r.MatchString(m), "%s should match %s", re, m)
+	}
+	for _, m := range notMatches {
+		assert.False(t, r.MatchString(m), "%s should not match %s", re, m)
+	}
+}
+
+func TestPathRegexExact(t *testing.T) {
+	ingress := &netv1.Ingress{}
+	re := pathRegex(ingress, typedPath("/api", netv1.PathTypeExact))
+	assert.Equal(t, `^/api$`, re)
+	assertMatches(t, re, []string{"/api"}, []string{"/api/", "/apiary", "/v1/api"})
+
+	re = pathRegex(ingress, typedPath("/v1.0/a+b", netv1.PathTypeExact))
+	assert.Equal(t, `^/v1\.0/a\+b$`, re)
+	assertMatches(t, re, []string{"/v1.0/a+b"}, []string{"/v1x0/aab"})
+}
+
+func TestPathRegexPrefix(t *testing.T) {
+	ingress := &netv1.Ingress{}
+	re := pathRegex(ingress, typedPath("/api", netv1.PathTypePrefix))
+	assert.Equal(t, `^/api(/|$)`, re)
+	assertMatches(t, re, []string{"/api", "/api/", "/api/v1"}, []string{"/apiary", "/v1/api"})
+
+	// the trailing slash is ignored
+	assert.Equal(t, re, pathRegex(ingress, typedPath("/api/", netv1.PathTypePrefix)))
+
+	re = pathRegex(ingress, typedPath("/", netv1.PathTypePrefix))
+	assert.Equal(t, `^/`, re)
+	assertMatches(t, re, []string{"/", "/api"}, []string{})
+
+	re = pathRegex(ingress, typedPath("/c++", netv1.PathTypePrefix))
+	assertMatches(t, re, []string{"/c++", "/c++/x"}, []string{"/cc"})
+}
+
+func TestPathRegexImplementationSpecific(t *testing.T) {
+	ingress := &netv1.Ingress{}
+	assert.Equal(t, `^/api(/|$)`, pathRegex(ingress, typedPath("/api", netv1.PathTypeImplementationSpecific)))
+	// without pathType
+	assert.Equal(t, `^/api(/|$)`, pathRegex(ingress, netv1.HTTPIngressPath{Path: "/api"}))
+	assert.Equal(t, "", pathRegex(ingress, netv1.HTTPIngressPath{}))
+
+	ingress.ObjectMeta = metav1.ObjectMeta{
+		Annotations: map[string]string{
+			config.AnnotationCloudflarePathRegex(): "true",
+		},
+	}
+	assert.Equal(t, `\.(png|jpg)$`, pathRegex(ingress, typedPath(`\.(png|jpg)$`, netv1.PathTypeImplementationSpecific)))
+	// Exact and Prefix keep their meaning
+	assert.Equal(t, `^/api$`, pathRegex(ingress, typedPath("/api", netv1.PathTypeExact)))
+}
@@ -0,0 +1,96 @@
+package ingress
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+)
+
+// annotations of other ingress controllers for the protocol of the backend
+const nginxBackendProtocolAnnotation = "nginx.ingress.kubernetes.io/backend-protocol"
+const traefikServersSchemeAnnotation = "traefik.ingress.kubernetes.io/service.serversscheme"
+
+// backendProtocol is the detected protocol of a backend
+type backendProtocol struct {
+	Schema string
+	// cloudflared speaks HTTP/2 to the origin, only with https
+	Http2Origin bool
+}
+
+var httpProtocol = backendProtocol{Schema: "http"}
+
+// protocolFromAppProtocol maps the appProtocol of a service port
+func protocolFromAppProtocol(appProtocol string) (backendProtocol, bool) {
+	switch strings.ToLower(appProtocol) {
+	case "https", "kubernetes.io/wss":
+		return backendProtocol{Schema: "https"}, true
+	case "kubernetes.io/h2c", "h2c", "http", "kubernetes.io/ws":
+		// cloudflared has no h2c, HTTP/1.1 upgrades the websockets
+		return httpProtocol, true
+	}
+	return backendProtocol{}, false
+}
+
+// protocolFromNginx maps the values of nginx backend-protocol
+func protocolFromNginx(value string) (backendProtocol, bool) {
+	switch strings.ToUpper(value) {
+	case "HTTPS":
+		return backendProtocol{Schema: "https"}, true
+	case "GRPCS":
+		return backendProtocol{Schema: "https", Http2Origin: true}, true
+	case "HTTP", "AUTO_HTTP", "GRPC":
+		return httpProtocol, true
+	}
+	return backendProtocol{}, false
+}
+
+// protocolFromTraefik maps the values of traefik service.serversscheme
+func protocolFromTraefik(value string) (backendProtocol, bool) {
+	switch strings.ToLower(value) {
+	case "https":
+		return backendProtocol{Schema: "https"}, true
+	case "http", "h2c":
+		return httpProtocol, true
+	}
+	return backendProtocol{}, false
+}
+
+// servicePort is the port of the service the backend points to
+func servicePort(svc *corev1.Service, backend *netv1.IngressServiceBackend) (corev1.ServicePort, bool) {
+	for _, port := range svc.Spec.Ports {
+		if backend.Port.Name != "" && port.Name == backend.Port.Name {
+			return port, true
+		}
+		if backend.Port.Name == "" && port.Port == backend.Port.Number {
+			return port, true
+		}
+	}
+	return corev1.ServicePort{}, false
+}
+
+// findSchema detects the protocol of a backend without tunnel-mapping from
+// the appProtocol of the service port, the nginx backend-protocol annotation
+// of the ingress and the traefik serversscheme annotation of the service.
+func findSchema(ingress *netv1.Ingress, services serviceLookup, backend *netv1.IngressServiceBackend) backendProtocol {
+	var svc *corev1.Service
+	if services != nil && backend != nil {
+		svc, _ = services(backend.Name)
+	}
+	if svc != nil {
+		if port, ok := servicePort(svc, backend); ok && port.AppProtocol != nil {
+			if proto, ok := protocolFromAppProtocol(*port.AppProtocol); ok {
+				return proto
+			}
+		}
+	}
+	if proto, ok := protocolFromNginx(ingress.Annotations[nginxBackendProtocolAnnotation]); ok {
+		return proto
+	}
+	if svc != nil {
+		if proto, ok := protocolFromTraefik(svc.Annotations[traefikServersSchemeAnnotation]); ok {
+			return proto
+		}
+	}
+	return httpProtocol
+}
@@ -0,0 +1,96 @@
+package ingress
+
+import (
+	"testing"
+
+	"github.com/mabels/cloudflared-controller/controller/config"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func appProtocolService(name string, port int32, appProtocol string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "what"},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: "web", Port: port, AppProtocol: &appProtocol}},
+		},
+	}
+}
+
+func TestFindSchema(t *testing.T) {
+	ingress := &netv1.Ingress{}
+	backend := &netv1.IngressServiceBackend{Name: "web", Port: netv1.ServiceBackendPort{Number: 443}}
+
+	assert.Equal(t, httpProtocol, findSchema(ingress, nil, backend))
+
+	for appProtocol, schema := range map[string]string{
+		"https":             "https",
+		"kubernetes.io/wss": "https",
+		"kubernetes.io/ws":  "http",
+		"kubernetes.io/h2c": "http",
+		"unknown":           "http",
+	} {
+		services := testServices(appProtocolService("web", 443, appProtocol))
+		assert.Equal(t, schema, findSchema(ingress, services, backend).Schema, appProtocol)
+	}
+	// by port name
+	services := testServices(appProtocolService("web", 443, "https"))
+	assert.Equal(t, "https", findSchema(ingress, services, &netv1.IngressServiceBackend{
+		Name: "web", Port: netv1.ServiceBackendPort{Name: "web"},
+	}).Schema)
+	// other port
+	assert.Equal(t, "http", findSchema(ingress, services, &netv1.IngressServiceBackend{
+		Name: "web", Port: netv1.ServiceBackendPort{Number: 80},
+	}).Schema)
+}
+
+func TestFindSchemaAnnotations(t *testing.T) {
+	backend := &netv1.IngressServiceBackend{Name: "web", Port: netv1.ServiceBackendPort{Number: 443}}
+	ingress := &netv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{nginxBackendProtocolAnnotation: "HTTPS"},
+		},
+	}
+	assert.Equal(t, backendProtocol{Schema: "https"}, findSchema(ingress, nil, backend))
+	ingress.Annotations[nginxBackendProtocolAnnotation] = "GRPCS"
+	assert.Equal(t, backendProtocol{Schema: "https", Http2Origin: true}, findSchema(ingress, nil, backend))
+
+	// the appProtocol of the port wins
+	services := testServices(appProtocolService("web", 443, "http"))
+	assert.Equal(t, httpProtocol, findSchema(ingress, services, backend))
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Annotations: map[string]string{traefikServersSchemeAnnotation: "https"},
+		},
+		Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 443}}},
+	}
+	assert.Equal(t, "https", findSchema(&netv1.Ingress{}, testServices(svc), backend).Schema)
+}
+
+func TestIngressClassDetectedProtocol(t *testing.T) {
+	cf, ingress, ev := setupIngress()
+	ingress.Annotations[nginxBackendProtocolAnnotation] = "GRPCS"
+
+	processEvent(ev, ingress, cf, newIngressClasses(), nil)
+
+	cfcis := cf.tunnelConfigMaps.upsertCalls[0].cfcis
+	assert.Equal(t, "https://svc-wurst-xxx-what-tech.what:4711", cfcis[0].Service)
+	assert.True(t, cfcis[0].OriginRequest.NoTLSVerify)
+	assert.True(t, cfcis[0].OriginRequest.Http2Origin)
+
+	// an explicit mapping wins
+	cf, ingress, ev = setupIngress()
+	ingress.Annotations = map[string]string{
+		nginxBackendProtocolAnnotation:             "HTTPS",
+		config.AnnotationCloudflareTunnelMapping(): "xxx.what.tech/http|/wurst",
+	}
+	processEvent(ev, ingress, cf, newIngressClasses(), nil)
+
+	cfcis = cf.tunnelConfigMaps.upsertCalls[0].cfcis
+	assert.Equal(t, "http://svc-wurst-xxx-what-tech.what:4711", cfcis[0].Service)
+	assert.Equal(t, "https://svc-471-xxx-what-tech.what:471", cfcis[1].Service)
+}
@@ -0,0 +1,118 @@
+package ingress
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/mabels/cloudflared-controller/controller/types"
+	"github.com/mabels/cloudflared-controller/controller/watcher"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// serviceLookup finds a Service of the namespace of the ingress
+type serviceLookup func(name string) (*corev1.Service, bool)
+
+func watcherServiceLookup(wt types.Watcher[*corev1.Service]) serviceLookup {
+	return func(name string) (*corev1.Service, bool) {
+		for _, svc := range wt.GetState() {
+			if svc.Name == name {
+				return svc, true
+			}
+		}
+		return nil, false
+	}
+}
+
+// backendPort is the port number of the backend, a named port is resolved
+// with the ports of the Service
+func backendPort(services serviceLookup, backend *netv1.IngressServiceBackend) (int32, error) {
+	if backend.Port.Name == "" {
+		if 0 < backend.Port.Number && backend.Port.Number < 0x10000 {
+			return backend.Port.Number, nil
+		}
+		return 0, fmt.Errorf("invalid port number %d of service %s", backend.Port.Number, backend.Name)
+	}
+	if services == nil {
+		return 0, fmt.Errorf("port by name(%s) of service %s without service cache", backend.Port.Name, backend.Name)
+	}
+	svc, ok := services(backend.Name)
+	if !ok {
+		return 0, fmt.Errorf("service %s of port %s not found", backend.Name, backend.Port.Name)
+	}
+	for _, port := range svc.Spec.Ports {
+		if port.Name == backend.Port.Name {
+			return port.Port, nil
+		}
+	}
+	return 0, fmt.Errorf("service %s has no port named %s", backend.Name, backend.Port.Name)
+}
+
+// referencesService is true if a backend of the ingress is the service,
+// the defaultBackend is a backend of every host
+func referencesService(ingress *netv1.Ingress, name string) bool {
+	if backend := ingress.Spec.DefaultBackend; backend != nil && backend.Service != nil && backend.Service.Name == name {
+		return true
+	}
+	for _, rule := range ingress.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			if path.Backend.Service != nil && path.Backend.Service.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// startServiceWatcher watches the Services of the namespace, onChange is
+// called with the name of a Service which is added, deleted or whose ports
+// or protocol annotation changed
+func startServiceWatcher(cfc types.CFController, ns string, onChange func(name string)) (types.Watcher[*corev1.Service], func(), error) {
+	wt := watcher.NewWatcher(
+		types.WatcherConfig[corev1.Service, *corev1.Service, types.WatcherBindingService, types.WatcherBindingServiceClient]{
+			Log:     cfc.Log(),
+			Context: cfc.Context(),
+			K8sClient: types.WatcherBindingServiceClient{
+				Sif: cfc.Rest().K8s().CoreV1().Services(ns),
+			},
+		})
+	err := wt.Start()
+	if err != nil {
+		return wt, func() {}, err
+	}
+	// the parts of a service which change the rules of its ingresses
+	type backendOf struct {
+		ports  []corev1.ServicePort
+		scheme string
+	}
+	var lock sync.Mutex
+	backends := make(map[string]backendOf)
+	unreg := wt.RegisterEvent(func(_ []*corev1.Service, ev watch.Event) {
+		svc, ok := ev.Object.(*corev1.Service)
+		if !ok {
+			cfc.Log().Error().Any("ev", ev).Msg("Failed to cast to Service")
+			return
+		}
+		backend := backendOf{
+			ports:  svc.Spec.Ports,
+			scheme: svc.Annotations[traefikServersSchemeAnnotation],
+		}
+		lock.Lock()
+		prev, found := backends[svc.Name]
+		if ev.Type == watch.Deleted {
+			delete(backends, svc.Name)
+		} else {
+			backends[svc.Name] = backend
+		}
+		lock.Unlock()
+		if !found || ev.Type == watch.Deleted || !reflect.DeepEqual(prev, backend) {
+			onChange(svc.Name)
+		}
+	})
+	return wt, unreg, nil
+}
@@ -0,0 +1,89 @@
+package ingress
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testServices(svcs ...*corev1.Service) serviceLookup {
+	return func(name string) (*corev1.Service, bool) {
+		for _, svc := range svcs {
+			if svc.Name == name {
+				return svc, true
+			}
+		}
+		return nil, false
+	}
+}
+
+func namedPortService(name string, ports map[string]int32) *corev1.Service {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "what"},
+	}
+	for pname, port := range ports {
+		svc.Spec.Ports = append(svc.Spec.Ports, corev1.ServicePort{Name: pname, Port: port})
+	}
+	return svc
+}
+
+func TestBackendPort(t *testing.T) {
+	services := testServices(namedPortService("web", map[string]int32{"http": 8080}))
+
+	port, err := backendPort(services, &netv1.IngressServiceBackend{
+		Name: "web",
+		Port: netv1.ServiceBackendPort{Number: 4711},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(4711), port)
+
+	port, err = backendPort(services, &netv1.IngressServiceBackend{
+		Name: "web",
+		Port: netv1.ServiceBackendPort{Name: "http"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(8080), port)
+
+	_, err = backendPort(services, &netv1.IngressServiceBackend{
+		Name: "web",
+		Port: netv1.ServiceBackendPort{Name: "grpc"},
+	})
+	assert.Error(t, err)
+
+	_, err = backendPort(services, &netv1.IngressServiceBackend{
+		Name: "missing",
+		Port: netv1.ServiceBackendPort{Name: "http"},
+	})
+	assert.Error(t, err)
+
+	_, err = backendPort(nil, &netv1.IngressServiceBackend{
+		Name: "web",
+		Port: netv1.ServiceBackendPort{Name: "http"},
+	})
+	assert.Error(t, err)
+}
+
+func TestIngressClassNamedPort(t *testing.T) {
+	cf, ingress, ev := setupIngress()
+	ingress.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Port = netv1.ServiceBackendPort{Name: "http"}
+	services := testServices(namedPortService("svc-wurst-xxx-what-tech", map[string]int32{"http": 8080}))
+
+	processEvent(ev, ingress, cf, newIngressClasses(), services)
+
+	assert.Len(t, cf.tunnelConfigMaps.upsertCalls, 1)
+	assert.Len(t, cf.tunnelConfigMaps.upsertCalls[0].cfcis, 3)
+	assert.Equal(t, "http://svc-wurst-xxx-what-tech.what:8080", cf.tunnelConfigMaps.upsertCalls[0].cfcis[0].Service)
+}
+
+func TestReferencesService(t *testing.T) {
+	_, ingress, _ := setupIngress()
+	assert.True(t, referencesService(ingress, "svc-yyy-wurst-what-tech"))
+	assert.False(t, referencesService(ingress, "other"))
+	ingress.Spec.DefaultBackend = &netv1.IngressBackend{
+		Service: &netv1.IngressServiceBackend{Name: "default-svc", Port: netv1.ServiceBackendPort{Name: "http"}},
+	}
+	assert.True(t, referencesService(ingress, "default-svc"))
+}
@@ -22,14 +22,16 @@ type mockUpsertCall struct {
 }
 type mockTunnelConfigMaps struct {
 	upsertCalls []mockUpsertCall
+	// the kept tunnels of every RemoveConfigMapExcept call
+	keepCalls [][]*types.CFTunnelParameter
+	cms       []*corev1.ConfigMap
 }
 
 func (*mockTunnelConfigMaps) Register(func([]*corev1.ConfigMap, watch.Event)) func() {
 	panic("implement me")
 }
-func (*mockTunnelConfigMaps) Get() []*corev1.ConfigMap {
-	panic("implement me")
-
+func (p *mockTunnelConfigMaps) Get() []*corev1.ConfigMap {
+	return p.cms
 }
 func (p *mockTunnelConfigMaps) UpsertConfigMap(cfc types.CFController, tparam *types.CFTunnelParameter, kind string, meta *metav1.ObjectMeta, cfcis []types.CFConfigIngress) error {
 	p.upsertCalls = append(p.upsertCalls, mockUpsertCall{
@@ -43,6 +45,14 @@ func (p *mockTunnelConfigMaps) UpsertConfigMap(cfc types.CFController, tparam *t
 }
 func (*mockTunnelConfigMaps) RemoveConfigMap(cfc types.CFController, kind string, meta *metav1.ObjectMeta) {
 }
+func (p *mockTunnelConfigMaps) RemoveConfigMapExcept(cfc types.CFController, kind string, meta *metav1.ObjectMeta, keep []*types.CFTunnelParameter) {
+	p.keepCalls = append(p.keepCalls, keep)
+}
+func (*mockTunnelConfigMaps) UpsertPrivateRoutes(cfc types.CFController, tparam *types.CFTunnelParameter, kind string, meta *metav1.ObjectMeta, routes []types.CFPrivateRoute) error {
+	return nil
+}
+func (*mockTunnelConfigMaps) RemovePrivateRoutes(cfc types.CFController, kind string, meta *metav1.ObjectMeta) {
+}
 
 type mockController struct {
 	log              *zerolog.Logger
@@ -50,6 +60,10 @@ type mockController struct {
 	tunnelConfigMaps mockTunnelConfigMaps
 }
 
+func (p *mockController) WithCredentials(creds *types.CFCredentials) types.CFController {
+	return p
+}
+
 func (p *mockController) WithComponent(component string, fns ...func(types.CFController)) types.CFController {
 	return p
 }
@@ -74,6 +88,10 @@ func (*mockController) SetCfg(*types.CFControllerConfig) {
 func (*mockController) Rest() types.RestClients {
 	panic("implement me")
 }
+func (mockController) Plan() *types.Plan {
+	return &types.Plan{}
+}
+
 func (p *mockController) K8sData() *types.K8sData {
 	return &types.K8sData{
 		TunnelConfigMaps: &p.tunnelConfigMaps,
@@ -93,7 +111,7 @@ func TestIngressForeignClass(t *testing.T) {
 	cf, ingress, ev := setupIngress()
 	ingress.Spec.IngressClassName = toPtr("wurstClass")
 
-	processEvent(ev, ingress, cf)
+	processEvent(ev, ingress, cf, newIngressClasses(), nil)
 	assert.Len(t, cf.tunnelConfigMaps.upsertCalls, 0)
 }
 
@@ -110,7 +128,7 @@ func TestIngressMappingForeignClass(t *testing.T) {
 			http/yyy.what.tech///yyy.ext.tech`,
 	}
 
-	processEvent(ev, ingress, cf)
+	processEvent(ev, ingress, cf, newIngressClasses(), nil)
 	assert.Len(t, cf.tunnelConfigMaps.upsertCalls, 1)
 
 	assert.Equal(t, cf.tunnelConfigMaps.upsertCalls[0].tparam.Namespace, "what")
@@ -119,7 +137,7 @@ func TestIngressMappingForeignClass(t *testing.T) {
 	assert.Equal(t, cf.tunnelConfigMaps.upsertCalls[0].cfcis, []types.CFConfigIngress{
 		{
 			Hostname: "xxx.ext.tech",
-			Path:     "/wurst",
+			Path:     "^/wurst(/|$)",
 			Service:  "https://xxx.what.tech:4711",
 			OriginRequest: &types.CFConfigOriginRequest{
 				NoTLSVerify:    false,
@@ -128,7 +146,7 @@ func TestIngressMappingForeignClass(t *testing.T) {
 		},
 		{
 			Hostname: "zzz.ext.tech",
-			Path:     "/",
+			Path:     "^/",
 			Service:  "https://xxx.what.tech:4911",
 			OriginRequest: &types.CFConfigOriginRequest{
 				NoTLSVerify:    true,
@@ -137,7 +155,7 @@ func TestIngressMappingForeignClass(t *testing.T) {
 		},
 		{
 			Hostname: "yyy.ext.tech",
-			Path:     "/",
+			Path:     "^/",
 			Service:  "https://yyy.what.tech:443",
 			OriginRequest: &types.CFConfigOriginRequest{
 				NoTLSVerify:    false,
@@ -0,0 +1,108 @@
+package ingress
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/mabels/cloudflared-controller/controller/config"
+	"github.com/mabels/cloudflared-controller/controller/k8s_data"
+	"github.com/mabels/cloudflared-controller/controller/types"
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const tunnelDomain = "cfargotunnel.com"
+
+func isTunnelHostname(hostname string) bool {
+	return strings.HasSuffix(hostname, "."+tunnelDomain)
+}
+
+// routed is true if every hostname of the rules is in the dns-routed
+// annotation of the tunnel ConfigMap
+func routed(cm *corev1.ConfigMap, rules string) bool {
+	cfcis := []types.CFConfigIngress{}
+	if yaml.Unmarshal([]byte(rules), &cfcis) != nil {
+		return false
+	}
+	hostnames := map[string]bool{}
+	for _, hostname := range strings.Split(cm.Annotations[config.AnnotationCloudflareDNSRouted()], ",") {
+		hostnames[hostname] = true
+	}
+	for _, cfci := range cfcis {
+		if cfci.Hostname != "" && !hostnames[cfci.Hostname] {
+			return false
+		}
+	}
+	return true
+}
+
+// tunnelStatus is the status.loadBalancer.ingress of a class ingress, the
+// tunnels of the tunnel ConfigMaps with its rules and a tunnel id, nothing
+// until the DNS records of all its hostnames are routed
+func tunnelStatus(cms []*corev1.ConfigMap, ingress *netv1.Ingress) []netv1.IngressLoadBalancerIngress {
+	if _, found := ingress.Annotations[config.AnnotationCloudflareDNSError()]; found {
+		return nil
+	}
+	key := k8s_data.ConfigMapKey("ingress", ingress.Namespace, ingress.Name)
+	hostnames := map[string]struct{}{}
+	for _, cm := range cms {
+		rules, found := cm.Data[key]
+		if !found {
+			continue
+		}
+		id, found := cm.Annotations[config.AnnotationCloudflareTunnelId()]
+		if !found || id == "" {
+			continue
+		}
+		if !routed(cm, rules) {
+			return nil
+		}
+		hostnames[fmt.Sprintf("%s.%s", id, tunnelDomain)] = struct{}{}
+	}
+	ret := make([]netv1.IngressLoadBalancerIngress, 0, len(hostnames))
+	for hostname := range hostnames {
+		ret = append(ret, netv1.IngressLoadBalancerIngress{Hostname: hostname})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Hostname < ret[j].Hostname
+	})
+	return ret
+}
+
+// desiredStatus replaces our entries of the status, the entries of other
+// controllers are kept
+func desiredStatus(current []netv1.IngressLoadBalancerIngress, ours []netv1.IngressLoadBalancerIngress) []netv1.IngressLoadBalancerIngress {
+	ret := []netv1.IngressLoadBalancerIngress{}
+	for _, lb := range current {
+		if !isTunnelHostname(lb.Hostname) {
+			ret = append(ret, lb)
+		}
+	}
+	return append(ret, ours...)
+}
+
+// syncStatus publishes the tunnel address of a class ingress and removes it
+// if the ingress is not ours (anymore)
+func syncStatus(cfc types.CFController, ingress *netv1.Ingress, ours bool) {
+	lbs := []netv1.IngressLoadBalancerIngress{}
+	if ours {
+		lbs = tunnelStatus(cfc.K8sData().TunnelConfigMaps.Get(), ingress)
+	}
+	current := ingress.Status.LoadBalancer.Ingress
+	desired := desiredStatus(current, lbs)
+	if len(current) == 0 && len(desired) == 0 || reflect.DeepEqual(current, desired) {
+		return
+	}
+	toUpdate := ingress.DeepCopy()
+	toUpdate.Status.LoadBalancer.Ingress = desired
+	_, err := cfc.Rest().K8s().NetworkingV1().Ingresses(ingress.Namespace).UpdateStatus(cfc.Context(), toUpdate, metav1.UpdateOptions{})
+	if err != nil {
+		cfc.Log().Error().Err(err).Str("ingress", ingress.Name).Msg("Failed to update ingress status")
+		return
+	}
+	cfc.Log().Debug().Str("ingress", ingress.Name).Any("status", desired).Msg("Updated ingress status")
+}
@@ -0,0 +1,84 @@
+package ingress
+
+import (
+	"testing"
+
+	"github.com/mabels/cloudflared-controller/controller/config"
+	"github.com/mabels/cloudflared-controller/controller/k8s_data"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func tunnelCM(id string, keys ...string) *corev1.ConfigMap {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{},
+		},
+		Data: map[string]string{},
+	}
+	if id != "" {
+		cm.Annotations[config.AnnotationCloudflareTunnelId()] = id
+	}
+	for _, key := range keys {
+		cm.Data[key] = "[]"
+	}
+	return cm
+}
+
+func TestTunnelStatus(t *testing.T) {
+	_, ingress, _ := setupIngress()
+	key := k8s_data.ConfigMapKey("ingress", ingress.Namespace, ingress.Name)
+
+	// no tunnel id yet
+	assert.Empty(t, tunnelStatus([]*corev1.ConfigMap{tunnelCM("", key)}, ingress))
+
+	cms := []*corev1.ConfigMap{
+		tunnelCM("b-id", key),
+		tunnelCM("other", k8s_data.ConfigMapKey("ingress", "what", "other")),
+		tunnelCM("a-id", key),
+	}
+	assert.Equal(t, []netv1.IngressLoadBalancerIngress{
+		{Hostname: "a-id.cfargotunnel.com"},
+		{Hostname: "b-id.cfargotunnel.com"},
+	}, tunnelStatus(cms, ingress))
+
+	// DNS is not routed
+	ingress.Annotations[config.AnnotationCloudflareDNSError()] = "conflict"
+	assert.Empty(t, tunnelStatus(cms, ingress))
+}
+
+func TestTunnelStatusRouted(t *testing.T) {
+	_, ingress, _ := setupIngress()
+	key := k8s_data.ConfigMapKey("ingress", ingress.Namespace, ingress.Name)
+	cm := tunnelCM("a-id")
+	cm.Data[key] = "- hostname: a.example.com\n  service: http://a\n- hostname: b.example.com\n  service: http://b\n- service: http_status:404\n"
+
+	// the DNS record of b.example.com failed or was skipped
+	cm.Annotations[config.AnnotationCloudflareDNSRouted()] = "a.example.com"
+	assert.Empty(t, tunnelStatus([]*corev1.ConfigMap{cm}, ingress))
+
+	cm.Annotations[config.AnnotationCloudflareDNSRouted()] = "a.example.com,b.example.com,c.example.com"
+	assert.Equal(t, []netv1.IngressLoadBalancerIngress{
+		{Hostname: "a-id.cfargotunnel.com"},
+	}, tunnelStatus([]*corev1.ConfigMap{cm}, ingress))
+}
+
+func TestDesiredStatus(t *testing.T) {
+	traefik := netv1.IngressLoadBalancerIngress{IP: "10.0.0.1"}
+	tunnel := netv1.IngressLoadBalancerIngress{Hostname: "a-id.cfargotunnel.com"}
+
+	assert.Equal(t, []netv1.IngressLoadBalancerIngress{tunnel},
+		desiredStatus(nil, []netv1.IngressLoadBalancerIngress{tunnel}))
+	assert.Equal(t, []netv1.IngressLoadBalancerIngress{traefik},
+		desiredStatus([]netv1.IngressLoadBalancerIngress{traefik, tunnel}, nil))
+	assert.Empty(t, desiredStatus([]netv1.IngressLoadBalancerIngress{tunnel}, nil))
+}
+
+func TestSyncStatusUnchanged(t *testing.T) {
+	cf, ingress, _ := setupIngress()
+	// no update without tunnel id, the mock has no rest clients
+	syncStatus(cf, ingress, true)
+	syncStatus(cf, ingress, false)
+}
@@ -0,0 +1,106 @@
+package k8s_data
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mabels/cloudflared-controller/controller/config"
+	"github.com/mabels/cloudflared-controller/controller/types"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// the keys of a credentials Secret are named like the environment
+// variables of the controller
+const (
+	CredentialsApiTokenKey  = "CLOUDFLARE_API_TOKEN"
+	CredentialsAccountIdKey = "CLOUDFLARE_ACCOUNT_ID"
+)
+
+// credentialsSecretRef checks a credentials-secret annotation, only a
+// Secret of the own namespace can be referenced
+func credentialsSecretRef(ns, value string) (string, error) {
+	name := strings.TrimSpace(value)
+	if name == "" || strings.Contains(name, "/") {
+		return "", fmt.Errorf("%s %q must name a Secret in namespace %s", config.AnnotationCloudflareCredentialsSecret(), value, ns)
+	}
+	return ns + "/" + name, nil
+}
+
+// CredentialsRef returns namespace/name of the credentials Secret of an
+// object in ns with annos, its own annotation wins over the one of the
+// namespace. "" are the credentials of the controller.
+func CredentialsRef(cfc types.CFController, ns string, annos map[string]string) (string, error) {
+	if value, found := annos[config.AnnotationCloudflareCredentialsSecret()]; found {
+		return credentialsSecretRef(ns, value)
+	}
+	nsObj, err := cfc.Rest().K8s().CoreV1().Namespaces().Get(cfc.Context(), ns, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if value, found := nsObj.Annotations[config.AnnotationCloudflareCredentialsSecret()]; found {
+		return credentialsSecretRef(ns, value)
+	}
+	return "", nil
+}
+
+// FetchCredentials reads the credentials Secret ref (namespace/name)
+func FetchCredentials(cfc types.CFController, ref string) (*types.CFCredentials, error) {
+	name := types.FromFQDN(ref, "")
+	secret, err := cfc.Rest().K8s().CoreV1().Secrets(name.Namespace).Get(cfc.Context(), name.Name, metav1.GetOptions{})
+	if err != nil {
+		cfc.Log().Error().Err(err).Str("secretName", ref).Msg("Error reading credentials")
+		return nil, err
+	}
+	creds := types.CFCredentials{
+		Secret:    ref,
+		ApiToken:  strings.TrimSpace(string(secret.Data[CredentialsApiTokenKey])),
+		AccountId: strings.TrimSpace(string(secret.Data[CredentialsAccountIdKey])),
+	}
+	if creds.ApiToken == "" || creds.AccountId == "" {
+		return nil, fmt.Errorf("Secret %s needs %s and %s", ref, CredentialsApiTokenKey, CredentialsAccountIdKey)
+	}
+	return &creds, nil
+}
+
+// TunnelCredentials resolves the credentials of the tunnel ConfigMap ns with
+// annos, nil are the credentials of the controller
+func TunnelCredentials(cfc types.CFController, ns string, annos map[string]string) (*types.CFCredentials, error) {
+	ref, err := CredentialsRef(cfc, ns, annos)
+	if err != nil || ref == "" {
+		return nil, err
+	}
+	return FetchCredentials(cfc, ref)
+}
+
+// checkCredentials refuses to put the rules of a source object into a
+// tunnel ConfigMap of another namespace using other credentials, so one
+// namespace can't publish through the account of another
+func checkCredentials(cfc types.CFController, kind string, meta *metav1.ObjectMeta, tparam *types.CFTunnelParameter) error {
+	tunnelNs := tparam.K8SConfigMapName().Namespace
+	if meta.Namespace == tunnelNs {
+		return nil
+	}
+	srcRef, err := CredentialsRef(cfc, meta.Namespace, meta.Annotations)
+	if err != nil {
+		return err
+	}
+	var annos map[string]string
+	cm, err := cfc.Rest().K8s().CoreV1().ConfigMaps(tunnelNs).Get(cfc.Context(), tparam.K8SConfigMapName().Name, metav1.GetOptions{})
+	if err == nil {
+		annos = cm.Annotations
+	} else if !errors.IsNotFound(err) {
+		return err
+	}
+	tunnelRef, err := CredentialsRef(cfc, tunnelNs, annos)
+	if err != nil {
+		return err
+	}
+	if srcRef != tunnelRef {
+		return fmt.Errorf("%s %s/%s can't use tunnel %s, it has other credentials", kind, meta.Namespace, meta.Name, tparam.K8SConfigMapName().FQDN)
+	}
+	return nil
+}
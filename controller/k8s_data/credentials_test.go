@@ -0,0 +1,48 @@
+package k8s_data
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mabels/cloudflared-controller/controller"
+	"github.com/mabels/cloudflared-controller/controller/config"
+	"github.com/mabels/cloudflared-controller/controller/types"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestCheckCredentials(t *testing.T) {
+	log := zerolog.Nop()
+	cfc := controller.NewCFController(&log)
+	cfc.SetCfg(&types.CFControllerConfig{})
+	// namespaces without annotation and no tunnel ConfigMap yet
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v1/namespaces/team-a", "/api/v1/namespaces/default":
+			w.Write([]byte(`{"kind":"Namespace","apiVersion":"v1","metadata":{"name":"team-a"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+		}
+	}))
+	defer srv.Close()
+	cs, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	assert.NoError(t, err)
+	cfc.Rest().SetK8s(cs)
+
+	tparam := &types.CFTunnelParameter{Namespace: "default", Name: "t"}
+	meta := &metav1.ObjectMeta{Name: "a", Namespace: "team-a"}
+	assert.NoError(t, checkCredentials(cfc, "ingress", meta, tparam))
+
+	// the source asks for its own account, the tunnel uses the one of the controller
+	meta.Annotations = map[string]string{config.AnnotationCloudflareCredentialsSecret(): "cloudflare"}
+	assert.ErrorContains(t, checkCredentials(cfc, "ingress", meta, tparam), "other credentials")
+
+	// the tunnel ConfigMap is in the namespace of the source
+	assert.NoError(t, checkCredentials(cfc, "ingress", meta, &types.CFTunnelParameter{Namespace: "team-a", Name: "t"}))
+}
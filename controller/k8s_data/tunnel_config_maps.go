@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"reflect"
 	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/google/uuid"
@@ -68,6 +70,11 @@ func cmKey(kind, ns, name string) string {
 	return reSanitzeNice.ReplaceAllString(fmt.Sprintf("%s-%s-%s", kind, ns, name), "_")
 }
 
+// ConfigMapKey is the data key of the rules of a source object in the tunnel ConfigMap
+func ConfigMapKey(kind, ns, name string) string {
+	return cmKey(kind, ns, name)
+}
+
 func UpsertConfigMap(cfc types.CFController, tparam *types.CFTunnelParameter, cm *corev1.ConfigMap) error {
 	client := cfc.Rest().K8s().CoreV1().ConfigMaps(tparam.K8SConfigMapName().Namespace)
 	toUpdate, err := client.Get(cfc.Context(), tparam.K8SConfigMapName().Name, metav1.GetOptions{})
@@ -104,13 +111,133 @@ func (ts *tunnelConfigMaps) lockConfigMap(kind string, tparam *types.CFTunnelPar
 	}
 }
 
-func (ts *tunnelConfigMaps) UpsertConfigMap(cfc types.CFController, tparam *types.CFTunnelParameter, kind string, meta *metav1.ObjectMeta, cfcis []types.CFConfigIngress) error {
+// rulePriority reads the rule-priority annotation of the source object
+func rulePriority(cfc types.CFController, meta *metav1.ObjectMeta) int {
+	str, found := meta.Annotations[config.AnnotationCloudflareRulePriority()]
+	if !found {
+		return 0
+	}
+	prio, err := strconv.Atoi(strings.TrimSpace(str))
+	if err != nil {
+		cfc.Log().Warn().Str("name", meta.Name).Str("namespace", meta.Namespace).Str("priority", str).Msg("Invalid rule-priority annotation")
+		return 0
+	}
+	return prio
+}
+
+// dnsConflictPolicy reads the dns-conflict annotation of the source object
+func dnsConflictPolicy(cfc types.CFController, meta *metav1.ObjectMeta) types.DNSConflictPolicy {
+	str, found := meta.Annotations[config.AnnotationCloudflareDNSConflict()]
+	if !found {
+		return ""
+	}
+	policy := types.DNSConflictPolicy(strings.TrimSpace(str))
+	switch policy {
+	case types.DNSConflictSkip, types.DNSConflictOverwrite, types.DNSConflictFail:
+		return policy
+	}
+	cfc.Log().Warn().Str("name", meta.Name).Str("namespace", meta.Namespace).Str("policy", str).Msg("Invalid dns-conflict annotation")
+	return ""
+}
+
+// dnsRecordOptions reads the dns-proxied, dns-ttl and dns-comment
+// annotations of the source object into m
+func dnsRecordOptions(cfc types.CFController, meta *metav1.ObjectMeta, m *types.CFConfigIngressMeta) {
+	log := cfc.Log().With().Str("name", meta.Name).Str("namespace", meta.Namespace).Logger()
+	if str, found := meta.Annotations[config.AnnotationCloudflareDNSProxied()]; found {
+		proxied, err := strconv.ParseBool(strings.TrimSpace(str))
+		if err != nil {
+			log.Warn().Str("proxied", str).Msg("Invalid dns-proxied annotation")
+		} else {
+			m.DNSProxied = &proxied
+		}
+	}
+	if str, found := meta.Annotations[config.AnnotationCloudflareDNSTTL()]; found {
+		ttl, err := strconv.Atoi(strings.TrimSpace(str))
+		if err != nil || ttl < 1 {
+			log.Warn().Str("ttl", str).Msg("Invalid dns-ttl annotation")
+		} else {
+			m.DNSTTL = ttl
+		}
+	}
+	if str, found := meta.Annotations[config.AnnotationCloudflareDNSComment()]; found {
+		m.DNSComment = str
+	}
+}
+
+// DeletionProtected reads the deletion-protection annotation, an unparsable
+// value protects, better safe than sorry
+func DeletionProtected(annotations map[string]string) bool {
+	str, found := annotations[config.AnnotationCloudflareDeletionProtection()]
+	if !found {
+		return false
+	}
+	protected, err := strconv.ParseBool(strings.TrimSpace(str))
+	return err != nil || protected
+}
+
+// loadBalancerOptions reads the load-balancer annotations of the source
+// object into m
+func loadBalancerOptions(cfc types.CFController, meta *metav1.ObjectMeta, m *types.CFConfigIngressMeta) {
+	str, found := meta.Annotations[config.AnnotationCloudflareLoadBalancer()]
+	if !found {
+		return
+	}
+	lb, err := strconv.ParseBool(strings.TrimSpace(str))
+	if err != nil {
+		cfc.Log().Warn().Str("name", meta.Name).Str("namespace", meta.Namespace).Str("loadBalancer", str).Msg("Invalid load-balancer annotation")
+		return
+	}
+	m.LoadBalancer = lb
+	if lb {
+		m.LBMonitorPath = strings.TrimSpace(meta.Annotations[config.AnnotationCloudflareLBMonitorPath()])
+	}
+}
+
+func (ts *tunnelConfigMaps) UpsertConfigMap(cfc types.CFController, tparam *types.CFTunnelParameter, kind string, meta *metav1.ObjectMeta, _cfcis []types.CFConfigIngress) error {
+	// meta of all rules of the source object
+	srcMeta := types.CFConfigIngressMeta{
+		Priority:           rulePriority(cfc, meta),
+		DNSConflict:        dnsConflictPolicy(cfc, meta),
+		DeletionProtection: DeletionProtected(meta.Annotations),
+	}
+	if srcMeta.DNSConflict != "" {
+		srcMeta.Source = fmt.Sprintf("%s/%s/%s", kind, meta.Namespace, meta.Name)
+	}
+	dnsRecordOptions(cfc, meta, &srcMeta)
+	loadBalancerOptions(cfc, meta, &srcMeta)
+	cfcis := make([]types.CFConfigIngress, 0, len(_cfcis))
+	for _, cfci := range _cfcis {
+		if !reflect.DeepEqual(srcMeta, types.CFConfigIngressMeta{}) {
+			m := srcMeta
+			if cfci.Meta != nil && m.Priority == 0 {
+				m.Priority = cfci.Meta.Priority
+			}
+			cfci.Meta = &m
+		}
+		cfcis = append(cfcis, cfci)
+	}
 	yCFConfigIngressByte, err := yaml.Marshal(cfcis)
 	if err != nil {
 		cfc.Log().Error().Err(err).Msg("Error marshaling cfcis")
 		return err
 	}
 
+	err = checkCredentials(cfc, kind, meta, tparam)
+	if err != nil {
+		cfc.Log().Error().Err(err).Msg("Error checking credentials")
+		return err
+	}
+	cm := tunnelConfigMap(cfc, tparam, meta, map[string]string{
+		cmKey(kind, meta.Namespace, meta.Name): string(yCFConfigIngressByte),
+	})
+	unlock := ts.lockConfigMap(kind, tparam)
+	defer unlock()
+	return UpsertConfigMap(cfc, tparam, cm)
+}
+
+// tunnelConfigMap is the tunnel ConfigMap with the data of one source object
+func tunnelConfigMap(cfc types.CFController, tparam *types.CFTunnelParameter, meta *metav1.ObjectMeta, data map[string]string) *corev1.ConfigMap {
 	annos := make(map[string]string)
 	for k, v := range meta.Annotations {
 		annos[k] = v
@@ -120,27 +247,92 @@ func (ts *tunnelConfigMaps) UpsertConfigMap(cfc types.CFController, tparam *type
 
 	delete(annos, config.AnnotationCloudflareTunnelExternalName())
 	delete(annos, config.AnnotationCloudflareTunnelK8sConfigMap())
+	// the priority belongs to the rules of the source object not to the tunnel
+	delete(annos, config.AnnotationCloudflareRulePriority())
+	delete(annos, config.AnnotationCloudflareDNSConflict())
+	delete(annos, config.AnnotationCloudflareDNSError())
+	delete(annos, config.AnnotationCloudflareDNSProxied())
+	delete(annos, config.AnnotationCloudflareDNSTTL())
+	delete(annos, config.AnnotationCloudflareDNSComment())
+	delete(annos, config.AnnotationCloudflarePrivateRoute())
+	delete(annos, config.AnnotationCloudflareVirtualNetwork())
+	delete(annos, config.AnnotationCloudflareLoadBalancer())
+	delete(annos, config.AnnotationCloudflareLBMonitorPath())
+	delete(annos, config.AnnotationCloudflarePathRegex())
+	// kept per source object in its rules and routes
+	delete(annos, config.AnnotationCloudflareDeletionProtection())
+	// a Secret of another namespace can't be referenced
+	if meta.Namespace != tparam.K8SConfigMapName().Namespace {
+		delete(annos, config.AnnotationCloudflareCredentialsSecret())
+	}
 
-	cm := corev1.ConfigMap{
+	return &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:        tparam.K8SConfigMapName().Name,
 			Namespace:   tparam.K8SConfigMapName().Namespace,
 			Labels:      config.CfLabels(meta.Labels, cfc),
 			Annotations: annos,
 		},
-		Data: map[string]string{
-			cmKey(kind, meta.Namespace, meta.Name): string(yCFConfigIngressByte),
-		},
+		Data: data,
 	}
+}
+
+func privateRoutesKey(kind, ns, name string) string {
+	return types.PrivateRoutesKeyPrefix + cmKey(kind, ns, name)
+}
 
+// UpsertPrivateRoutes writes the private routes of the source object, no
+// routes removes them
+func (ts *tunnelConfigMaps) UpsertPrivateRoutes(cfc types.CFController, tparam *types.CFTunnelParameter, kind string, meta *metav1.ObjectMeta, routes []types.CFPrivateRoute) error {
+	if len(routes) == 0 {
+		ts.RemovePrivateRoutes(cfc, kind, meta)
+		return nil
+	}
+	protected := DeletionProtected(meta.Annotations)
+	for i := range routes {
+		routes[i].DeletionProtection = protected
+	}
+	yRoutes, err := yaml.Marshal(routes)
+	if err != nil {
+		cfc.Log().Error().Err(err).Msg("Error marshaling private routes")
+		return err
+	}
+	err = checkCredentials(cfc, kind, meta, tparam)
+	if err != nil {
+		cfc.Log().Error().Err(err).Msg("Error checking credentials")
+		return err
+	}
+	cm := tunnelConfigMap(cfc, tparam, meta, map[string]string{
+		privateRoutesKey(kind, meta.Namespace, meta.Name): string(yRoutes),
+	})
 	unlock := ts.lockConfigMap(kind, tparam)
 	defer unlock()
-	return UpsertConfigMap(cfc, tparam, &cm)
+	return UpsertConfigMap(cfc, tparam, cm)
+}
+
+func (ts *tunnelConfigMaps) RemovePrivateRoutes(cfc types.CFController, kind string, meta *metav1.ObjectMeta) {
+	ts.removeKey(cfc, kind, privateRoutesKey(kind, meta.Namespace, meta.Name), nil)
 }
 
 func (ts *tunnelConfigMaps) RemoveConfigMap(cfc types.CFController, kind string, meta *metav1.ObjectMeta) {
+	ts.removeKey(cfc, kind, cmKey(kind, meta.Namespace, meta.Name), nil)
+}
+
+func (ts *tunnelConfigMaps) RemoveConfigMapExcept(cfc types.CFController, kind string, meta *metav1.ObjectMeta, keep []*types.CFTunnelParameter) {
+	except := make(map[string]bool, len(keep))
+	for _, tparam := range keep {
+		except[tparam.K8SConfigMapName().FQDN] = true
+	}
+	ts.removeKey(cfc, kind, cmKey(kind, meta.Namespace, meta.Name), except)
+}
+
+// removeKey removes the data key from all tunnel ConfigMaps which are not
+// in except, key namespace/name of the ConfigMap
+func (ts *tunnelConfigMaps) removeKey(cfc types.CFController, kind string, key string, except map[string]bool) {
 	for _, toUpdate := range cfc.K8sData().TunnelConfigMaps.Get() {
-		key := cmKey(kind, meta.Namespace, meta.Name)
+		if except[toUpdate.GetNamespace()+"/"+toUpdate.GetName()] {
+			continue
+		}
 		needChange := len(toUpdate.Data)
 		delete(toUpdate.Data, key)
 		if needChange != len(toUpdate.Data) {
@@ -235,7 +427,7 @@ func (tcm *tunnelConfigMaps) delete(cm *corev1.ConfigMap) {
 	tcm.cmsLock.Lock()
 	ocm, found := tcm.cms[key]
 	if found {
-		delete(tcm.watchers, key)
+		delete(tcm.cms, key)
 		tcm.cmsLock.Unlock()
 		tcm.fireEvents(ocm.cm, watch.Deleted)
 	} else {
@@ -0,0 +1,52 @@
+package k8s_data
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mabels/cloudflared-controller/controller"
+	"github.com/mabels/cloudflared-controller/controller/types"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestRemoveConfigMapExcept(t *testing.T) {
+	log := zerolog.Nop()
+	cfc := controller.NewCFController(&log)
+	cfc.SetCfg(&types.CFControllerConfig{})
+	updates := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		updates = append(updates, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+	cs, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	assert.NoError(t, err)
+	cfc.Rest().SetK8s(cs)
+
+	tcm := newTunnelConfigMaps()
+	cfc.K8sData().TunnelConfigMaps = tcm
+	one := &types.CFTunnelParameter{Namespace: "what", Name: "one.tech"}
+	two := &types.CFTunnelParameter{Namespace: "what", Name: "two.tech"}
+	key := cmKey("ingress", "what", "web")
+	for _, tparam := range []*types.CFTunnelParameter{one, two} {
+		tcm.upsert(&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "what", Name: tparam.K8SConfigMapName().Name},
+			Data:       map[string]string{key: "- hostname: www.what.tech\n  service: http://web\n"},
+		})
+	}
+
+	// the host of the ingress moved from tunnel one to tunnel two
+	tcm.RemoveConfigMapExcept(cfc, "ingress", &metav1.ObjectMeta{Namespace: "what", Name: "web"}, []*types.CFTunnelParameter{two})
+	assert.Equal(t, []string{"PUT /api/v1/namespaces/what/configmaps/" + one.K8SConfigMapName().Name}, updates)
+	for _, cm := range tcm.Get() {
+		_, found := cm.Data[key]
+		assert.Equal(t, cm.Name == two.K8SConfigMapName().Name, found, cm.Name)
+	}
+}
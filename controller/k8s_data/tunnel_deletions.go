@@ -0,0 +1,68 @@
+package k8s_data
+
+import (
+	"fmt"
+
+	"github.com/mabels/cloudflared-controller/controller/config"
+	"github.com/mabels/cloudflared-controller/controller/types"
+	coordv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The pending deletion of a tunnel whose ConfigMap is deleted is kept in a
+// Lease next to the tunnel ConfigMap, so the next leader continues it.
+// Leases are written even in the dry-run, so the writes ask for dryRun=All.
+
+func dryRun(cfc types.CFController) []string {
+	if cfc.Cfg().DryRun {
+		return []string{metav1.DryRunAll}
+	}
+	return nil
+}
+
+func tunnelDeletionSelector(cfc types.CFController) string {
+	return fmt.Sprintf("%s=%s", config.LabelCloudflaredControllerDeletionOf, cfc.Cfg().Leader.Name)
+}
+
+// UpsertTunnelDeletion replaces the annotations of the deletion Lease of the tunnel
+func UpsertTunnelDeletion(cfc types.CFController, tp *types.CFTunnelParameter, annos map[string]string) error {
+	name := tp.K8SDeletionName()
+	client := cfc.Rest().K8s().CoordinationV1().Leases(name.Namespace)
+	lease, err := client.Get(cfc.Context(), name.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = client.Create(cfc.Context(), &coordv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name.Name,
+				Namespace: name.Namespace,
+				Labels: map[string]string{
+					config.LabelCloudflaredControllerDeletionOf: cfc.Cfg().Leader.Name,
+				},
+				Annotations: annos,
+			},
+		}, metav1.CreateOptions{DryRun: dryRun(cfc)})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	lease.Annotations = annos
+	_, err = client.Update(cfc.Context(), lease, metav1.UpdateOptions{DryRun: dryRun(cfc)})
+	return err
+}
+
+func DeleteTunnelDeletion(cfc types.CFController, tp *types.CFTunnelParameter) error {
+	name := tp.K8SDeletionName()
+	return cfc.Rest().K8s().CoordinationV1().Leases(name.Namespace).Delete(cfc.Context(), name.Name, metav1.DeleteOptions{DryRun: dryRun(cfc)})
+}
+
+// ListTunnelDeletions returns the deletion Leases of all namespaces
+func ListTunnelDeletions(cfc types.CFController) ([]coordv1.Lease, error) {
+	leases, err := cfc.Rest().K8s().CoordinationV1().Leases(metav1.NamespaceAll).List(cfc.Context(), metav1.ListOptions{
+		LabelSelector: tunnelDeletionSelector(cfc),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return leases.Items, nil
+}
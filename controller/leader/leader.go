@@ -1,13 +1,16 @@
 package leader
 
 import (
+	"context"
+
 	"github.com/mabels/cloudflared-controller/controller/types"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/tools/leaderelection"
 	"k8s.io/client-go/tools/leaderelection/resourcelock"
 )
 
-func LeaderSelection(cfc types.CFController, lcb leaderelection.LeaderCallbacks) {
+// LeaderSelection runs until ctx is done or the leadership is lost
+func LeaderSelection(ctx context.Context, cfc types.CFController, lcb leaderelection.LeaderCallbacks) {
 	cfc.Log().Info().Str("namespace", cfc.Cfg().Leader.Namespace).Str("name", cfc.Cfg().Leader.Name).Msg("Start Leader Election")
 	lock := resourcelock.LeaseLock{
 		LeaseMeta: metav1.ObjectMeta{
@@ -19,7 +22,7 @@ func LeaderSelection(cfc types.CFController, lcb leaderelection.LeaderCallbacks)
 			Identity: cfc.Cfg().Identity,
 		},
 	}
-	leaderelection.RunOrDie(cfc.Context(), leaderelection.LeaderElectionConfig{
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
 		Lock:            &lock,
 		ReleaseOnCancel: true,
 		LeaseDuration:   cfc.Cfg().Leader.LeaseDuration,
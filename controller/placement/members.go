@@ -0,0 +1,262 @@
+package placement
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mabels/cloudflared-controller/controller/config"
+	"github.com/mabels/cloudflared-controller/controller/types"
+	coordv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Members tracks the running controller replicas. Every replica renews its
+// own Lease, the alive replicas are the Leases which are not expired.
+type Members struct {
+	cfc   types.CFController
+	stop  chan struct{}
+	done  sync.WaitGroup
+	lease string
+
+	lock sync.Mutex
+	ring *Ring
+
+	fnsLock sync.Mutex
+	// key uuid
+	fns map[string]func(members []string)
+}
+
+var reSanitzeLeaseName = regexp.MustCompile(`[^a-z0-9-]+`)
+
+func memberLeaseName(cfc types.CFController) string {
+	id := reSanitzeLeaseName.ReplaceAllString(strings.ToLower(cfc.Cfg().Identity), "-")
+	return strings.Trim(fmt.Sprintf("%s-member-%s", cfc.Cfg().Leader.Name, id), "-")
+}
+
+func StartMembers(_cfc types.CFController) *Members {
+	cfc := _cfc.WithComponent("members")
+	m := &Members{
+		cfc:   cfc,
+		stop:  make(chan struct{}),
+		lease: memberLeaseName(cfc),
+		ring:  NewRing([]string{cfc.Cfg().Identity}),
+		fns:   make(map[string]func(members []string)),
+	}
+	m.refresh()
+	m.done.Add(1)
+	go func() {
+		defer m.done.Done()
+		ticker := time.NewTicker(cfc.Cfg().Connectors.RenewInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-cfc.Context().Done():
+				return
+			case <-ticker.C:
+				m.refresh()
+			}
+		}
+	}()
+	return m
+}
+
+func (m *Members) Stop() {
+	select {
+	case <-m.stop:
+		return
+	default:
+	}
+	close(m.stop)
+	m.done.Wait()
+	// the controller context is usually cancelled on shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client := m.cfc.Rest().K8s().CoordinationV1().Leases(m.cfc.Cfg().Leader.Namespace)
+	err := client.Delete(ctx, m.lease, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		m.cfc.Log().Error().Err(err).Str("lease", m.lease).Msg("Failed to release member lease")
+	}
+}
+
+func (m *Members) renew() error {
+	client := m.cfc.Rest().K8s().CoordinationV1().Leases(m.cfc.Cfg().Leader.Namespace)
+	identity := m.cfc.Cfg().Identity
+	duration := int32(m.cfc.Cfg().Connectors.LeaseDuration.Seconds())
+	now := metav1.NewMicroTime(time.Now())
+	lease, err := client.Get(m.cfc.Context(), m.lease, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = client.Create(m.cfc.Context(), &coordv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      m.lease,
+				Namespace: m.cfc.Cfg().Leader.Namespace,
+				Labels: map[string]string{
+					config.LabelCloudflaredControllerMember: m.cfc.Cfg().Leader.Name,
+				},
+			},
+			Spec: coordv1.LeaseSpec{
+				HolderIdentity:       &identity,
+				LeaseDurationSeconds: &duration,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	lease.Spec.HolderIdentity = &identity
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.RenewTime = &now
+	_, err = client.Update(m.cfc.Context(), lease, metav1.UpdateOptions{})
+	return err
+}
+
+// aliveMembers returns the sorted holder identities of all not expired leases
+func aliveMembers(leases []coordv1.Lease, now time.Time) []string {
+	ret := []string{}
+	for _, lease := range leases {
+		if lease.Spec.HolderIdentity == nil || lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+			continue
+		}
+		expires := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+		if expires.Before(now) {
+			continue
+		}
+		ret = append(ret, *lease.Spec.HolderIdentity)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// staleLeases returns the leases of crashed replicas, a lease is stale once it
+// is expired for another lease duration
+func staleLeases(leases []coordv1.Lease, now time.Time) []coordv1.Lease {
+	ret := []coordv1.Lease{}
+	for _, lease := range leases {
+		if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+			continue
+		}
+		duration := time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+		if lease.Spec.RenewTime.Add(2 * duration).Before(now) {
+			ret = append(ret, lease)
+		}
+	}
+	return ret
+}
+
+// collect deletes the stale leases, the resource version guards against a
+// replica which renewed its lease in the meantime
+func (m *Members) collect(leases []coordv1.Lease) {
+	client := m.cfc.Rest().K8s().CoordinationV1().Leases(m.cfc.Cfg().Leader.Namespace)
+	for _, lease := range staleLeases(leases, time.Now()) {
+		if lease.Name == m.lease {
+			continue
+		}
+		rv := lease.ResourceVersion
+		err := client.Delete(m.cfc.Context(), lease.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{ResourceVersion: &rv},
+		})
+		if err != nil && !errors.IsNotFound(err) && !errors.IsConflict(err) {
+			m.cfc.Log().Error().Err(err).Str("lease", lease.Name).Msg("Failed to delete stale member lease")
+			continue
+		}
+		m.cfc.Log().Info().Str("lease", lease.Name).Msg("Deleted stale member lease")
+	}
+}
+
+func (m *Members) refresh() {
+	err := m.renew()
+	if err != nil {
+		m.cfc.Log().Error().Err(err).Str("lease", m.lease).Msg("Failed to renew member lease")
+	}
+	leases, err := m.cfc.Rest().K8s().CoordinationV1().Leases(m.cfc.Cfg().Leader.Namespace).List(m.cfc.Context(), metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", config.LabelCloudflaredControllerMember, m.cfc.Cfg().Leader.Name),
+	})
+	if err != nil {
+		m.cfc.Log().Error().Err(err).Msg("Failed to list member leases")
+		return
+	}
+	m.collect(leases.Items)
+	alive := aliveMembers(leases.Items, time.Now())
+	found := false
+	for _, a := range alive {
+		if a == m.cfc.Cfg().Identity {
+			found = true
+			break
+		}
+	}
+	if !found {
+		// we are alive even if our lease write did not make it
+		alive = append(alive, m.cfc.Cfg().Identity)
+		sort.Strings(alive)
+	}
+	m.lock.Lock()
+	if reflect.DeepEqual(m.ring.Members(), alive) {
+		m.lock.Unlock()
+		return
+	}
+	m.ring = NewRing(alive)
+	m.lock.Unlock()
+	m.cfc.Log().Info().Strs("members", alive).Msg("Members changed")
+	m.fnsLock.Lock()
+	fns := make([]func([]string), 0, len(m.fns))
+	for _, fn := range m.fns {
+		fns = append(fns, fn)
+	}
+	m.fnsLock.Unlock()
+	for _, fn := range fns {
+		fn(alive)
+	}
+}
+
+func (m *Members) Get() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.ring.Members()
+}
+
+// returns a function to unregister the callback
+func (m *Members) Register(fn func(members []string)) func() {
+	m.fnsLock.Lock()
+	uid := uuid.NewString()
+	m.fns[uid] = fn
+	m.fnsLock.Unlock()
+	return func() {
+		m.fnsLock.Lock()
+		delete(m.fns, uid)
+		m.fnsLock.Unlock()
+	}
+}
+
+// Connectors reads the requested connector count of a tunnel ConfigMap
+func Connectors(cfc types.CFController, annotations map[string]string) int {
+	str, found := annotations[config.AnnotationCloudflareTunnelConnectors()]
+	if !found {
+		return cfc.Cfg().Connectors.Default
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(str))
+	if err != nil || n < 0 {
+		cfc.Log().Warn().Str("connectors", str).Msg("Invalid connectors annotation, using default")
+		return cfc.Cfg().Connectors.Default
+	}
+	return n
+}
+
+// Owns reports if this replica should run a connector for the tunnel
+func (m *Members) Owns(tunnel string, connectors int) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.ring.Owns(m.cfc.Cfg().Identity, tunnel, connectors)
+}
@@ -0,0 +1,95 @@
+package placement
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// virtual nodes per member, keeps the tunnel distribution even with few replicas
+const ringVirtualNodes = 64
+
+type ringPoint struct {
+	hash   uint64
+	member string
+}
+
+// Ring is a consistent-hash ring over the controller replicas. Removing a
+// member only moves the tunnels which were placed on that member.
+type Ring struct {
+	members []string
+	points  []ringPoint
+}
+
+func ringHash(key string) uint64 {
+	hash := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(hash[:8])
+}
+
+func NewRing(members []string) *Ring {
+	r := &Ring{
+		members: make([]string, 0, len(members)),
+		points:  make([]ringPoint, 0, len(members)*ringVirtualNodes),
+	}
+	seen := make(map[string]bool)
+	for _, m := range members {
+		if seen[m] {
+			continue
+		}
+		seen[m] = true
+		r.members = append(r.members, m)
+		for i := 0; i < ringVirtualNodes; i++ {
+			r.points = append(r.points, ringPoint{
+				hash:   ringHash(fmt.Sprintf("%s#%d", m, i)),
+				member: m,
+			})
+		}
+	}
+	sort.Strings(r.members)
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash == r.points[j].hash {
+			return r.points[i].member < r.points[j].member
+		}
+		return r.points[i].hash < r.points[j].hash
+	})
+	return r
+}
+
+func (r *Ring) Members() []string {
+	return r.members
+}
+
+// Owners returns the n members responsible for key, walking the ring
+// clockwise from the key position. n <= 0 selects every member.
+func (r *Ring) Owners(key string, n int) []string {
+	if n <= 0 || n >= len(r.members) {
+		ret := make([]string, len(r.members))
+		copy(ret, r.members)
+		return ret
+	}
+	hash := ringHash(key)
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= hash
+	})
+	ret := make([]string, 0, n)
+	seen := make(map[string]bool)
+	for i := 0; i < len(r.points) && len(ret) < n; i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if seen[p.member] {
+			continue
+		}
+		seen[p.member] = true
+		ret = append(ret, p.member)
+	}
+	return ret
+}
+
+func (r *Ring) Owns(member string, key string, n int) bool {
+	for _, o := range r.Owners(key, n) {
+		if o == member {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package placement
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	coordv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRingOwners(t *testing.T) {
+	ring := NewRing([]string{"c", "a", "b", "a"})
+	assert.Equal(t, []string{"a", "b", "c"}, ring.Members())
+
+	assert.Len(t, ring.Owners("default/cfd-tunnel-cfg.what-tech", 0), 3)
+	assert.Len(t, ring.Owners("default/cfd-tunnel-cfg.what-tech", 5), 3)
+	owners := ring.Owners("default/cfd-tunnel-cfg.what-tech", 2)
+	assert.Len(t, owners, 2)
+	assert.NotEqual(t, owners[0], owners[1])
+	assert.Equal(t, owners, ring.Owners("default/cfd-tunnel-cfg.what-tech", 2))
+	assert.True(t, ring.Owns(owners[0], "default/cfd-tunnel-cfg.what-tech", 2))
+}
+
+func TestRingDistribution(t *testing.T) {
+	ring := NewRing([]string{"a", "b", "c"})
+	count := map[string]int{}
+	for i := 0; i < 300; i++ {
+		count[ring.Owners(fmt.Sprintf("ns/tunnel-%d", i), 1)[0]]++
+	}
+	for _, m := range ring.Members() {
+		assert.Greater(t, count[m], 50, m)
+	}
+}
+
+func TestRingRemoveMemberKeepsOthers(t *testing.T) {
+	before := NewRing([]string{"a", "b", "c"})
+	after := NewRing([]string{"a", "c"})
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("ns/tunnel-%d", i)
+		owner := before.Owners(key, 1)[0]
+		if owner != "b" {
+			assert.Equal(t, owner, after.Owners(key, 1)[0], key)
+		}
+	}
+}
+
+func TestAliveMembers(t *testing.T) {
+	now := time.Now()
+	lease := func(id string, renew time.Time) coordv1.Lease {
+		duration := int32(15)
+		rt := metav1.NewMicroTime(renew)
+		return coordv1.Lease{
+			Spec: coordv1.LeaseSpec{
+				HolderIdentity:       &id,
+				LeaseDurationSeconds: &duration,
+				RenewTime:            &rt,
+			},
+		}
+	}
+	alive := aliveMembers([]coordv1.Lease{
+		lease("b", now.Add(-5*time.Second)),
+		lease("expired", now.Add(-20*time.Second)),
+		lease("a", now),
+		{},
+	}, now)
+	assert.Equal(t, []string{"a", "b"}, alive)
+}
+
+func TestStaleLeases(t *testing.T) {
+	now := time.Now()
+	lease := func(name string, renew time.Time) coordv1.Lease {
+		duration := int32(15)
+		rt := metav1.NewMicroTime(renew)
+		return coordv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: coordv1.LeaseSpec{
+				LeaseDurationSeconds: &duration,
+				RenewTime:            &rt,
+			},
+		}
+	}
+	stale := staleLeases([]coordv1.Lease{
+		lease("alive", now),
+		lease("expired", now.Add(-20*time.Second)),
+		lease("crashed", now.Add(-time.Hour)),
+		{},
+	}, now)
+	names := []string{}
+	for _, l := range stale {
+		names = append(names, l.Name)
+	}
+	assert.Equal(t, []string{"crashed"}, names)
+}
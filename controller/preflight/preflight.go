@@ -0,0 +1,324 @@
+package preflight
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	cfgo "github.com/cloudflare/cloudflare-go"
+	"github.com/google/uuid"
+	"github.com/mabels/cloudflared-controller/controller/types"
+)
+
+type Status string
+
+const (
+	StatusOK      Status = "ok"
+	StatusDenied  Status = "denied"
+	StatusFailed  Status = "failed"
+	StatusSkipped Status = "skipped"
+)
+
+// Result of one capability of the token
+type Result struct {
+	Capability string
+	// account id or zone name
+	Scope    string
+	Required bool
+	Status   Status
+	Err      error
+}
+
+type Report struct {
+	Time    time.Time
+	Results []Result
+}
+
+// Ready is true if every required capability is available
+func (r *Report) Ready() bool {
+	for _, res := range r.Results {
+		if res.Required && res.Status != StatusOK && res.Status != StatusSkipped {
+			return false
+		}
+	}
+	return true
+}
+
+// Missing are the required capabilities which are not available
+func (r *Report) Missing() []string {
+	ret := []string{}
+	for _, res := range r.Results {
+		if res.Required && res.Status != StatusOK && res.Status != StatusSkipped {
+			ret = append(ret, res.Capability+"@"+res.Scope)
+		}
+	}
+	return ret
+}
+
+// WriteMatrix writes the permission matrix as table
+func (r *Report) WriteMatrix(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CAPABILITY\tSCOPE\tREQUIRED\tSTATUS\tERROR")
+	for _, res := range r.Results {
+		errStr := ""
+		if res.Err != nil {
+			errStr = res.Err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%v\t%s\t%s\n", res.Capability, res.Scope, res.Required, res.Status, errStr)
+	}
+	tw.Flush()
+}
+
+// prober sends the requests of the checks
+type prober interface {
+	verifyToken(ctx context.Context) error
+	account(ctx context.Context, accountId string) error
+	// get reads endpoint
+	get(ctx context.Context, endpoint string) error
+	// post sends an empty object to endpoint, it is rejected by the
+	// validation if the token has the permission
+	post(ctx context.Context, endpoint string) error
+}
+
+type cfgoProber struct {
+	api *cfgo.API
+}
+
+func (p cfgoProber) verifyToken(ctx context.Context) error {
+	body, err := p.api.VerifyAPIToken(ctx)
+	if err != nil {
+		return err
+	}
+	if body.Status != "active" {
+		return fmt.Errorf("token status is %s", body.Status)
+	}
+	return nil
+}
+
+func (p cfgoProber) account(ctx context.Context, accountId string) error {
+	_, _, err := p.api.Account(ctx, accountId)
+	return err
+}
+
+func (p cfgoProber) get(ctx context.Context, endpoint string) error {
+	_, err := p.api.Raw(ctx, http.MethodGet, endpoint, nil, nil)
+	return err
+}
+
+func (p cfgoProber) post(ctx context.Context, endpoint string) error {
+	_, err := p.api.Raw(ctx, http.MethodPost, endpoint, map[string]interface{}{}, nil)
+	return err
+}
+
+// status classifies the error of a check, a write probe passed the
+// permission check if its payload is rejected
+func status(err error, writeProbe bool) (Status, error) {
+	if err == nil {
+		return StatusOK, nil
+	}
+	var authz *cfgo.AuthorizationError
+	var authn *cfgo.AuthenticationError
+	if errors.As(err, &authz) || errors.As(err, &authn) {
+		return StatusDenied, err
+	}
+	var req *cfgo.RequestError
+	if writeProbe && errors.As(err, &req) {
+		return StatusOK, nil
+	}
+	return StatusFailed, err
+}
+
+// run checks the capabilities of the token, zones key zone name value id
+func run(cfc types.CFController, p prober, zones map[string]string, zonesErr error) *Report {
+	ctx := cfc.Context()
+	accountId := cfc.Cfg().CloudFlare.AccountId
+	report := &Report{Time: time.Now()}
+	check := func(capability, scope string, required bool, writeProbe bool, fn func() error) {
+		res := Result{Capability: capability, Scope: scope, Required: required}
+		if writeProbe && cfc.Cfg().DryRun {
+			// the dry-run would answer the probe itself
+			res.Status = StatusSkipped
+		} else {
+			res.Status, res.Err = status(fn(), writeProbe)
+		}
+		report.Results = append(report.Results, res)
+	}
+	check("token:status", "-", true, false, func() error {
+		return p.verifyToken(ctx)
+	})
+	check("account:read", accountId, true, false, func() error {
+		return p.account(ctx, accountId)
+	})
+	tunnels := fmt.Sprintf("/accounts/%s/cfd_tunnel", accountId)
+	check("tunnel:list", accountId, true, false, func() error {
+		return p.get(ctx, tunnels+"?per_page=1")
+	})
+	check("tunnel:create", accountId, true, true, func() error {
+		return p.post(ctx, tunnels)
+	})
+	if cfc.Cfg().Preflight.Access {
+		apps := fmt.Sprintf("/accounts/%s/access/apps", accountId)
+		check("access:read", accountId, true, false, func() error {
+			return p.get(ctx, apps+"?per_page=1")
+		})
+		check("access:edit", accountId, true, true, func() error {
+			return p.post(ctx, apps)
+		})
+	}
+	if zonesErr != nil {
+		report.Results = append(report.Results, Result{
+			Capability: "zone:list",
+			Scope:      accountId,
+			Required:   true,
+			Status:     StatusFailed,
+			Err:        zonesErr,
+		})
+		return report
+	}
+	names := make([]string, 0, len(zones))
+	for name := range zones {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		records := fmt.Sprintf("/zones/%s/dns_records", zones[name])
+		check("dns:read", name, true, false, func() error {
+			return p.get(ctx, records+"?per_page=1")
+		})
+		check("dns:edit", name, true, true, func() error {
+			return p.post(ctx, records)
+		})
+	}
+	return report
+}
+
+// Run checks the token of the controller
+func Run(cfc types.CFController) *Report {
+	api, err := cfc.Rest().Cfgo()
+	if err != nil {
+		return &Report{
+			Time: time.Now(),
+			Results: []Result{{
+				Capability: "token:status",
+				Scope:      "-",
+				Required:   true,
+				Status:     StatusFailed,
+				Err:        err,
+			}},
+		}
+	}
+	zones, err := cfc.Rest().ZoneIDs()
+	return run(cfc, cfgoProber{api: api}, zones, err)
+}
+
+// Checker runs the preflight at start and every Preflight.Interval
+type Checker struct {
+	cfc  types.CFController
+	stop chan struct{}
+	done sync.WaitGroup
+
+	lock sync.Mutex
+	last *Report
+
+	fnsLock sync.Mutex
+	// key uuid
+	fns map[string]func(*Report)
+}
+
+func Start(_cfc types.CFController) *Checker {
+	cfc := _cfc.WithComponent("preflight")
+	c := &Checker{
+		cfc:  cfc,
+		stop: make(chan struct{}),
+		fns:  make(map[string]func(*Report)),
+	}
+	c.check()
+	if cfc.Cfg().Preflight.Interval <= 0 {
+		return c
+	}
+	c.done.Add(1)
+	go func() {
+		defer c.done.Done()
+		ticker := time.NewTicker(cfc.Cfg().Preflight.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-cfc.Context().Done():
+				return
+			case <-ticker.C:
+				c.check()
+			}
+		}
+	}()
+	return c
+}
+
+func (c *Checker) check() {
+	report := Run(c.cfc)
+	c.lock.Lock()
+	changed := c.last == nil || matrix(c.last) != matrix(report)
+	c.last = report
+	c.lock.Unlock()
+	if changed {
+		c.cfc.Log().Info().Msg("Token permissions:\n" + matrix(report))
+	}
+	if report.Ready() {
+		c.cfc.Log().Debug().Msg("Preflight passed")
+	} else {
+		c.cfc.Log().Error().Strs("missing", report.Missing()).Msg("Preflight failed, the token misses required permissions")
+	}
+	c.fnsLock.Lock()
+	fns := make([]func(*Report), 0, len(c.fns))
+	for _, fn := range c.fns {
+		fns = append(fns, fn)
+	}
+	c.fnsLock.Unlock()
+	for _, fn := range fns {
+		fn(report)
+	}
+}
+
+func matrix(r *Report) string {
+	sb := strings.Builder{}
+	r.WriteMatrix(&sb)
+	return sb.String()
+}
+
+// Report is the last preflight report
+func (c *Checker) Report() *Report {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.last
+}
+
+func (c *Checker) Ready() bool {
+	report := c.Report()
+	return report != nil && report.Ready()
+}
+
+// Register calls fn after every preflight
+func (c *Checker) Register(fn func(*Report)) func() {
+	id := uuid.New().String()
+	c.fnsLock.Lock()
+	c.fns[id] = fn
+	c.fnsLock.Unlock()
+	return func() {
+		c.fnsLock.Lock()
+		delete(c.fns, id)
+		c.fnsLock.Unlock()
+	}
+}
+
+func (c *Checker) Stop() {
+	close(c.stop)
+	c.done.Wait()
+}
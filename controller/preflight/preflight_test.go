@@ -0,0 +1,88 @@
+package preflight
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	cfgo "github.com/cloudflare/cloudflare-go"
+	"github.com/mabels/cloudflared-controller/controller"
+	"github.com/mabels/cloudflared-controller/controller/types"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeProber struct {
+	errs map[string]error
+}
+
+func (p fakeProber) verifyToken(ctx context.Context) error {
+	return p.errs["token"]
+}
+
+func (p fakeProber) account(ctx context.Context, accountId string) error {
+	return p.errs["account"]
+}
+
+func (p fakeProber) get(ctx context.Context, endpoint string) error {
+	return p.errs["GET "+strings.Split(endpoint, "?")[0]]
+}
+
+func (p fakeProber) post(ctx context.Context, endpoint string) error {
+	if err, found := p.errs["POST "+endpoint]; found {
+		return err
+	}
+	// the empty object is never valid
+	e := cfgo.NewRequestError(&cfgo.Error{StatusCode: 400, ErrorMessages: []string{"invalid"}})
+	return &e
+}
+
+func denied() error {
+	e := cfgo.NewAuthorizationError(&cfgo.Error{StatusCode: 403, ErrorMessages: []string{"Authentication error"}})
+	return &e
+}
+
+func testController(dryRun bool) types.CFController {
+	log := zerolog.Nop()
+	cfc := controller.NewCFController(&log)
+	cfg := types.CFControllerConfig{DryRun: dryRun}
+	cfg.CloudFlare.AccountId = "acc"
+	cfc.SetCfg(&cfg)
+	return cfc
+}
+
+func TestPreflightReady(t *testing.T) {
+	report := run(testController(false), fakeProber{errs: map[string]error{}}, map[string]string{"example.com": "z1"}, nil)
+	assert.True(t, report.Ready())
+	assert.Empty(t, report.Missing())
+	caps := []string{}
+	for _, res := range report.Results {
+		caps = append(caps, res.Capability+"@"+res.Scope)
+		assert.Equal(t, StatusOK, res.Status, res.Capability)
+	}
+	assert.Equal(t, []string{
+		"token:status@-", "account:read@acc", "tunnel:list@acc", "tunnel:create@acc",
+		"dns:read@example.com", "dns:edit@example.com",
+	}, caps)
+}
+
+func TestPreflightMissingPermission(t *testing.T) {
+	report := run(testController(false), fakeProber{errs: map[string]error{
+		"POST /zones/z2/dns_records": denied(),
+	}}, map[string]string{"example.com": "z1", "example.org": "z2"}, nil)
+	assert.False(t, report.Ready())
+	assert.Equal(t, []string{"dns:edit@example.org"}, report.Missing())
+
+	sb := strings.Builder{}
+	report.WriteMatrix(&sb)
+	assert.Contains(t, sb.String(), "CAPABILITY")
+	assert.Regexp(t, `dns:edit\s+example.org\s+true\s+denied`, sb.String())
+}
+
+func TestPreflightDryRunSkipsWrites(t *testing.T) {
+	report := run(testController(true), fakeProber{errs: map[string]error{
+		"POST /accounts/acc/cfd_tunnel": denied(),
+	}}, map[string]string{}, nil)
+	assert.True(t, report.Ready())
+	assert.Equal(t, StatusSkipped, report.Results[3].Status)
+}
@@ -1,12 +1,15 @@
 package controller
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"strings"
 	"sync"
 
 	cfgo "github.com/cloudflare/cloudflare-go"
-	"github.com/cloudflare/cloudflared/cfapi"
 	"github.com/mabels/cloudflared-controller/controller/types"
+	"golang.org/x/time/rate"
 	"k8s.io/client-go/kubernetes"
 )
 
@@ -16,22 +19,90 @@ type RestClients struct {
 	cfc types.CFController
 	// Cf  *cfapi.RESTClient
 	cfsLock sync.Mutex
-	cfs     map[string]*cfapi.RESTClient
+
+	zonesOnce sync.Once
+	zones     *zoneCache
+
+	httpOnce   sync.Once
+	httpClient *http.Client
 
 	cfgoAPI *cfgo.API
 
 	clientSet *kubernetes.Clientset
+
+	// nil uses the credentials of the controller
+	creds *types.CFCredentials
+	// the clients of creds are canceled if the Secret changes
+	context    context.Context
+	cancelFunc context.CancelFunc
+	root       *RestClients
+	scopesLock sync.Mutex
+	// key namespace/name of the credentials Secret
+	scopes map[string]*RestClients
 }
 
 func NewRestClients(cfc types.CFController) *RestClients {
 	rc := RestClients{
-		cfc: cfc,
-		cfs: make(map[string]*cfapi.RESTClient),
+		cfc:    cfc,
+		scopes: make(map[string]*RestClients),
 	}
 	return &rc
 }
 
+// forCredentials returns the cached clients of creds, every credentials
+// Secret has its own clients, zones and rate limit
+func (rc *RestClients) forCredentials(creds *types.CFCredentials) *RestClients {
+	if rc.root != nil {
+		return rc.root.forCredentials(creds)
+	}
+	rc.scopesLock.Lock()
+	defer rc.scopesLock.Unlock()
+	scope, found := rc.scopes[creds.Secret]
+	if found && *scope.creds == *creds {
+		return scope
+	}
+	if found {
+		rc.cfc.Log().Info().Str("credentials", creds.Secret).Msg("Credentials changed, replacing Cloudflare clients")
+		scope.cancelFunc()
+	}
+	my := *creds
+	ctx, cancel := context.WithCancel(rc.cfc.Context())
+	scope = &RestClients{
+		cfc:        rc.cfc,
+		creds:      &my,
+		context:    ctx,
+		cancelFunc: cancel,
+		root:       rc,
+	}
+	rc.scopes[creds.Secret] = scope
+	return scope
+}
+
+func (rc *RestClients) apiToken() string {
+	if rc.creds != nil {
+		return rc.creds.ApiToken
+	}
+	return rc.cfc.Cfg().CloudFlare.ApiToken
+}
+
+func (rc *RestClients) accountId() string {
+	if rc.creds != nil {
+		return rc.creds.AccountId
+	}
+	return rc.cfc.Cfg().CloudFlare.AccountId
+}
+
+func (rc *RestClients) ctx() context.Context {
+	if rc.context != nil {
+		return rc.context
+	}
+	return rc.cfc.Context()
+}
+
 func (rc *RestClients) K8s() *kubernetes.Clientset {
+	if rc.root != nil {
+		return rc.root.K8s()
+	}
 	return rc.clientSet
 }
 
@@ -48,14 +119,37 @@ func (cl *cfgoLogger) Printf(format string, v ...interface{}) {
 	cl.cfc.Log().Info().Str("cfgo", fmt.Sprintf(format, v...)).Msg("cfgo log")
 }
 
+// cfHTTPClient is used by all Cloudflare clients, so they share the rate
+// limit, the retries and the timeouts of one cfTransport
+func (rc *RestClients) cfHTTPClient() *http.Client {
+	rc.httpOnce.Do(func() {
+		log := rc.cfc.Log().With().Str("component", "cloudflare-api").Str("accountId", rc.accountId()).Logger()
+		transport := newCFTransport(&log, &rc.cfc.Cfg().CloudFlare, nil)
+		if rc.cfc.Cfg().DryRun {
+			transport.plan = rc.cfc.Plan()
+		}
+		rc.httpClient = &http.Client{Transport: transport}
+	})
+	return rc.httpClient
+}
+
 func (rc *RestClients) Cfgo() (*cfgo.API, error) {
 	rc.cfsLock.Lock()
 	defer rc.cfsLock.Unlock()
 	if rc.cfgoAPI == nil {
 		var err error
 
-		rc.cfgoAPI, err = cfgo.NewWithAPIToken(rc.cfc.Cfg().CloudFlare.ApiToken,
-			cfgo.UsingLogger(&cfgoLogger{cfc: rc.cfc}))
+		opts := []cfgo.Option{
+			cfgo.UsingLogger(&cfgoLogger{cfc: rc.cfc}),
+			cfgo.HTTPClient(rc.cfHTTPClient()),
+			// limits and retries are done by the cfTransport
+			cfgo.UsingRateLimit(float64(rate.Inf)),
+			cfgo.UsingRetryPolicy(0, 0, 0),
+		}
+		if rc.cfc.Cfg().CloudFlare.ApiUrl != "" {
+			opts = append(opts, cfgo.BaseURL(rc.cfc.Cfg().CloudFlare.ApiUrl))
+		}
+		rc.cfgoAPI, err = cfgo.NewWithAPIToken(rc.apiToken(), opts...)
 		if err != nil {
 			return nil, err
 		}
@@ -64,63 +158,66 @@ func (rc *RestClients) Cfgo() (*cfgo.API, error) {
 
 }
 
-func (rc *RestClients) CFClientWithoutZoneID() (*cfapi.RESTClient, error) {
-	rc.cfsLock.Lock()
-	defer rc.cfsLock.Unlock()
-	_, found := rc.cfs[""]
-	var err error
-	if !found {
-		rc.cfs[""], err = cfapi.NewRESTClient(
-			rc.cfc.Cfg().CloudFlare.ApiUrl,
-			rc.cfc.Cfg().CloudFlare.AccountId, // accountTag string,
-			"",                                // zoneTag string,
-			rc.cfc.Cfg().CloudFlare.ApiToken,
-			"cloudflared-controller",
-			rc.cfc.Log())
-	}
-	return rc.cfs[""], err
+// zoneCache is created on first use, the config is not set in NewRestClients
+func (rc *RestClients) zoneCache() *zoneCache {
+	rc.zonesOnce.Do(func() {
+		log := rc.cfc.Log().With().Str("component", "zones").Str("accountId", rc.accountId()).Logger()
+		rc.zones = newZoneCache(&log,
+			rc.cfc.Cfg().CloudFlare.ZoneCacheTTL,
+			rc.cfc.Cfg().CloudFlare.ZoneCacheNegativeTTL,
+			func() (map[string]string, error) {
+				zones, err := getZones(rc.cfc, rc.apiToken(), rc.cfHTTPClient())
+				if err != nil {
+					return nil, err
+				}
+				ret := make(map[string]string, len(zones))
+				for _, zone := range zones {
+					ret[zone.Name] = zone.ID
+				}
+				return ret, nil
+			})
+		rc.zones.start(rc.ctx())
+	})
+	return rc.zones
 }
 
-func (rc *RestClients) GetCFClientForDomain(domain string) (*cfapi.RESTClient, error) {
-	rc.cfsLock.Lock()
-	defer rc.cfsLock.Unlock()
-	rcl, found := rc.cfs[domain]
-	if !found {
-		zones, err := getZones(rc.cfc)
-		if err != nil {
-			rc.cfc.Log().Error().Err(err).Msg("Failed to get zones")
-			return nil, err
-		}
-		zonestrs := []string{}
-		for _, zone := range zones {
-			zonestrs = append(zonestrs, zone.Name)
-			rc.cfc.Log().Debug().Str("zone", zone.Name).Msg("client for zone")
-			rc.cfs[zone.Name], err = cfapi.NewRESTClient(
-				rc.cfc.Cfg().CloudFlare.ApiUrl,
-				rc.cfc.Cfg().CloudFlare.AccountId, // accountTag string,
-				zone.ID,                           // zoneTag string,
-				rc.cfc.Cfg().CloudFlare.ApiToken,
-				fmt.Sprintf("cloudflared-controller(%s)", zone.Name),
-				rc.cfc.Log())
-			if err != nil {
-				rc.cfc.Log().Fatal().Err(err).
-					Str("zone", zone.Name).
-					Str("zoneId", zone.ID).
-					Str("apiUrl", rc.cfc.Cfg().CloudFlare.ApiUrl).
-					Str("account", rc.cfc.Cfg().CloudFlare.AccountId).
-					Str("apiToken", rc.cfc.Cfg().CloudFlare.ApiToken).
-					Msg("Failed to create cloudflare client")
-			}
+// longestSuffixZone returns the most specific zone containing hostname, so
+// dev.example.com wins over example.com and example.co.uk is found at all.
+func longestSuffixZone(hostname string, zones []string) (string, bool) {
+	hostname = strings.ToLower(strings.Trim(strings.TrimSpace(hostname), "."))
+	found := ""
+	for _, zone := range zones {
+		zone = strings.ToLower(zone)
+		if hostname != zone && !strings.HasSuffix(hostname, "."+zone) {
+			continue
 		}
-		rcl, found = rc.cfs[domain]
-		if !found {
-			rc.cfc.Log().Error().
-				Str("domain", domain).
-				Str("apiToken", rc.cfc.Cfg().CloudFlare.ApiToken).
-				Strs("zones", zonestrs).
-				Msg("domain not found")
-			return nil, fmt.Errorf("domain %s not found", domain)
+		if len(zone) > len(found) {
+			found = zone
 		}
 	}
-	return rcl, nil
+	return found, found != ""
+}
+
+// ZoneForHostname resolves the zone of hostname by the longest suffix match
+// against the zones of the account.
+func (rc *RestClients) ZoneForHostname(hostname string) (*types.CFZone, error) {
+	zone, zoneId, found, err := rc.zoneCache().Lookup(hostname)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		zones, _ := rc.zoneCache().Zones()
+		return nil, fmt.Errorf("no zone of account %s matches hostname %s (zones: %s)",
+			rc.accountId(), hostname, strings.Join(zoneNames(zones), ","))
+	}
+	return &types.CFZone{
+		Name: zone,
+		ID:   zoneId,
+		Apex: strings.ToLower(strings.Trim(strings.TrimSpace(hostname), ".")) == zone,
+	}, nil
+}
+
+// ZoneIDs returns the ids of all zones of the account, key zone name
+func (rc *RestClients) ZoneIDs() (map[string]string, error) {
+	return rc.zoneCache().Zones()
 }
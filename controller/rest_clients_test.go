@@ -5,10 +5,32 @@ import (
 	"testing"
 
 	"github.com/mabels/cloudflared-controller/controller/config"
+	"github.com/mabels/cloudflared-controller/controller/types"
 	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
 )
 
-func TestRestCFClientWithoutZoneID(t *testing.T) {
+func TestLongestSuffixZone(t *testing.T) {
+	zones := []string{"example.com", "dev.example.com", "example.co.uk", "co.uk.example.org"}
+	for hostname, zone := range map[string]string{
+		"www.example.com":       "example.com",
+		"example.com":           "example.com",
+		"a.dev.example.com":     "dev.example.com",
+		"dev.example.com":       "dev.example.com",
+		"WWW.Example.Co.Uk.":    "example.co.uk",
+		"xdev.example.com":      "example.com",
+		"x.co.uk.example.org":   "co.uk.example.org",
+		"*.dev.example.com":     "dev.example.com",
+		"www.other-example.com": "",
+		"example.co":            "",
+	} {
+		found, ok := longestSuffixZone(hostname, zones)
+		assert.Equal(t, zone, found, hostname)
+		assert.Equal(t, zone != "", ok, hostname)
+	}
+}
+
+func TestRestCfgo(t *testing.T) {
 	_log := zerolog.New(os.Stderr).With().Timestamp().Logger()
 	cfc := NewCFController(&_log)
 
@@ -21,13 +43,14 @@ func TestRestCFClientWithoutZoneID(t *testing.T) {
 	cfc.SetCfg(cfg)
 
 	rc := NewRestClients(cfc)
-	cf, err := rc.CFClientWithoutZoneID()
+	cf, err := rc.Cfgo()
 	if err != nil {
 		t.Fatal(err)
 	}
 	if cf == nil {
 		t.Fatal("NewRestClients returned nil")
 	}
+	assert.Equal(t, "https://api.cloudflare.com/client/v4", cf.BaseURL)
 }
 
 // func TestRestCFClientGetCFClientForDomain(t *testing.T) {
@@ -52,3 +75,33 @@ func TestRestCFClientWithoutZoneID(t *testing.T) {
 // 	}
 
 // }
+
+func TestWithCredentials(t *testing.T) {
+	_log := zerolog.Nop()
+	cfc := NewCFController(&_log)
+	cfg := types.CFControllerConfig{}
+	cfg.CloudFlare.ApiToken = "root-token"
+	cfg.CloudFlare.AccountId = "root-account"
+	cfc.SetCfg(&cfg)
+
+	teamA := cfc.WithCredentials(&types.CFCredentials{Secret: "a/cf", ApiToken: "a-token", AccountId: "a-account"})
+	assert.Equal(t, "a-account", teamA.Cfg().CloudFlare.AccountId)
+	assert.Equal(t, "a-token", teamA.Cfg().CloudFlare.ApiToken)
+	assert.Equal(t, "root-account", cfc.Cfg().CloudFlare.AccountId)
+	rest := teamA.Rest().(*RestClients)
+	assert.Equal(t, "a-token", rest.apiToken())
+	assert.Equal(t, "a-account", rest.accountId())
+	assert.Equal(t, "root-token", cfc.Rest().(*RestClients).apiToken())
+
+	// the clients are cached per credentials Secret
+	assert.Same(t, rest, cfc.WithCredentials(&types.CFCredentials{Secret: "a/cf", ApiToken: "a-token", AccountId: "a-account"}).Rest())
+	assert.Same(t, rest, teamA.WithComponent("x").Rest())
+	teamB := cfc.WithCredentials(&types.CFCredentials{Secret: "b/cf", ApiToken: "b-token", AccountId: "b-account"})
+	assert.NotSame(t, rest, teamB.Rest())
+
+	// a changed Secret replaces the clients
+	rotated := cfc.WithCredentials(&types.CFCredentials{Secret: "a/cf", ApiToken: "a-token2", AccountId: "a-account"})
+	assert.NotSame(t, rest, rotated.Rest())
+	assert.Error(t, rest.ctx().Err())
+	assert.Equal(t, "a-token2", rotated.Rest().(*RestClients).apiToken())
+}
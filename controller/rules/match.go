@@ -0,0 +1,117 @@
+package rules
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/mabels/cloudflared-controller/controller/types"
+)
+
+// RuleRef points to a rule of the merged tunnel config
+type RuleRef struct {
+	Index int                   `json:"index"`
+	Key   string                `json:"key"`
+	Rule  types.CFConfigIngress `json:"rule"`
+}
+
+type ShadowedRule struct {
+	RuleRef
+	By RuleRef `json:"by"`
+}
+
+// MatchReport answers which rule of a tunnel serves an URL
+type MatchReport struct {
+	Tunnel   string         `json:"tunnel,omitempty"`
+	URL      string         `json:"url"`
+	Match    *RuleRef       `json:"match,omitempty"`
+	Rules    []RuleRef      `json:"rules"`
+	Shadowed []ShadowedRule `json:"shadowed"`
+}
+
+func ref(rules []SourcedRule, idx int) RuleRef {
+	return RuleRef{Index: idx, Key: rules[idx].Key, Rule: rules[idx].Rule}
+}
+
+// the same as cloudflared ingress.matchHost
+func matchHost(ruleHost, reqHost string) bool {
+	if ruleHost == "" || ruleHost == "*" || ruleHost == reqHost {
+		return true
+	}
+	if strings.HasPrefix(ruleHost, "*.") {
+		return strings.HasSuffix(reqHost, strings.TrimPrefix(ruleHost, "*"))
+	}
+	return false
+}
+
+// Matches reports if the rule serves the hostname and path like cloudflared does
+func Matches(rule types.CFConfigIngress, hostname, path string) (bool, error) {
+	if !matchHost(rule.Hostname, hostname) {
+		return false, nil
+	}
+	if rule.Path == "" {
+		return true, nil
+	}
+	re, err := regexp.Compile(rule.Path)
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(path), nil
+}
+
+// Match returns the index of the first rule serving the url or -1
+func Match(rules []SourcedRule, rawURL string) (int, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "https://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return -1, err
+	}
+	for i, r := range rules {
+		ok, err := Matches(r.Rule, u.Hostname(), u.Path)
+		if err != nil {
+			return -1, fmt.Errorf("rule #%d from %s: %v", i+1, r.Key, err)
+		}
+		if ok {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
+
+// ShadowedRules returns every rule which is shadowed by an earlier rule,
+// the final catch-all is not reported.
+func ShadowedRules(rules []SourcedRule) []ShadowedRule {
+	ret := []ShadowedRule{}
+	for i := 0; i < len(rules)-1; i++ {
+		for j := 0; j < i; j++ {
+			if Shadows(rules[j].Rule, rules[i].Rule) {
+				ret = append(ret, ShadowedRule{RuleRef: ref(rules, i), By: ref(rules, j)})
+				break
+			}
+		}
+	}
+	return ret
+}
+
+func Explain(rules []SourcedRule, rawURL string) (*MatchReport, error) {
+	idx, err := Match(rules, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	ret := &MatchReport{
+		URL:      rawURL,
+		Rules:    make([]RuleRef, 0, len(rules)),
+		Shadowed: ShadowedRules(rules),
+	}
+	for i := range rules {
+		ret.Rules = append(ret.Rules, ref(rules, i))
+	}
+	if idx >= 0 {
+		m := ref(rules, idx)
+		ret.Match = &m
+	}
+	return ret, nil
+}
@@ -0,0 +1,49 @@
+package rules
+
+import (
+	"testing"
+
+	"github.com/mabels/cloudflared-controller/controller/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	rules := []SourcedRule{
+		{Key: "ingress-default-a", Rule: types.CFConfigIngress{Hostname: "a.example.com", Path: "^/api", Service: "http://a:80"}},
+		{Key: "ingress-default-b", Rule: types.CFConfigIngress{Hostname: "a.example.com", Service: "http://b:80"}},
+		{Key: "svc-default-c", Rule: types.CFConfigIngress{Hostname: "*.example.com", Service: "http://c:80"}},
+		catchAll(),
+	}
+	for url, idx := range map[string]int{
+		"https://a.example.com/api/v1":  0,
+		"https://a.example.com/v1/api":  1,
+		"a.example.com:8443/api":        0,
+		"http://b.example.com/":         2,
+		"https://example.com/":          3,
+		"https://x.a.example.com/api/x": 2,
+	} {
+		i, err := Match(rules, url)
+		assert.NoError(t, err, url)
+		assert.Equal(t, idx, i, url)
+	}
+	i, err := Match(rules[:3], "https://other.com")
+	assert.NoError(t, err)
+	assert.Equal(t, -1, i)
+}
+
+func TestExplain(t *testing.T) {
+	rules := []SourcedRule{
+		{Key: "ingress-default-a", Rule: types.CFConfigIngress{Hostname: "a.example.com", Path: "/", Service: "http://a:80"}},
+		{Key: "ingress-default-b", Rule: types.CFConfigIngress{Hostname: "a.example.com", Path: "/api", Service: "http://b:80"}},
+		catchAll(),
+	}
+	report, err := Explain(rules, "https://a.example.com/api")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, report.Match.Index)
+	assert.Equal(t, "ingress-default-a", report.Match.Key)
+	assert.Len(t, report.Rules, 3)
+	assert.Equal(t, []ShadowedRule{{
+		RuleRef: RuleRef{Index: 1, Key: "ingress-default-b", Rule: rules[1].Rule},
+		By:      RuleRef{Index: 0, Key: "ingress-default-a", Rule: rules[0].Rule},
+	}}, report.Shadowed)
+}
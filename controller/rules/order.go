@@ -0,0 +1,82 @@
+package rules
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/mabels/cloudflared-controller/controller/types"
+)
+
+func priority(rule types.CFConfigIngress) int {
+	if rule.Meta == nil {
+		return 0
+	}
+	return rule.Meta.Priority
+}
+
+// hostClass orders exact hostnames before wildcards before rules without hostname
+func hostClass(hostname string) int {
+	switch {
+	case hostname == "" || hostname == "*":
+		return 2
+	case strings.HasPrefix(hostname, "*"):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// lessPath is true if path a is more specific than path b, the empty path
+// matches everything and is the least specific.
+func lessPath(a, b string) bool {
+	if a == b {
+		return false
+	}
+	if a == "" || b == "" {
+		return b == ""
+	}
+	aAnchored, aPrefix, _ := literalPath(a)
+	bAnchored, bPrefix, _ := literalPath(b)
+	if len(aPrefix) != len(bPrefix) {
+		return len(aPrefix) > len(bPrefix)
+	}
+	if aAnchored != bAnchored {
+		return aAnchored
+	}
+	// an Exact path before the Prefix of the same path
+	_, aExact, _ := pathForm(a)
+	_, bExact, _ := pathForm(b)
+	if aExact != bExact {
+		return aExact
+	}
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a < b
+}
+
+// Sort orders the rules deterministically. The rule-priority of the source
+// object wins, then exact hostnames go before wildcards, more specific paths
+// before shorter ones and finally the source key decides.
+func Sort(rules []SourcedRule) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		a, b := rules[i].Rule, rules[j].Rule
+		if priority(a) != priority(b) {
+			return priority(a) > priority(b)
+		}
+		if hostClass(a.Hostname) != hostClass(b.Hostname) {
+			return hostClass(a.Hostname) < hostClass(b.Hostname)
+		}
+		if hostClass(a.Hostname) == 1 && len(a.Hostname) != len(b.Hostname) {
+			// *.a.example.com before *.example.com
+			return len(a.Hostname) > len(b.Hostname)
+		}
+		if a.Path != b.Path {
+			return lessPath(a.Path, b.Path)
+		}
+		if rules[i].Key != rules[j].Key {
+			return rules[i].Key < rules[j].Key
+		}
+		return a.Hostname < b.Hostname
+	})
+}
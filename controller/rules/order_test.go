@@ -0,0 +1,98 @@
+package rules
+
+import (
+	"testing"
+
+	"github.com/mabels/cloudflared-controller/controller/types"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func keysAndPaths(rules []SourcedRule) []string {
+	ret := []string{}
+	for _, r := range rules {
+		ret = append(ret, r.Key+":"+r.Rule.Hostname+r.Rule.Path)
+	}
+	return ret
+}
+
+func TestSort(t *testing.T) {
+	rules := []SourcedRule{
+		{Key: "ingress-default-a", Rule: types.CFConfigIngress{Hostname: "a.example.com", Path: "/", Service: "http://a:80"}},
+		{Key: "svc-default-z", Rule: types.CFConfigIngress{Hostname: "*.example.com", Service: "http://z:80"}},
+		{Key: "svc-default-y", Rule: types.CFConfigIngress{Hostname: "*.b.example.com", Service: "http://y:80"}},
+		{Key: "ingress-default-b", Rule: types.CFConfigIngress{Hostname: "a.example.com", Path: "/api", Service: "http://b:80"}},
+		{Key: "ingress-default-c", Rule: types.CFConfigIngress{Hostname: "a.example.com", Service: "http://c:80"}},
+		{Key: "ingress-default-d", Rule: types.CFConfigIngress{Hostname: "a.example.com", Path: "^/api", Service: "http://d:80"}},
+		{Key: "svc-default-x", Rule: types.CFConfigIngress{Hostname: "x.example.com", Service: "http://x:80"}},
+	}
+	Sort(rules)
+	assert.Equal(t, []string{
+		"ingress-default-d:a.example.com^/api",
+		"ingress-default-b:a.example.com/api",
+		"ingress-default-a:a.example.com/",
+		"ingress-default-c:a.example.com",
+		"svc-default-x:x.example.com",
+		"svc-default-y:*.b.example.com",
+		"svc-default-z:*.example.com",
+	}, keysAndPaths(rules))
+	assert.Empty(t, Validate(append(rules, catchAll())))
+}
+
+func TestSortPathTypes(t *testing.T) {
+	rules := []SourcedRule{
+		{Key: "ingress-default-a", Rule: types.CFConfigIngress{Hostname: "a.example.com", Path: `^/`, Service: "http://a:80"}},
+		{Key: "ingress-default-b", Rule: types.CFConfigIngress{Hostname: "a.example.com", Path: `^/api(/|$)`, Service: "http://b:80"}},
+		{Key: "ingress-default-c", Rule: types.CFConfigIngress{Hostname: "a.example.com", Path: `^/api$`, Service: "http://c:80"}},
+		{Key: "ingress-default-d", Rule: types.CFConfigIngress{Hostname: "a.example.com", Path: `^/api/v1(/|$)`, Service: "http://d:80"}},
+	}
+	Sort(rules)
+	assert.Equal(t, []string{
+		"ingress-default-d:a.example.com^/api/v1(/|$)",
+		"ingress-default-c:a.example.com^/api$",
+		"ingress-default-b:a.example.com^/api(/|$)",
+		"ingress-default-a:a.example.com^/",
+	}, keysAndPaths(rules))
+	assert.Empty(t, Validate(append(rules, catchAll())))
+}
+
+func TestSortPriority(t *testing.T) {
+	rules := []SourcedRule{
+		{Key: "ingress-default-a", Rule: types.CFConfigIngress{Hostname: "a.example.com", Path: "/api", Service: "http://a:80"}},
+		{Key: "ingress-default-b", Rule: types.CFConfigIngress{Hostname: "*.example.com", Service: "http://b:80",
+			Meta: &types.CFConfigIngressMeta{Priority: 10}}},
+		{Key: "ingress-default-c", Rule: types.CFConfigIngress{Hostname: "a.example.com", Service: "http://c:80",
+			Meta: &types.CFConfigIngressMeta{Priority: -1}}},
+	}
+	Sort(rules)
+	assert.Equal(t, []string{
+		"ingress-default-b:*.example.com",
+		"ingress-default-a:a.example.com/api",
+		"ingress-default-c:a.example.com",
+	}, keysAndPaths(rules))
+}
+
+func TestBuildIsDeterministic(t *testing.T) {
+	log := zerolog.Nop()
+	cm := &corev1.ConfigMap{
+		Data: map[string]string{
+			"ingress-default-a": "- hostname: a.example.com\n  path: /\n  service: http://a:80\n",
+			"ingress-default-b": "- hostname: a.example.com\n  path: /api\n  service: http://b:80\n  meta:\n    priority: 0\n",
+			"ingress-default-c": "- hostname: c.example.com\n  service: http://c:80\n  meta:\n    priority: 5\n",
+		},
+	}
+	first := Build(&log, cm)
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, first, Build(&log, cm))
+	}
+	assert.Equal(t, []string{
+		"ingress-default-c:c.example.com",
+		"ingress-default-b:a.example.com/api",
+		"ingress-default-a:a.example.com/",
+		CatchAllKey + ":",
+	}, keysAndPaths(first))
+	for _, rule := range Ingress(first) {
+		assert.Nil(t, rule.Meta)
+	}
+}
@@ -0,0 +1,94 @@
+package rules
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mabels/cloudflared-controller/controller/config"
+	"github.com/mabels/cloudflared-controller/controller/types"
+	"github.com/mabels/cloudflared-controller/utils"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// SourcedRoute is a private route of a tunnel ConfigMap together with the
+// data key it was read from
+type SourcedRoute struct {
+	Key   string
+	Route types.CFPrivateRoute
+}
+
+// key of the routes from the private-route annotation of the ConfigMap
+const ConfigMapRoutesKey = "configmap"
+
+func isPrivateRoutesKey(key string) bool {
+	return strings.HasPrefix(key, types.PrivateRoutesKeyPrefix)
+}
+
+// PrivateRoutes returns the routes of all Services of a tunnel ConfigMap
+// and of its own private-route annotation, sorted and without duplicates
+func PrivateRoutes(log *zerolog.Logger, cm *corev1.ConfigMap) []SourcedRoute {
+	ret := []SourcedRoute{}
+	// value index in ret
+	seen := make(map[types.CFPrivateRoute]int)
+	add := func(key string, route types.CFPrivateRoute) {
+		network := types.CFPrivateRoute{Network: route.Network, VirtualNetwork: route.VirtualNetwork}
+		if idx, found := seen[network]; found {
+			// a duplicate still protects the tunnel
+			ret[idx].Route.DeletionProtection = ret[idx].Route.DeletionProtection || route.DeletionProtection
+			return
+		}
+		seen[network] = len(ret)
+		ret = append(ret, SourcedRoute{Key: key, Route: route})
+	}
+	keys := make([]string, 0, len(cm.Data))
+	for key := range cm.Data {
+		if isPrivateRoutesKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	// the first key of a duplicate route wins
+	sort.Strings(keys)
+	for _, key := range keys {
+		data := cm.Data[key]
+		routes := []types.CFPrivateRoute{}
+		err := yaml.Unmarshal([]byte(data), &routes)
+		if err != nil {
+			log.Error().Err(err).Str("key", key).Str("routes", data).Msg("error unmarshalling private routes")
+			continue
+		}
+		for _, route := range routes {
+			add(strings.TrimPrefix(key, types.PrivateRoutesKeyPrefix), route)
+		}
+	}
+	if value, found := cm.Annotations[config.AnnotationCloudflarePrivateRoute()]; found {
+		networks, err := utils.ParsePrivateRoute(value, nil)
+		if err != nil {
+			log.Error().Err(err).Str("configMap", cm.Name).Msg("Invalid private-route annotation")
+		}
+		for _, network := range networks {
+			add(ConfigMapRoutesKey, types.CFPrivateRoute{
+				Network:        network,
+				VirtualNetwork: cm.Annotations[config.AnnotationCloudflareVirtualNetwork()],
+			})
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].Route.VirtualNetwork != ret[j].Route.VirtualNetwork {
+			return ret[i].Route.VirtualNetwork < ret[j].Route.VirtualNetwork
+		}
+		return ret[i].Route.Network < ret[j].Route.Network
+	})
+	return ret
+}
+
+// WarpRouting is true if the tunnel has private routes or its ConfigMap
+// enables them with private-route: true
+func WarpRouting(log *zerolog.Logger, cm *corev1.ConfigMap) bool {
+	if enabled, err := strconv.ParseBool(strings.TrimSpace(cm.Annotations[config.AnnotationCloudflarePrivateRoute()])); err == nil && enabled {
+		return true
+	}
+	return len(PrivateRoutes(log, cm)) > 0
+}
@@ -0,0 +1,47 @@
+package rules
+
+import (
+	"testing"
+
+	"github.com/mabels/cloudflared-controller/controller/types"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPrivateRoutes(t *testing.T) {
+	log := zerolog.Nop()
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				"cloudflare.com/private-route": "10.0.0.0/8",
+			},
+		},
+		Data: map[string]string{
+			"ingress-default-a": "- hostname: a.example.com\n  service: http://a:80\n",
+			"private-routes.service-default-b": "- network: 10.43.0.1/32\n  virtualNetwork: staging\n" +
+				"- network: 10.0.0.0/8\n",
+			"private-routes.service-default-c": "- network: 10.43.0.2/32\n",
+		},
+	}
+	assert.Equal(t, []SourcedRoute{
+		{Key: "service-default-b", Route: types.CFPrivateRoute{Network: "10.0.0.0/8"}},
+		{Key: "service-default-c", Route: types.CFPrivateRoute{Network: "10.43.0.2/32"}},
+		{Key: "service-default-b", Route: types.CFPrivateRoute{Network: "10.43.0.1/32", VirtualNetwork: "staging"}},
+	}, PrivateRoutes(&log, cm))
+	assert.True(t, WarpRouting(&log, cm))
+	// route keys are not rules
+	assert.Len(t, FromConfigMap(&log, cm), 1)
+
+	cm = &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				"cloudflare.com/private-route": "true",
+			},
+		},
+	}
+	assert.Len(t, PrivateRoutes(&log, cm), 0)
+	assert.True(t, WarpRouting(&log, cm))
+	assert.False(t, WarpRouting(&log, &corev1.ConfigMap{}))
+}
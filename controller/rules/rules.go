@@ -0,0 +1,68 @@
+package rules
+
+import (
+	"github.com/mabels/cloudflared-controller/controller/config"
+	"github.com/mabels/cloudflared-controller/controller/types"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// SourcedRule is a rule of a tunnel ConfigMap together with the data key
+// (cmKey) of the Ingress or Service it was generated from.
+type SourcedRule struct {
+	Key  string
+	Rule types.CFConfigIngress
+}
+
+// key of the catch-all rule which is added by the controller
+const CatchAllKey = "catch-all"
+
+// FromConfigMap merges the rules of all data keys of a tunnel ConfigMap
+func FromConfigMap(log *zerolog.Logger, cm *corev1.ConfigMap) []SourcedRule {
+	ret := []SourcedRule{}
+	for key, rules := range cm.Data {
+		if isPrivateRoutesKey(key) {
+			continue
+		}
+		rule := []types.CFConfigIngress{}
+		err := yaml.Unmarshal([]byte(rules), &rule)
+		if err != nil {
+			log.Error().Err(err).Str("key", key).Str("rules", rules).Msg("error unmarshalling rules")
+			continue
+		}
+		for _, r := range rule {
+			ret = append(ret, SourcedRule{Key: key, Rule: r})
+		}
+	}
+	return ret
+}
+
+// the service of the catch-all rule without tunnel-fallback annotation
+const defaultFallback = "http_status:404"
+
+// Build returns the rules of a tunnel ConfigMap in the order they are
+// rendered into the cloudflared config, including the final catch-all rule.
+func Build(log *zerolog.Logger, cm *corev1.ConfigMap) []SourcedRule {
+	ret := FromConfigMap(log, cm)
+	Sort(ret)
+	fallback, found := cm.Annotations[config.AnnotationCloudflareTunnelFallback()]
+	if !found || fallback == "" {
+		fallback = defaultFallback
+	}
+	return append(ret, SourcedRule{
+		Key:  CatchAllKey,
+		Rule: types.CFConfigIngress{Service: fallback},
+	})
+}
+
+// Ingress returns the rules without the controller only metadata
+func Ingress(rules []SourcedRule) []types.CFConfigIngress {
+	ret := make([]types.CFConfigIngress, 0, len(rules))
+	for _, r := range rules {
+		rule := r.Rule
+		rule.Meta = nil
+		ret = append(ret, rule)
+	}
+	return ret
+}
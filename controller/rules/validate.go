@@ -0,0 +1,201 @@
+package rules
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mabels/cloudflared-controller/controller/types"
+)
+
+// RuleError reports an invalid rule and the ConfigMap data key it came from
+type RuleError struct {
+	Key   string
+	Index int
+	Rule  types.CFConfigIngress
+	Err   error
+}
+
+func (e RuleError) Error() string {
+	return fmt.Sprintf("rule #%d(%s) from %s: %v", e.Index+1, e.Rule.Hostname, e.Key, e.Err)
+}
+
+// the same checks as cloudflared does in ingress.validateIngress
+func validateService(service string) error {
+	switch {
+	case strings.HasPrefix(service, "unix:"), strings.HasPrefix(service, "unix+tls:"):
+		return nil
+	case strings.HasPrefix(service, "http_status:"):
+		code, err := strconv.Atoi(strings.TrimPrefix(service, "http_status:"))
+		if err != nil {
+			return fmt.Errorf("invalid HTTP status code: %v", err)
+		}
+		if code < 100 || code > 999 {
+			return fmt.Errorf("invalid HTTP status code: %d", code)
+		}
+		return nil
+	case service == "hello_world", service == "hello-world",
+		service == "socks-proxy", service == "bastion":
+		return nil
+	}
+	u, err := url.Parse(service)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" || u.Hostname() == "" {
+		return fmt.Errorf("%s is an invalid address, please make sure it has a scheme and a hostname", service)
+	}
+	if u.Path != "" {
+		return fmt.Errorf("%s is an invalid address, ingress rules don't support proxying to a different path on the origin service", service)
+	}
+	// any other scheme is proxied as a TCP stream
+	return nil
+}
+
+func isCatchAll(rule types.CFConfigIngress) bool {
+	return (rule.Hostname == "" || rule.Hostname == "*") && rule.Path == ""
+}
+
+func validateHostname(rule types.CFConfigIngress, idx, total int) error {
+	if _, _, err := net.SplitHostPort(rule.Hostname); err == nil {
+		return fmt.Errorf("hostname cannot contain a port")
+	}
+	if strings.LastIndex(rule.Hostname, "*") > 0 {
+		return fmt.Errorf(`hostname patterns can have at most one wildcard character ("*") and it can only be used for subdomains, e.g. "*.example.com"`)
+	}
+	last := idx == total-1
+	if last && !isCatchAll(rule) {
+		return fmt.Errorf("the last ingress rule must match all URLs (i.e. it should not have a hostname or path filter)")
+	}
+	if !last && isCatchAll(rule) {
+		return fmt.Errorf("rule is matching every hostname, the rules which follow it will never be triggered")
+	}
+	return nil
+}
+
+func hostCovers(earlier, later string) bool {
+	if earlier == "" || earlier == "*" || earlier == later {
+		return true
+	}
+	if strings.HasPrefix(earlier, "*.") {
+		return strings.HasSuffix(later, strings.TrimPrefix(earlier, "*"))
+	}
+	return false
+}
+
+// literalPath splits a path regex into its anchor and its literal prefix,
+// complete is true if the regex has no other operators.
+func literalPath(path string) (anchored bool, prefix string, complete bool) {
+	anchored = strings.HasPrefix(path, "^")
+	re, err := regexp.Compile(strings.TrimPrefix(path, "^"))
+	if err != nil {
+		return anchored, "", false
+	}
+	prefix, complete = re.LiteralPrefix()
+	return anchored, prefix, complete
+}
+
+// pathForm detects the regexes of the Exact (^lit$) and Prefix (^lit(/|$))
+// pathTypes of an Ingress and returns their literal path.
+func pathForm(path string) (lit string, exact bool, segment bool) {
+	if !strings.HasPrefix(path, "^") {
+		return "", false, false
+	}
+	var inner string
+	switch {
+	case strings.HasSuffix(path, "(/|$)"):
+		inner = strings.TrimSuffix(path[1:], "(/|$)")
+		segment = true
+	case strings.HasSuffix(path, "$"):
+		inner = strings.TrimSuffix(path[1:], "$")
+		exact = true
+	default:
+		return "", false, false
+	}
+	re, err := regexp.Compile(inner)
+	if err != nil {
+		return "", false, false
+	}
+	lit, complete := re.LiteralPrefix()
+	if !complete || regexp.QuoteMeta(lit) != inner {
+		return "", false, false
+	}
+	return lit, exact, segment
+}
+
+// pathCovers is true if every path matched by later is matched by earlier.
+// It only detects the cases which can be decided from the literal prefixes.
+func pathCovers(earlier, later string) bool {
+	if earlier == "" || earlier == later {
+		return true
+	}
+	if later == "" {
+		return false
+	}
+	if eLit, eExact, eSegment := pathForm(earlier); eExact {
+		return false
+	} else if eSegment {
+		// ^/api(/|$) covers /api and everything below /api/
+		lLit, lExact, lSegment := pathForm(later)
+		if lExact || lSegment {
+			return lLit == eLit || strings.HasPrefix(lLit, eLit+"/")
+		}
+		lAnchored, lPrefix, _ := literalPath(later)
+		return lAnchored && strings.HasPrefix(lPrefix, eLit+"/")
+	}
+	eAnchored, ePrefix, eComplete := literalPath(earlier)
+	if !eComplete {
+		return false
+	}
+	lAnchored, lPrefix, _ := literalPath(later)
+	if eAnchored {
+		return lAnchored && strings.HasPrefix(lPrefix, ePrefix)
+	}
+	return strings.Contains(lPrefix, ePrefix)
+}
+
+// Shadows reports if the earlier rule matches every request of the later rule
+func Shadows(earlier, later types.CFConfigIngress) bool {
+	return hostCovers(earlier.Hostname, later.Hostname) && pathCovers(earlier.Path, later.Path)
+}
+
+// Validate checks the rendered rules like cloudflared does on startup.
+// A shadowed rule is accepted by cloudflared, it is reported by Warnings.
+func Validate(rules []SourcedRule) []RuleError {
+	errs := []RuleError{}
+	for i, r := range rules {
+		fail := func(err error) {
+			errs = append(errs, RuleError{Key: r.Key, Index: i, Rule: r.Rule, Err: err})
+		}
+		if err := validateService(r.Rule.Service); err != nil {
+			fail(err)
+		}
+		if err := validateHostname(r.Rule, i, len(rules)); err != nil {
+			fail(err)
+		}
+		if r.Rule.Path != "" {
+			if _, err := regexp.Compile(r.Rule.Path); err != nil {
+				fail(fmt.Errorf("invalid path regex: %v", err))
+			}
+		}
+	}
+	return errs
+}
+
+// Warnings reports the rules which can never match because an earlier rule
+// matches all their requests.
+func Warnings(rules []SourcedRule) []RuleError {
+	errs := []RuleError{}
+	for _, s := range ShadowedRules(rules) {
+		errs = append(errs, RuleError{
+			Key:   s.Key,
+			Index: s.Index,
+			Rule:  s.Rule,
+			Err:   fmt.Errorf("shadowed by rule #%d(%s) from %s", s.By.Index+1, s.By.Rule.Hostname, s.By.Key),
+		})
+	}
+	return errs
+}
@@ -0,0 +1,157 @@
+package rules
+
+import (
+	"testing"
+
+	"github.com/mabels/cloudflared-controller/controller/config"
+	"github.com/mabels/cloudflared-controller/controller/types"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func sourced(key string, rules ...types.CFConfigIngress) []SourcedRule {
+	ret := []SourcedRule{}
+	for _, r := range rules {
+		ret = append(ret, SourcedRule{Key: key, Rule: r})
+	}
+	return ret
+}
+
+func catchAll() SourcedRule {
+	return SourcedRule{Key: CatchAllKey, Rule: types.CFConfigIngress{Service: "http_status:404"}}
+}
+
+func TestBuild(t *testing.T) {
+	log := zerolog.Nop()
+	rules := Build(&log, &corev1.ConfigMap{
+		Data: map[string]string{
+			"ingress-default-a": "- hostname: a.example.com\n  service: http://a:80\n",
+			"ingress-default-b": "broken: [",
+		},
+	})
+	assert.Equal(t, []SourcedRule{
+		{Key: "ingress-default-a", Rule: types.CFConfigIngress{Hostname: "a.example.com", Service: "http://a:80"}},
+		catchAll(),
+	}, rules)
+	assert.Empty(t, Validate(rules))
+}
+
+func TestValidateService(t *testing.T) {
+	assert.NoError(t, validateService("http://svc.ns:80"))
+	assert.NoError(t, validateService("https://svc.ns"))
+	assert.NoError(t, validateService("tcp://svc.ns:5432"))
+	assert.NoError(t, validateService("unix:/tmp/socket"))
+	assert.NoError(t, validateService("http_status:404"))
+	assert.NoError(t, validateService("hello_world"))
+	assert.Error(t, validateService("http_status:42"))
+	assert.Error(t, validateService("http_status:abc"))
+	assert.Error(t, validateService("svc.ns:80"))
+	assert.Error(t, validateService("http://svc.ns:80/path"))
+	assert.Error(t, validateService("http://:80"))
+	// cloudflared accepts every scheme
+	assert.NoError(t, validateService("gopher://svc.ns:70"))
+	assert.NoError(t, validateService("foo://svc.ns:1234"))
+}
+
+func TestValidateRules(t *testing.T) {
+	rules := append(sourced("ingress-default-a",
+		types.CFConfigIngress{Hostname: "a.example.com:443", Service: "http://a:80"},
+		types.CFConfigIngress{Hostname: "a.*.example.com", Service: "http://a:80"},
+		types.CFConfigIngress{Hostname: "b.example.com", Path: "/(api", Service: "http://b:80"},
+		types.CFConfigIngress{Hostname: "c.example.com", Service: "c"},
+	), catchAll())
+	errs := Validate(rules)
+	assert.Len(t, errs, 4)
+	for i, err := range errs {
+		assert.Equal(t, "ingress-default-a", err.Key)
+		assert.Equal(t, i, err.Index)
+	}
+}
+
+func TestValidateCatchAll(t *testing.T) {
+	errs := Validate(sourced("ingress-default-a",
+		types.CFConfigIngress{Service: "http://a:80"},
+		types.CFConfigIngress{Hostname: "a.example.com", Service: "http://a:80"},
+	))
+	assert.Len(t, errs, 2)
+	assert.Contains(t, errs[0].Error(), "matching every hostname")
+	assert.Contains(t, errs[1].Error(), "must match all URLs")
+}
+
+func TestValidateShadowed(t *testing.T) {
+	rules := sourced("ingress-default-a",
+		types.CFConfigIngress{Hostname: "a.example.com", Path: "^/api", Service: "http://a:80"},
+		types.CFConfigIngress{Hostname: "*.example.com", Service: "http://a:80"},
+	)
+	rules = append(rules, sourced("svc-default-b",
+		types.CFConfigIngress{Hostname: "a.example.com", Path: "^/api", Service: "http://b:80"},
+		types.CFConfigIngress{Hostname: "a.example.com", Path: "^/api/v1", Service: "http://b:80"},
+		types.CFConfigIngress{Hostname: "a.example.com", Path: "^/ap", Service: "http://b:80"},
+		types.CFConfigIngress{Hostname: "b.example.com", Path: "/x", Service: "http://b:80"},
+		types.CFConfigIngress{Hostname: "a.b.example.com", Path: "/x", Service: "http://b:80"},
+	)...)
+	rules = append(rules, catchAll())
+	assert.Empty(t, Validate(rules))
+	errs := Warnings(rules)
+	assert.Len(t, errs, 5)
+	for _, err := range errs {
+		assert.Equal(t, "svc-default-b", err.Key)
+	}
+	assert.Equal(t, []int{2, 3, 4, 5, 6}, []int{errs[0].Index, errs[1].Index, errs[2].Index, errs[3].Index, errs[4].Index})
+	assert.Contains(t, errs[0].Error(), "shadowed by rule #1(a.example.com) from ingress-default-a")
+	assert.Contains(t, errs[2].Error(), "shadowed by rule #2(*.example.com) from ingress-default-a")
+}
+
+func TestPathCovers(t *testing.T) {
+	assert.True(t, pathCovers("", "^/api"))
+	assert.True(t, pathCovers("^/api", "^/api/v1"))
+	assert.True(t, pathCovers("/api", "^/v1/api"))
+	assert.True(t, pathCovers("api", "^/v1/api.*"))
+	assert.False(t, pathCovers("^/api", "/api"))
+	assert.False(t, pathCovers("^/api", ""))
+	assert.False(t, pathCovers("^/api$", "^/api/v1"))
+	assert.False(t, pathCovers("^/v[12]", "^/v1"))
+}
+
+func TestPathCoversPathTypes(t *testing.T) {
+	// Prefix /api
+	assert.True(t, pathCovers(`^/api(/|$)`, `^/api$`))
+	assert.True(t, pathCovers(`^/api(/|$)`, `^/api/v1(/|$)`))
+	assert.True(t, pathCovers(`^/api(/|$)`, `^/api/v1`))
+	assert.False(t, pathCovers(`^/api(/|$)`, `^/apiary(/|$)`))
+	assert.False(t, pathCovers(`^/api(/|$)`, `^/api.*`))
+	assert.False(t, pathCovers(`^/api(/|$)`, `/api/v1`))
+	// Exact /api
+	assert.False(t, pathCovers(`^/api$`, `^/api(/|$)`))
+	assert.False(t, pathCovers(`^/api$`, `^/api/v1$`))
+	assert.True(t, pathCovers(`^/`, `^/api$`))
+	assert.True(t, pathCovers(`^/api`, `^/api(/|$)`))
+}
+
+func TestPathForm(t *testing.T) {
+	lit, exact, segment := pathForm(`^/a\.b$`)
+	assert.Equal(t, []interface{}{"/a.b", true, false}, []interface{}{lit, exact, segment})
+	lit, exact, segment = pathForm(`^/a\.b(/|$)`)
+	assert.Equal(t, []interface{}{"/a.b", false, true}, []interface{}{lit, exact, segment})
+	_, exact, segment = pathForm(`^/a.b$`)
+	assert.False(t, exact || segment)
+	_, exact, segment = pathForm(`/api$`)
+	assert.False(t, exact || segment)
+}
+
+func TestBuildFallback(t *testing.T) {
+	log := zerolog.Nop()
+	rules := Build(&log, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				config.AnnotationCloudflareTunnelFallback(): "http://errors.default:8080",
+			},
+		},
+	})
+	assert.Equal(t, []SourcedRule{
+		{Key: CatchAllKey, Rule: types.CFConfigIngress{Service: "http://errors.default:8080"}},
+	}, rules)
+	assert.Empty(t, Validate(rules))
+}
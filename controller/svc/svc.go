@@ -87,6 +87,30 @@ func mappingFromPorts(ports []corev1.ServicePort) []types.SvcAnnotationMapping {
 	return []types.SvcAnnotationMapping{}
 }
 
+// privateRoutes are the networks of the private-route annotation
+func privateRoutes(svc *corev1.Service) ([]types.CFPrivateRoute, error) {
+	value, found := svc.Annotations[config.AnnotationCloudflarePrivateRoute()]
+	if !found {
+		return nil, nil
+	}
+	clusterIPs := svc.Spec.ClusterIPs
+	if len(clusterIPs) == 0 && svc.Spec.ClusterIP != "" {
+		clusterIPs = []string{svc.Spec.ClusterIP}
+	}
+	networks, err := utils.ParsePrivateRoute(value, clusterIPs)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]types.CFPrivateRoute, 0, len(networks))
+	for _, network := range networks {
+		ret = append(ret, types.CFPrivateRoute{
+			Network:        network,
+			VirtualNetwork: svc.Annotations[config.AnnotationCloudflareVirtualNetwork()],
+		})
+	}
+	return ret, nil
+}
+
 func updateConfigMap(_cfc types.CFController, svc *corev1.Service) error {
 	cfc := _cfc.WithComponent("watchSvc", func(cfc types.CFController) {
 		log := cfc.Log().With().Str("svc", svc.Name).Logger()
@@ -95,11 +119,13 @@ func updateConfigMap(_cfc types.CFController, svc *corev1.Service) error {
 
 	annotations := svc.GetAnnotations()
 	externalName, ok := annotations[config.AnnotationCloudflareTunnelExternalName()]
-	if !ok {
+	_, private := annotations[config.AnnotationCloudflarePrivateRoute()]
+	if !ok && !private {
 		//err := fmt.Errorf("does not have %s annotation", config.AnnotationCloudflareTunnelExternalName)
 		cfc.Log().Debug().Str("kind", svc.Kind).Str("name", svc.Name).
 			Msgf("skipping not cloudflared annotated(%s)", config.AnnotationCloudflareTunnelName())
 		cfc.K8sData().TunnelConfigMaps.RemoveConfigMap(cfc, "service", &svc.ObjectMeta)
+		cfc.K8sData().TunnelConfigMaps.RemovePrivateRoutes(cfc, "service", &svc.ObjectMeta)
 		return nil
 	}
 
@@ -108,6 +134,20 @@ func updateConfigMap(_cfc types.CFController, svc *corev1.Service) error {
 		cfc.Log().Error().Err(err).Msg("Failed to find tunnel param")
 		return err
 	}
+	routes, err := privateRoutes(svc)
+	if err != nil {
+		cfc.Log().Error().Err(err).Msg("Failed to parse private routes")
+		return err
+	}
+	err = cfc.K8sData().TunnelConfigMaps.UpsertPrivateRoutes(cfc, tparam, "service", &svc.ObjectMeta, routes)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// only reachable through WARP
+		cfc.K8sData().TunnelConfigMaps.RemoveConfigMap(cfc, "service", &svc.ObjectMeta)
+		return nil
+	}
 	// Mapping
 	// name/schema/path
 	// name is name of the port
@@ -239,6 +279,7 @@ func startServiceWatcher(cfc types.CFController, ns string) (watcherBindingServi
 			log.Debug().Str("uid", string(svc.GetUID())).Str("name", svc.Name).
 				Msgf("skipping not cloudflared annotated(%s)", config.AnnotationCloudflareTunnelName())
 			cfc.K8sData().TunnelConfigMaps.RemoveConfigMap(cfc, "service", &svc.ObjectMeta)
+			cfc.K8sData().TunnelConfigMaps.RemovePrivateRoutes(cfc, "service", &svc.ObjectMeta)
 			return
 		}
 		var err error
@@ -249,6 +290,7 @@ func startServiceWatcher(cfc types.CFController, ns string) (watcherBindingServi
 			err = updateConfigMap(cfc, svc)
 		case watch.Deleted:
 			cfc.K8sData().TunnelConfigMaps.RemoveConfigMap(cfc, "service", &svc.ObjectMeta)
+			cfc.K8sData().TunnelConfigMaps.RemovePrivateRoutes(cfc, "service", &svc.ObjectMeta)
 		default:
 			log.Error().Msgf("Unknown event type: %s", ev.Type)
 		}
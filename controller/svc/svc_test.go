@@ -23,6 +23,8 @@ type mockUpsertCall struct {
 }
 type mockTunnelConfigMaps struct {
 	upsertCalls []mockUpsertCall
+	routes      []types.CFPrivateRoute
+	removeCalls int
 }
 
 func (*mockTunnelConfigMaps) Register(func([]*corev1.ConfigMap, watch.Event)) func() {
@@ -42,9 +44,21 @@ func (p *mockTunnelConfigMaps) UpsertConfigMap(cfc types.CFController, tparam *t
 	})
 	return nil
 }
-func (*mockTunnelConfigMaps) RemoveConfigMap(cfc types.CFController, kind string, meta *metav1.ObjectMeta) {
-	panic("implement me")
-
+func (p *mockTunnelConfigMaps) RemoveConfigMap(cfc types.CFController, kind string, meta *metav1.ObjectMeta) {
+	p.removeCalls++
+}
+func (p *mockTunnelConfigMaps) RemoveConfigMapExcept(cfc types.CFController, kind string, meta *metav1.ObjectMeta, keep []*types.CFTunnelParameter) {
+}
+func (p *mockTunnelConfigMaps) UpsertPrivateRoutes(cfc types.CFController, tparam *types.CFTunnelParameter, kind string, meta *metav1.ObjectMeta, routes []types.CFPrivateRoute) error {
+	if len(routes) == 0 {
+		p.RemovePrivateRoutes(cfc, kind, meta)
+		return nil
+	}
+	p.routes = append(p.routes, routes...)
+	return nil
+}
+func (p *mockTunnelConfigMaps) RemovePrivateRoutes(cfc types.CFController, kind string, meta *metav1.ObjectMeta) {
+	p.routes = nil
 }
 
 type mockController struct {
@@ -53,6 +67,10 @@ type mockController struct {
 	tunnelConfigMaps mockTunnelConfigMaps
 }
 
+func (p *mockController) WithCredentials(creds *types.CFCredentials) types.CFController {
+	return p
+}
+
 func (p *mockController) WithComponent(component string, fns ...func(types.CFController)) types.CFController {
 	return p
 }
@@ -77,6 +95,10 @@ func (*mockController) SetCfg(*types.CFControllerConfig) {
 func (*mockController) Rest() types.RestClients {
 	panic("implement me")
 }
+func (mockController) Plan() *types.Plan {
+	return &types.Plan{}
+}
+
 func (p *mockController) K8sData() *types.K8sData {
 	return &types.K8sData{
 		TunnelConfigMaps: &p.tunnelConfigMaps,
@@ -511,3 +533,51 @@ func TestSimpleSVC(t *testing.T) {
 			},
 		}}, cf.tunnelConfigMaps.upsertCalls[0].cfcis)
 }
+
+func TestPrivateRouteOnlyUpdateConfigMap(t *testing.T) {
+	_log := zerolog.New(os.Stderr).With().Timestamp().Logger()
+	cf := &mockController{
+		log: &_log,
+		cfg: &types.CFControllerConfig{
+			CloudFlare: types.CFControllerCloudflareConfig{
+				TunnelConfigMapNamespace: "what",
+			},
+		},
+	}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "what-tech",
+			Namespace: "what",
+			Annotations: map[string]string{
+				"cloudflare.com/tunnel-name":     "what.tech",
+				"cloudflare.com/private-route":   "true",
+				"cloudflare.com/virtual-network": "staging",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			ClusterIP:  "10.43.94.217",
+			ClusterIPs: []string{"10.43.94.217"},
+			Ports: []corev1.ServicePort{
+				{
+					Name:       "http",
+					Port:       80,
+					Protocol:   "TCP",
+					TargetPort: intstr.FromString("http"),
+				},
+			},
+		},
+	}
+	err := updateConfigMap(cf, svc)
+	assert.NoError(t, err)
+	assert.Len(t, cf.tunnelConfigMaps.upsertCalls, 0)
+	assert.Equal(t, 1, cf.tunnelConfigMaps.removeCalls)
+	assert.Equal(t, []types.CFPrivateRoute{{Network: "10.43.94.217/32", VirtualNetwork: "staging"}}, cf.tunnelConfigMaps.routes)
+
+	svc.Annotations["cloudflare.com/private-route"] = "10.43.0.0/16"
+	svc.Annotations["cloudflare.com/tunnel-external-name"] = "cft.what.tech"
+	cf.tunnelConfigMaps.routes = nil
+	err = updateConfigMap(cf, svc)
+	assert.NoError(t, err)
+	assert.Len(t, cf.tunnelConfigMaps.upsertCalls, 1)
+	assert.Equal(t, []types.CFPrivateRoute{{Network: "10.43.0.0/16", VirtualNetwork: "staging"}}, cf.tunnelConfigMaps.routes)
+}
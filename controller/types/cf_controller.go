@@ -8,6 +8,9 @@ import (
 
 type CFController interface {
 	WithComponent(component string, fns ...func(CFController)) CFController
+	// WithCredentials uses the Cloudflare account of creds instead of the
+	// one of the controller
+	WithCredentials(creds *CFCredentials) CFController
 	RegisterShutdown(sfn func()) func()
 	Shutdown() error
 	Log() *zerolog.Logger
@@ -16,6 +19,8 @@ type CFController interface {
 	SetCfg(*CFControllerConfig)
 	Rest() RestClients
 	K8sData() *K8sData
+	// Plan collects the calls skipped by the dry-run
+	Plan() *Plan
 	Context() context.Context
 	CancelFunc() context.CancelFunc
 	// shutdownFns   map[string]func()
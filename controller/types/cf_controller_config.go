@@ -7,6 +7,25 @@ type CFControllerCloudflareConfig struct {
 	ApiToken                 string
 	AccountId                string
 	TunnelConfigMapNamespace string
+	// local writes the ingress rules to the config.yaml of cloudflared,
+	// cloudflare pushes them to the remote tunnel configuration
+	ConfigSrc string
+	// the zones of the account are refreshed every ZoneCacheTTL, hostnames
+	// without zone are not looked up again for ZoneCacheNegativeTTL
+	ZoneCacheTTL         time.Duration
+	ZoneCacheNegativeTTL time.Duration
+	// the tunnel of a deleted tunnel ConfigMap is deleted after this delay
+	TunnelDeleteGrace time.Duration
+	// all API calls share one token bucket of RateLimit requests per second
+	RateLimit float64
+	RateBurst int
+	// 429 and 5xx responses are retried with exponential backoff or after
+	// the Retry-After header of the response
+	MaxRetries      int
+	RetryMinBackoff time.Duration
+	RetryMaxBackoff time.Duration
+	// timeout of a single attempt
+	RequestTimeout time.Duration
 	// ZoneId    string
 }
 
@@ -26,6 +45,9 @@ type CFControllerConfig struct {
 	ConfigMapLabelSelector string
 	CloudFlare             CFControllerCloudflareConfig
 	TestCreateAccess       bool
+	DebugAddr              string
+	DryRun                 bool     // only log the mutating calls to Cloudflare, Kubernetes and cloudflared
+	Command                []string // positional arguments, e.g. the match subcommand
 	AccessGroup            struct {
 		ConfigMapsNames []string
 	}
@@ -36,4 +58,34 @@ type CFControllerConfig struct {
 		RenewDeadline time.Duration
 		RetryPeriod   time.Duration
 	}
+	DNS struct {
+		// interval of the full sweep over the owned records, 0 disables the
+		// garbage collection of DNS records
+		GCInterval time.Duration
+		// removed hostnames are deleted after this delay, so a hostname can
+		// move between tunnels without being deleted
+		GCDelay time.Duration
+	}
+	IngressClass struct {
+		// IngressClasses with this spec.controller are served by us
+		Controller string
+	}
+	Preflight struct {
+		// the token is checked again every Interval, 0 only checks at start
+		Interval time.Duration
+		// Access is checked and required
+		Access bool
+	}
+	Connectors struct {
+		// 0 means every replica runs every tunnel
+		Default       int
+		LeaseDuration time.Duration
+		RenewInterval time.Duration
+	}
+}
+
+// RemoteManaged is true if the ingress rules are pushed to the tunnel
+// configuration of cloudflare instead of the local config.yaml
+func (c *CFControllerCloudflareConfig) RemoteManaged() bool {
+	return c.ConfigSrc == "cloudflare"
 }
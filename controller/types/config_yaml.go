@@ -7,21 +7,69 @@ import (
 type CFConfigOriginRequest struct {
 	NoTLSVerify    bool   `yaml:"noTLSVerify" json:"noTLSVerify"`
 	HttpHostHeader string `yaml:"httpHostHeader,omitempty"`
+	Http2Origin    bool   `yaml:"http2Origin,omitempty"`
 }
 
+// CFConfigIngressMeta is only used by the controller, it is stripped
+// before the config is passed to cloudflared
+type CFConfigIngressMeta struct {
+	Priority    int               `yaml:"priority,omitempty"`
+	DNSConflict DNSConflictPolicy `yaml:"dnsConflict,omitempty"`
+	// kind/namespace/name of the object the rule was generated from
+	Source string `yaml:"source,omitempty"`
+	// options of the DNS record, nil proxied means proxied
+	DNSProxied *bool  `yaml:"dnsProxied,omitempty"`
+	DNSTTL     int    `yaml:"dnsTTL,omitempty"`
+	DNSComment string `yaml:"dnsComment,omitempty"`
+	// the hostname is published through the load balancer of all clusters
+	LoadBalancer bool `yaml:"loadBalancer,omitempty"`
+	// path of the health monitor of the pool, default /
+	LBMonitorPath string `yaml:"lbMonitorPath,omitempty"`
+	// the source object keeps the tunnel if the tunnel ConfigMap is deleted
+	DeletionProtection bool `yaml:"deletionProtection,omitempty"`
+}
+
+// DNSConflictPolicy decides what happens if the DNS record of a hostname
+// exists and does not point to the tunnel
+type DNSConflictPolicy string
+
+const (
+	DNSConflictSkip      DNSConflictPolicy = "skip"
+	DNSConflictOverwrite DNSConflictPolicy = "overwrite"
+	DNSConflictFail      DNSConflictPolicy = "fail"
+)
+
 type CFConfigIngress struct {
 	Hostname      string                 `yaml:"hostname,omitempty"`
 	Path          string                 `yaml:"path,omitempty"`
 	Service       string                 `yaml:"service,omitempty"`
 	OriginRequest *CFConfigOriginRequest `yaml:"originRequest,omitempty"`
+	Meta          *CFConfigIngressMeta   `yaml:"meta,omitempty"`
+}
+
+type CFConfigWarpRouting struct {
+	Enabled bool `yaml:"enabled"`
 }
 
 type CFConfigYaml struct {
-	Tunnel          string            `yaml:"tunnel"`
-	CredentialsFile string            `yaml:"credentials-file"`
-	Ingress         []CFConfigIngress `yaml:"ingress"`
+	Tunnel          string               `yaml:"tunnel"`
+	CredentialsFile string               `yaml:"credentials-file"`
+	Ingress         []CFConfigIngress    `yaml:"ingress,omitempty"`
+	WarpRouting     *CFConfigWarpRouting `yaml:"warp-routing,omitempty"`
 }
 
+// CFPrivateRoute is a network which WARP clients reach through the tunnel
+type CFPrivateRoute struct {
+	Network string `yaml:"network"`
+	// name of the virtual network, empty is the default network
+	VirtualNetwork string `yaml:"virtualNetwork,omitempty"`
+	// the source object keeps the tunnel if the tunnel ConfigMap is deleted
+	DeletionProtection bool `yaml:"deletionProtection,omitempty"`
+}
+
+// data keys of the tunnel ConfigMap with private routes instead of rules
+const PrivateRoutesKeyPrefix = "private-routes."
+
 type CFTunnelSecret struct {
 	AccountTag   string    `json:"AccountTag"`
 	TunnelSecret string    `json:"TunnelSecret"`
@@ -0,0 +1,10 @@
+package types
+
+// CFCredentials is a Cloudflare account read from the Secret referenced by
+// the credentials-secret annotation of a tunnel ConfigMap or its namespace
+type CFCredentials struct {
+	// namespace/name of the Secret
+	Secret    string
+	ApiToken  string
+	AccountId string
+}
@@ -0,0 +1,69 @@
+package types
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// PlanEntry is a mutating call which was intercepted by the dry-run
+type PlanEntry struct {
+	Time time.Time
+	// cloudflare, kubernetes or cloudflared
+	Target string
+	// http method or start
+	Action string
+	// api path or tunnel name
+	Object string
+	Detail string
+}
+
+// Plan collects the intercepted calls of a dry-run
+type Plan struct {
+	lock    sync.Mutex
+	entries []PlanEntry
+}
+
+// Record logs the entry as plan entry and keeps it for the summary
+func (p *Plan) Record(log *zerolog.Logger, entry PlanEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	log.Info().Str("planTarget", entry.Target).Str("planAction", entry.Action).
+		Str("planObject", entry.Object).Str("planDetail", entry.Detail).Msg("Dry-run, skipped call")
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.entries = append(p.entries, entry)
+}
+
+func (p *Plan) Entries() []PlanEntry {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]PlanEntry{}, p.entries...)
+}
+
+// WriteSummary writes the count of every target and action followed by
+// all entries
+func (p *Plan) WriteSummary(w io.Writer) {
+	entries := p.Entries()
+	counts := map[string]int{}
+	for _, e := range entries {
+		counts[e.Target+" "+e.Action]++
+	}
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(w, "Dry-run plan: %d intercepted calls\n", len(entries))
+	for _, k := range keys {
+		fmt.Fprintf(w, "  %5d %s\n", counts[k], k)
+	}
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s %s %s %s %s\n", e.Time.Format(time.RFC3339), e.Target, e.Action, e.Object, e.Detail)
+	}
+}
@@ -48,12 +48,21 @@ func (cft *CFTunnelParameter) K8SSecretName() K8SResourceName {
 	return buildK8SResourceName("cfd-tunnel-key", cft)
 }
 
+// K8SDeletionName is the Lease which keeps the pending deletion of the tunnel
+func (cft *CFTunnelParameter) K8SDeletionName() K8SResourceName {
+	return buildK8SResourceName("cfd-tunnel-del", cft)
+}
+
 type TunnelConfigMaps interface {
 	Register(func([]*corev1.ConfigMap, watch.Event)) func()
 	Get() []*corev1.ConfigMap
 
 	UpsertConfigMap(cfc CFController, tparam *CFTunnelParameter, kind string, meta *metav1.ObjectMeta, cfcis []CFConfigIngress) error
 	RemoveConfigMap(cfc CFController, kind string, meta *metav1.ObjectMeta)
+	// RemoveConfigMapExcept removes the rules of meta from every tunnel but keep
+	RemoveConfigMapExcept(cfc CFController, kind string, meta *metav1.ObjectMeta, keep []*CFTunnelParameter)
+	UpsertPrivateRoutes(cfc CFController, tparam *CFTunnelParameter, kind string, meta *metav1.ObjectMeta, routes []CFPrivateRoute) error
+	RemovePrivateRoutes(cfc CFController, kind string, meta *metav1.ObjectMeta)
 	// func (cfmh *CloudFlaredConfigMapHandler) WriteCloudflaredConfig(cfc types.CFController, kind string, resName string, tp *UpsertTunnelParams, cts *CFTunnelSecret, cfcis []config.CFConfigIngress) error {
 	// func (cfmh *CloudFlaredConfigMapHandler) RemoveFromCloudflaredConfig(cfc types.CFController, kind string, meta *metav1.ObjectMeta) {
 
@@ -0,0 +1,55 @@
+package types
+
+import (
+	"context"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	v1 "k8s.io/client-go/kubernetes/typed/networking/v1"
+
+	netv1 "k8s.io/api/networking/v1"
+)
+
+type WatcherBindingIngressClass struct {
+	item netv1.IngressClass
+}
+
+func (nl WatcherBindingIngressClass) GetUID() types.UID {
+	return nl.item.GetUID()
+}
+
+func (nl WatcherBindingIngressClass) GetItem() *netv1.IngressClass {
+	return &nl.item
+}
+
+type WatcherBindingIngressClassList struct {
+	list *netv1.IngressClassList
+}
+
+func (nl *WatcherBindingIngressClassList) GetItems() []WatcherBindingIngressClass {
+	ret := make([]WatcherBindingIngressClass, 0, len(nl.list.Items))
+	for _, item := range nl.list.Items {
+		ret = append(ret, WatcherBindingIngressClass{
+			item: item,
+		})
+	}
+	return ret
+}
+
+type WatcherBindingIngressClassClient struct {
+	Cif v1.IngressClassInterface
+}
+
+func (nl WatcherBindingIngressClassClient) Watch(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+	return nl.Cif.Watch(ctx, options)
+}
+
+func (nl WatcherBindingIngressClassClient) List(ctx context.Context, options metav1.ListOptions) (K8SList[*netv1.IngressClass, WatcherBindingIngressClass], error) {
+	list, err := nl.Cif.List(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	ret := WatcherBindingIngressClassList{list: list}
+	return &ret, nil
+}
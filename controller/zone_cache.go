@@ -0,0 +1,158 @@
+package controller
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// zoneCache holds the zones of the account. It is refreshed in the
+// background every ttl, hostnames without zone are remembered for
+// negativeTTL so misses do not hit the API every time. The lock is never
+// held while the zones are fetched.
+type zoneCache struct {
+	log         *zerolog.Logger
+	fetch       func() (map[string]string, error)
+	ttl         time.Duration
+	negativeTTL time.Duration
+	now         func() time.Time
+
+	// serializes the fetches, readers are not blocked by it
+	refreshLock sync.Mutex
+
+	lock     sync.RWMutex
+	loadedAt time.Time
+	// key zone name, value zone id
+	zones map[string]string
+	// key hostname, value expiry of the negative entry
+	misses map[string]time.Time
+}
+
+func newZoneCache(log *zerolog.Logger, ttl, negativeTTL time.Duration, fetch func() (map[string]string, error)) *zoneCache {
+	return &zoneCache{
+		log:         log,
+		fetch:       fetch,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		now:         time.Now,
+		zones:       make(map[string]string),
+		misses:      make(map[string]time.Time),
+	}
+}
+
+// refresh fetches the zones unless they were loaded after since
+func (zc *zoneCache) refresh(since time.Time) error {
+	zc.refreshLock.Lock()
+	defer zc.refreshLock.Unlock()
+	zc.lock.RLock()
+	loadedAt := zc.loadedAt
+	zc.lock.RUnlock()
+	if loadedAt.After(since) {
+		// someone else refreshed while we waited
+		return nil
+	}
+	zones, err := zc.fetch()
+	if err != nil {
+		zc.log.Error().Err(err).Msg("Failed to refresh zones")
+		return err
+	}
+	zc.lock.Lock()
+	zc.zones = zones
+	zc.loadedAt = zc.now()
+	// keep the misses until they expire, only a hostname which now has
+	// a zone is forgotten
+	names := zoneNames(zones)
+	for hostname, expires := range zc.misses {
+		if _, found := longestSuffixZone(hostname, names); found || !zc.loadedAt.Before(expires) {
+			delete(zc.misses, hostname)
+		}
+	}
+	zc.lock.Unlock()
+	zc.log.Debug().Int("zones", len(zones)).Msg("Refreshed zones")
+	return nil
+}
+
+func (zc *zoneCache) snapshot() (map[string]string, time.Time) {
+	zc.lock.RLock()
+	defer zc.lock.RUnlock()
+	return zc.zones, zc.loadedAt
+}
+
+// Zones returns the cached zones, loads them on first use
+func (zc *zoneCache) Zones() (map[string]string, error) {
+	zones, loadedAt := zc.snapshot()
+	if loadedAt.IsZero() {
+		err := zc.refresh(loadedAt)
+		if err != nil {
+			return nil, err
+		}
+		zones, _ = zc.snapshot()
+	}
+	ret := make(map[string]string, len(zones))
+	for k, v := range zones {
+		ret[k] = v
+	}
+	return ret, nil
+}
+
+func zoneNames(zones map[string]string) []string {
+	ret := make([]string, 0, len(zones))
+	for name := range zones {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Lookup returns the zone name and id of hostname. An unknown hostname
+// refreshes the zones once per negativeTTL.
+func (zc *zoneCache) Lookup(hostname string) (string, string, bool, error) {
+	zones, err := zc.Zones()
+	if err != nil {
+		return "", "", false, err
+	}
+	if zone, found := longestSuffixZone(hostname, zoneNames(zones)); found {
+		return zone, zones[zone], true, nil
+	}
+	zc.lock.RLock()
+	expires, negative := zc.misses[hostname]
+	loadedAt := zc.loadedAt
+	zc.lock.RUnlock()
+	if negative && zc.now().Before(expires) {
+		return "", "", false, nil
+	}
+	err = zc.refresh(loadedAt)
+	if err != nil {
+		return "", "", false, err
+	}
+	zones, _ = zc.snapshot()
+	if zone, found := longestSuffixZone(hostname, zoneNames(zones)); found {
+		return zone, zones[zone], true, nil
+	}
+	zc.lock.Lock()
+	zc.misses[hostname] = zc.now().Add(zc.negativeTTL)
+	zc.lock.Unlock()
+	return "", "", false, nil
+}
+
+// start refreshes the zones every ttl until ctx is done
+func (zc *zoneCache) start(ctx context.Context) {
+	if zc.ttl <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(zc.ttl)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				zc.refresh(zc.now())
+			}
+		}
+	}()
+}
@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeZones struct {
+	lock    sync.Mutex
+	fetches int
+	zones   map[string]string
+	err     error
+}
+
+func (fz *fakeZones) fetch() (map[string]string, error) {
+	fz.lock.Lock()
+	defer fz.lock.Unlock()
+	fz.fetches++
+	if fz.err != nil {
+		return nil, fz.err
+	}
+	ret := make(map[string]string, len(fz.zones))
+	for k, v := range fz.zones {
+		ret[k] = v
+	}
+	return ret, nil
+}
+
+func TestZoneCacheLookup(t *testing.T) {
+	log := zerolog.Nop()
+	fz := &fakeZones{zones: map[string]string{"example.com": "id-1", "dev.example.com": "id-2"}}
+	zc := newZoneCache(&log, time.Hour, time.Minute, fz.fetch)
+
+	zone, id, found, err := zc.Lookup("a.dev.example.com")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "dev.example.com", zone)
+	assert.Equal(t, "id-2", id)
+	_, _, found, _ = zc.Lookup("www.example.com")
+	assert.True(t, found)
+	assert.Equal(t, 1, fz.fetches)
+}
+
+func TestZoneCacheNegative(t *testing.T) {
+	log := zerolog.Nop()
+	now := time.Now()
+	fz := &fakeZones{zones: map[string]string{"example.com": "id-1"}}
+	zc := newZoneCache(&log, time.Hour, time.Minute, fz.fetch)
+	zc.now = func() time.Time { return now }
+
+	_, _, found, err := zc.Lookup("www.example.org")
+	assert.NoError(t, err)
+	assert.False(t, found)
+	// initial load and the refresh of the miss
+	assert.Equal(t, 2, fz.fetches)
+	_, _, found, _ = zc.Lookup("www.example.org")
+	assert.False(t, found)
+	assert.Equal(t, 2, fz.fetches)
+
+	fz.zones["example.org"] = "id-2"
+	now = now.Add(2 * time.Minute)
+	zone, id, found, err := zc.Lookup("www.example.org")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "example.org", zone)
+	assert.Equal(t, "id-2", id)
+	assert.Equal(t, 3, fz.fetches)
+}
+
+func TestZoneCacheNegativeAlternating(t *testing.T) {
+	log := zerolog.Nop()
+	now := time.Now()
+	fz := &fakeZones{zones: map[string]string{"example.com": "id-1"}}
+	zc := newZoneCache(&log, time.Hour, time.Minute, fz.fetch)
+	zc.now = func() time.Time { return now }
+
+	// initial load and one refresh per unknown hostname
+	for i := 0; i < 5; i++ {
+		_, _, found, err := zc.Lookup("a.example.org")
+		assert.NoError(t, err)
+		assert.False(t, found)
+		_, _, found, err = zc.Lookup("b.example.net")
+		assert.NoError(t, err)
+		assert.False(t, found)
+		now = now.Add(time.Second)
+	}
+	assert.Equal(t, 3, fz.fetches)
+
+	now = now.Add(time.Minute)
+	_, _, found, _ := zc.Lookup("a.example.org")
+	assert.False(t, found)
+	assert.Equal(t, 4, fz.fetches)
+}
+
+func TestZoneCacheRefreshError(t *testing.T) {
+	log := zerolog.Nop()
+	fz := &fakeZones{err: fmt.Errorf("api down")}
+	zc := newZoneCache(&log, time.Hour, time.Minute, fz.fetch)
+	_, err := zc.Zones()
+	assert.Error(t, err)
+
+	fz.err = nil
+	fz.zones = map[string]string{"example.com": "id-1"}
+	zones, err := zc.Zones()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"example.com": "id-1"}, zones)
+}
+
+func TestZoneCacheConcurrentLoad(t *testing.T) {
+	log := zerolog.Nop()
+	fz := &fakeZones{zones: map[string]string{"example.com": "id-1"}}
+	zc := newZoneCache(&log, time.Hour, time.Minute, fz.fetch)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			zc.Lookup("www.example.com")
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, fz.fetches)
+}
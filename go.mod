@@ -7,6 +7,7 @@ require (
 	github.com/cloudflare/cloudflared v0.0.0-20230417170412-3996b1adcad2
 	github.com/joho/godotenv v1.5.1
 	github.com/stretchr/testify v1.8.4
+	golang.org/x/time v0.3.0
 	k8s.io/api v0.27.1
 	k8s.io/client-go v0.27.1
 )
@@ -60,7 +61,6 @@ require (
 	golang.org/x/sys v0.13.0 // indirect
 	golang.org/x/term v0.13.0 // indirect
 	golang.org/x/text v0.13.0 // indirect
-	golang.org/x/time v0.3.0 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	google.golang.org/protobuf v1.28.1 // indirect
 	gopkg.in/inf.v0 v0.9.1 // indirect
@@ -18,9 +18,12 @@ import (
 	"github.com/mabels/cloudflared-controller/controller"
 	"github.com/mabels/cloudflared-controller/controller/cloudflared"
 	"github.com/mabels/cloudflared-controller/controller/config"
+	"github.com/mabels/cloudflared-controller/controller/debug"
 	"github.com/mabels/cloudflared-controller/controller/ingress"
 	"github.com/mabels/cloudflared-controller/controller/k8s_data"
 	"github.com/mabels/cloudflared-controller/controller/leader"
+	"github.com/mabels/cloudflared-controller/controller/placement"
+	"github.com/mabels/cloudflared-controller/controller/preflight"
 	"github.com/mabels/cloudflared-controller/controller/svc"
 	"github.com/mabels/cloudflared-controller/controller/types"
 	"github.com/mabels/cloudflared-controller/controller/watcher"
@@ -102,6 +105,13 @@ func main() {
 			cfc.Log().Fatal().Err(err).Msg("Failed to get kubeconfig")
 		}
 	}
+	if cfc.Cfg().DryRun {
+		cfc.Log().Warn().Msg("Dry-run, mutating calls are only logged")
+		config.Wrap(controller.K8sDryRun(cfc))
+		cfc.RegisterShutdown(func() {
+			cfc.Plan().WriteSummary(os.Stdout)
+		})
+	}
 	k8s, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		cfc.Log().Fatal().Err(err).Msg("Error building kubernetes clientset")
@@ -110,6 +120,29 @@ func main() {
 
 	cfc.Rest().K8s().CoreV1().Namespaces()
 
+	if len(cfc.Cfg().Command) > 0 {
+		switch cfc.Cfg().Command[0] {
+		case "match":
+			err := debug.RunMatch(cfc, cfc.Cfg().Command[1:], os.Stdout)
+			if err != nil {
+				cfc.Log().Fatal().Err(err).Msg("match failed")
+			}
+			os.Exit(0)
+		case "preflight":
+			report := preflight.Run(cfc)
+			report.WriteMatrix(os.Stdout)
+			if !report.Ready() {
+				os.Exit(1)
+			}
+			os.Exit(0)
+		default:
+			cfc.Log().Fatal().Strs("command", cfc.Cfg().Command).Msg("unknown command")
+		}
+	}
+	if cfc.Cfg().DebugAddr != "" {
+		cfc.RegisterShutdown(debug.Start(cfc))
+	}
+
 	cfc.K8sData().Namespaces, err = watchedNamespaces(cfc)
 	if err != nil {
 		cfc.Log().Fatal().Err(err).Msg("Failed to start namespace watcher")
@@ -124,14 +157,30 @@ func main() {
 
 	if !cfc.Cfg().NoCloudFlared {
 		cfc.K8sData().TunnelConfigMaps = k8s_data.StartWaitForTunnelConfigMaps(cfc)
+		members := placement.StartMembers(cfc)
+		cfc.RegisterShutdown(members.Stop)
 		cfc.RegisterShutdown(
 			cfc.K8sData().TunnelConfigMaps.Register(
-				cloudflared.ConfigMapHandlerStartCloudflared(cfc)))
+				cloudflared.ConfigMapHandlerStartCloudflared(cfc, members)))
 	}
 
+	checker := preflight.Start(cfc)
+	cfc.RegisterShutdown(checker.Stop)
 	for {
+		if !checker.Ready() {
+			cfc.Log().Warn().Strs("missing", checker.Report().Missing()).Msg("Preflight failed, not running for leader")
+			time.Sleep(time.Second * 30)
+			continue
+		}
+		// a failed preflight gives up the leadership
+		ctx, cancel := context.WithCancel(cfc.Context())
+		unregPreflight := checker.Register(func(report *preflight.Report) {
+			if !report.Ready() {
+				cancel()
+			}
+		})
 		runningLeaders := []func(){}
-		leader.LeaderSelection(cfc, leaderelection.LeaderCallbacks{
+		leader.LeaderSelection(ctx, cfc, leaderelection.LeaderCallbacks{
 			OnStartedLeading: func(c context.Context) {
 				if len(runningLeaders) > 0 {
 					cfc.Log().Fatal().Msg("Already running leader")
@@ -142,7 +191,8 @@ func main() {
 					runningLeaders = append(runningLeaders,
 						ingress.Start(cfc),
 						svc.Start(cfc),
-						cloudflared.ConfigMapHandlerPrepareCloudflared(cfc))
+						cloudflared.ConfigMapHandlerPrepareCloudflared(cfc),
+						cloudflared.StartDNSGarbageCollector(cfc))
 				}()
 			},
 			OnStoppedLeading: func() {
@@ -163,6 +213,8 @@ func main() {
 				cfc.Log().Info().Str("id", cfc.Cfg().Identity).Msgf("new leader is %s", current_id)
 			},
 		})
+		unregPreflight()
+		cancel()
 		time.Sleep(time.Second * 5)
 		cfc.Log().Info().Msg("Restarting leader selection")
 	}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// hostCIDR returns the single address network of ip
+func hostCIDR(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.String() + "/32"
+	}
+	return ip.String() + "/128"
+}
+
+// ParsePrivateRoute parses the private-route annotation. true routes the
+// given clusterIPs, false nothing, otherwise it is a comma separated list of
+// CIDRs or addresses.
+func ParsePrivateRoute(value string, clusterIPs []string) ([]string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+	if enabled, err := strconv.ParseBool(value); err == nil {
+		if !enabled {
+			return nil, nil
+		}
+		ret := []string{}
+		for _, clusterIP := range clusterIPs {
+			ip := net.ParseIP(clusterIP)
+			if ip == nil {
+				// headless services have no address
+				continue
+			}
+			ret = append(ret, hostCIDR(ip))
+		}
+		return ret, nil
+	}
+	ret := []string{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if ip := net.ParseIP(part); ip != nil {
+			ret = append(ret, hostCIDR(ip))
+			continue
+		}
+		_, network, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid private route %s: %v", part, err)
+		}
+		ret = append(ret, network.String())
+	}
+	return ret, nil
+}
@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePrivateRoute(t *testing.T) {
+	routes, err := ParsePrivateRoute("true", []string{"10.43.0.10", "fd00::10", "None"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.43.0.10/32", "fd00::10/128"}, routes)
+
+	routes, err = ParsePrivateRoute("false", []string{"10.43.0.10"})
+	assert.NoError(t, err)
+	assert.Nil(t, routes)
+
+	routes, err = ParsePrivateRoute(" 10.1.0.0/16, 192.168.1.7,10.2.3.4/8", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.1.0.0/16", "192.168.1.7/32", "10.0.0.0/8"}, routes)
+
+	_, err = ParsePrivateRoute("10.1.0.0/33", nil)
+	assert.Error(t, err)
+}